@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// handles are 1 to 16 underscores, digits and ASCII letters
+var handlerx = regexp.MustCompile("^[_0-9A-Za-z]{1,16}$")
+// fully-qualified domain name without the trailing dot
+var hostrx = regexp.MustCompile("^(?:(?:(?:[a-zA-Z0-9][-a-zA-Z0-9]*)?[a-zA-Z0-9])[.])*(?:[a-zA-Z][-a-zA-Z0-9]*[a-zA-Z0-9]|[a-zA-Z])$")
+
+// an address is a user on some host, written handle!host
+type Address struct {
+	Handle string
+	Host string
+}
+
+// handles that can't be registered, because they could be mistaken for the host's staff or the system itself
+// more can be added with reservedhandle in the [policy] config section
+var reservedHandles = []string{
+	"abuse", "admin", "administrator", "anonymous", "api", "guest", "help", "hostmaster", "imp", "info",
+	"moderator", "noreply", "official", "postmaster", "root", "security", "staff", "support", "system", "webmaster",
+}
+
+func IsValidHandle(handle string) bool {
+	return handlerx.MatchString(handle)
+}
+
+// handles are case-insensitive, so reserving "admin" reserves "ADMIN" too
+func IsReservedHandle(handle string) bool {
+	for _, reserved := range append(reservedHandles, cfg.Policy.ReservedHandle...) {
+		if strings.EqualFold(handle, strings.TrimSpace(reserved)) {
+			return true
+		}
+	}
+	return false
+}
+
+func ParseAddress(s string) (*Address, error) {
+	parts := strings.Split(s, "!")
+	if len(parts) != 2 {
+		return nil, errors.New("Address must be in the form handle!host.")
+	}
+	a := &Address{Handle: parts[0], Host: parts[1]}
+	if !IsValidHandle(a.Handle) {
+		return nil, errors.New("Invalid handle in address.")
+	}
+	if !hostrx.MatchString(a.Host) {
+		return nil, errors.New("Invalid host in address.")
+	}
+	return a, nil
+}
+
+// like ParseAddress, but the handle may be * to match everyone at the host, e.g. *!example.com
+func ParseAddressPattern(s string) (*Address, error) {
+	if strings.HasPrefix(s, "*!") {
+		host := s[2:]
+		if !hostrx.MatchString(host) {
+			return nil, errors.New("Invalid host in address.")
+		}
+		return &Address{Handle: "*", Host: host}, nil
+	}
+	return ParseAddress(s)
+}
+
+func (a *Address) String() string {
+	return a.Handle + "!" + a.Host
+}
+
+// true if this address belongs to a user of this host
+func (a *Address) IsLocal() bool {
+	return strings.EqualFold(a.Host, cfg.Api.Host)
+}
+
+func LocalAddress(handle string) *Address {
+	return &Address{Handle: handle, Host: cfg.Api.Host}
+}
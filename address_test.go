@@ -0,0 +1,58 @@
+package main
+
+import "testing"
+
+func TestParseAddressPattern(t *testing.T) {
+	tests := []struct {
+		s string
+		handle string
+		host string
+		ok bool
+	}{
+		{"bob!example.com", "bob", "example.com", true},
+		{"Bob_2!imp.example.co.uk", "Bob_2", "imp.example.co.uk", true},
+		{"*!example.com", "*", "example.com", true},
+		{"*!localhost", "*", "localhost", true},
+		{"abcdefghijklmnop!example.com", "abcdefghijklmnop", "example.com", true},
+
+		{"", "", "", false},
+		{"bob", "", "", false},
+		{"bob!", "", "", false},
+		{"!example.com", "", "", false},
+		{"*!", "", "", false},
+		{"*bob!example.com", "", "", false},
+		{"bob*!example.com", "", "", false},
+		{"bob!*", "", "", false},
+		{"bob!example.com!other.com", "", "", false},
+		{"*!example.com!other.com", "", "", false},
+		{"abcdefghijklmnopq!example.com", "", "", false},
+		{"bo-b!example.com", "", "", false},
+		{"bob!example.com.", "", "", false},
+		{"bob!-example.com", "", "", false},
+		{"bob!example.123", "", "", false},
+		{"bob!exa mple.com", "", "", false},
+		{"bob!example.com:5039", "", "", false},
+	}
+	for _, test := range tests {
+		a, err := ParseAddressPattern(test.s)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("ParseAddressPattern(%q) = %v, want an error", test.s, a)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseAddressPattern(%q) failed: %v", test.s, err)
+			continue
+		}
+		if a.Handle != test.handle || a.Host != test.host {
+			t.Errorf("ParseAddressPattern(%q) = %q!%q, want %q!%q", test.s, a.Handle, a.Host, test.handle, test.host)
+		}
+	}
+}
+
+func TestParseAddressRejectsWildcard(t *testing.T) {
+	if a, err := ParseAddress("*!example.com"); err == nil {
+		t.Errorf("ParseAddress(\"*!example.com\") = %v, want an error", a)
+	}
+}
@@ -0,0 +1,673 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An archive is everything needed to recreate a user's account on another IMP host.
+// Addresses and hosts are always written in full, since the archive's host is not the host it will be imported to.
+
+const (
+	ArchiveFormat = "imp-archive"
+	ArchiveVersion = 1
+)
+
+type Archive struct {
+	Format string
+	Version int
+	// the user's address on the host the archive came from
+	Address string
+	ExportedDate int64
+	Profile ArchiveProfile
+	Notes []ArchiveNote
+	Groups []ArchiveGroup
+	Mutes []string
+	Blocks []string
+	Follows []string
+	Bookmarks []ArchiveBookmark
+}
+
+type ArchiveProfile struct {
+	Status string
+	StatusLink string
+	StatusMentions []ArchiveMention
+	Biography string
+	BiographyLink string
+	BiographyMentions []ArchiveMention
+	ReplyPolicy string
+	JoinedDate int64
+}
+
+type ArchiveNote struct {
+	// IDs only relate notes in the same archive to each other
+	NoteId int64
+	Text string
+	Link string
+	LinkType string
+	Date int64
+	Edited bool
+	GroupId int64
+	Mentions []ArchiveMention
+	ReplyToId int64
+	ReplyToHost string
+	ThreadId int64
+	RepostOfId int64
+	RepostOfHost string
+	// the reposted note's JSON, unless it is in the archive
+	RepostCopy string
+	Via string
+}
+
+type ArchiveMention struct {
+	Position int64
+	Address string
+	Resolved bool
+}
+
+type ArchiveGroup struct {
+	GroupId int64
+	Name string
+	Members []string
+}
+
+type ArchiveBookmark struct {
+	NoteId int64
+	NoteHost string
+	Date int64
+}
+
+func ExportArchiveHandler(rw http.ResponseWriter, r *http.Request) {
+	user, ok := listOwnerFromRequest(rw, r)
+	if !ok {
+		return
+	}
+
+	archive, err := BuildArchive(db, user)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sendData(rw, http.StatusOK, archive)
+}
+
+// recreate the archive's contents in the authenticated user's account
+// takes the archive JSON in the archive form value
+func ImportArchiveHandler(rw http.ResponseWriter, r *http.Request) {
+	user, ok := listOwnerFromRequest(rw, r)
+	if !ok {
+		return
+	}
+	// importing notes is posting them
+	if !CanPost(user) {
+		sendError(rw, http.StatusForbidden, "Verify your email address before importing an archive.")
+		return
+	}
+
+	archive := new(Archive)
+	err := json.Unmarshal([]byte(r.PostFormValue("archive")), archive)
+	if err != nil {
+		sendError(rw, http.StatusBadRequest, "The archive is not valid JSON.")
+		return
+	}
+
+	err = ImportArchive(db, user, archive)
+	if err != nil {
+		if _, ok := err.(ArchiveError); ok {
+			sendError(rw, http.StatusBadRequest, err.Error())
+		} else {
+			fmt.Println(err)
+			sendError(rw, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+	sendData(rw, http.StatusOK, map[string]interface{}{
+			"Notes": len(archive.Notes),
+			"Groups": len(archive.Groups),
+		})
+}
+
+// a problem with the archive itself, rather than with the database
+type ArchiveError string
+
+func (e ArchiveError) Error() string {
+	return string(e)
+}
+
+func BuildArchive(db *sqlx.DB, user *User) (*Archive, error) {
+	archive := &Archive{
+		Format: ArchiveFormat,
+		Version: ArchiveVersion,
+		Address: LocalAddress(user.Handle).String(),
+		ExportedDate: time.Now().Unix(),
+		Profile: ArchiveProfile{
+			Status: user.Status,
+			StatusLink: user.StatusLink.String,
+			StatusMentions: []ArchiveMention{},
+			Biography: user.Biography,
+			BiographyLink: user.BiographyLink.String,
+			BiographyMentions: []ArchiveMention{},
+			ReplyPolicy: user.ReplyPolicy,
+			JoinedDate: user.JoinedDate.Time.Unix(),
+		},
+		Notes: []ArchiveNote{},
+		Groups: []ArchiveGroup{},
+		Bookmarks: []ArchiveBookmark{},
+	}
+
+	profileMentions, err := FetchProfileMentions(db, user.UserId)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range profileMentions[ProfileStatus] {
+		archive.Profile.StatusMentions = append(archive.Profile.StatusMentions,
+			ArchiveMention{Position: m.Position, Address: m.Address().String(), Resolved: m.Resolved})
+	}
+	for _, m := range profileMentions[ProfileEssence] {
+		archive.Profile.BiographyMentions = append(archive.Profile.BiographyMentions,
+			ArchiveMention{Position: m.Position, Address: m.Address().String(), Resolved: m.Resolved})
+	}
+
+	// notes are in ID order, so replies and reposts come after the notes they refer to
+	notes := []Note{}
+	err = db.Select(&notes, "SELECT * FROM Note WHERE UserId = ? AND Deleted = 0 AND Pending = 0 ORDER BY NoteId", user.UserId)
+	if err != nil {
+		return nil, err
+	}
+	err = AttachMentions(db, notes)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range notes {
+		a := ArchiveNote{
+			NoteId: n.NoteId,
+			Text: n.Text,
+			Link: n.Link.String,
+			LinkType: n.LinkType.String,
+			Date: n.Date.Time.Unix(),
+			Edited: n.Edited,
+			GroupId: n.GroupId,
+			Mentions: []ArchiveMention{},
+			ReplyToId: n.ReplyToId,
+			ReplyToHost: n.ReplyToHost,
+			ThreadId: n.ThreadId,
+			RepostOfId: n.RepostOfId,
+			RepostOfHost: n.RepostOfHost,
+			RepostCopy: n.RepostCopy.String,
+		}
+		for _, m := range n.Mentions {
+			a.Mentions = append(a.Mentions, ArchiveMention{Position: m.Position, Address: m.Address().String(), Resolved: m.Resolved})
+		}
+		if a.ReplyToId > 0 && len(a.ReplyToHost) == 0 {
+			a.ReplyToHost = cfg.Api.Host
+		}
+		if len(n.ViaHandle) > 0 {
+			a.Via = n.ViaHandle + "!" + n.ViaHost
+		}
+		if a.RepostOfId > 0 && len(a.RepostOfHost) == 0 {
+			a.RepostOfHost = cfg.Api.Host
+			original := new(Note)
+			err = db.Get(original, "SELECT * FROM Note WHERE NoteId = ?", n.RepostOfId)
+			if err == sql.ErrNoRows {
+				// nothing left to repost
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			if original.UserId != user.UserId {
+				// the original won't be on the new host, so take a copy as we would of a remote note
+				visible, err := CanSeeNote(db, original, UserPrincipal(user))
+				if err != nil {
+					return nil, err
+				}
+				if !visible {
+					continue
+				}
+				originals := []Note{*original}
+				err = AttachMentions(db, originals)
+				if err != nil {
+					return nil, err
+				}
+				cached, err := json.Marshal(originals[0].AsMap())
+				if err != nil {
+					return nil, err
+				}
+				a.RepostCopy = string(cached)
+			}
+		}
+		archive.Notes = append(archive.Notes, a)
+	}
+
+	groups := []Group{}
+	err = db.Select(&groups, "SELECT * FROM `Group` WHERE UserId = ? ORDER BY GroupId", user.UserId)
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range groups {
+		members := []GroupMember{}
+		err = db.Select(&members, "SELECT * FROM GroupMember WHERE GroupId = ?", g.GroupId)
+		if err != nil {
+			return nil, err
+		}
+		a := ArchiveGroup{GroupId: g.GroupId, Name: g.Name, Members: []string{}}
+		for _, m := range members {
+			a.Members = append(a.Members, m.Handle + "!" + m.Host)
+		}
+		archive.Groups = append(archive.Groups, a)
+	}
+
+	archive.Mutes, err = archiveAddressList(db, "Mute", user.UserId)
+	if err != nil {
+		return nil, err
+	}
+	archive.Blocks, err = archiveAddressList(db, "Block", user.UserId)
+	if err != nil {
+		return nil, err
+	}
+	archive.Follows, err = archiveAddressList(db, "Follow", user.UserId)
+	if err != nil {
+		return nil, err
+	}
+
+	bookmarks := []Bookmark{}
+	err = db.Select(&bookmarks, "SELECT * FROM Bookmark WHERE UserId = ? ORDER BY CreatedDate", user.UserId)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range bookmarks {
+		a := ArchiveBookmark{NoteId: b.NoteId, NoteHost: b.NoteHost, Date: b.CreatedDate.Time.Unix()}
+		if len(a.NoteHost) == 0 {
+			a.NoteHost = cfg.Api.Host
+		}
+		archive.Bookmarks = append(archive.Bookmarks, a)
+	}
+	return archive, nil
+}
+
+func archiveAddressList(db *sqlx.DB, table string, userId int64) ([]string, error) {
+	entries := []AddressListEntry{}
+	err := db.Select(&entries, "SELECT UserId, Handle, Host FROM `" + table + "` WHERE UserId = ?", userId)
+	if err != nil {
+		return nil, err
+	}
+	list := []string{}
+	for _, e := range entries {
+		list = append(list, e.Handle + "!" + e.Host)
+	}
+	return list, nil
+}
+
+// what is left to do once an archive's contents are in the database
+type importedArchive struct {
+	// notes and profile fields that mention users of other hosts
+	pendingNotes []*Note
+	pendingFields map[string]*Note
+	// reposts of notes on other hosts, whose copies are fetched again rather than taken from the archive
+	remoteReposts []*Note
+}
+
+// add everything in the archive to the user's account
+// either all of it is imported or none of it is
+// nothing in the archive is taken on trust that this host can check for itself: mentions are resolved again,
+// copies of reposted notes are fetched from their hosts, and vias are dropped
+// the notes keep their dates, but are marked as imported, since their dates are only the archive's word
+func ImportArchive(db *sqlx.DB, user *User, archive *Archive) error {
+	if archive.Format != ArchiveFormat || archive.Version != ArchiveVersion {
+		return ArchiveError("Unsupported archive format.")
+	}
+	from, err := ParseAddress(archive.Address)
+	if err != nil {
+		return ArchiveError("The archive's address is invalid.")
+	}
+	if from.IsLocal() {
+		return ArchiveError("The archive came from this host.")
+	}
+	if len(archive.Profile.ReplyPolicy) > 0 && !IsValidReplyPolicy(archive.Profile.ReplyPolicy) {
+		return ArchiveError("The archive's reply policy is invalid.")
+	}
+	if archive.ExportedDate > time.Now().Unix() {
+		return ArchiveError("The archive is dated in the future.")
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	imported, err := importArchive(db, tx, user, archive, from)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	for _, note := range imported.remoteReposts {
+		job := &FederationJob{UserId: user.UserId, Kind: JobRepostCopy, Host: note.RepostOfHost, Method: "GET",
+			Path: "/note/" + strconv.FormatInt(note.RepostOfId, 10), AsGuest: true}
+		err = EnqueueFederationJob(db, job, nil)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	if len(imported.pendingNotes) > 0 || len(imported.pendingFields) > 0 {
+		go func() {
+			for _, note := range imported.pendingNotes {
+				ProcessMentions(db, note, LocalAddress(user.Handle))
+			}
+			for field, note := range imported.pendingFields {
+				ProcessProfileMentions(db, user, field, note)
+			}
+		}()
+	}
+
+	// reading followed users' notes on other hosts needs guest tokens
+	for _, s := range archive.Follows {
+		address, _ := ParseAddress(s)
+		if address.IsLocal() {
+			continue
+		}
+		err = EnsureGuestToken(db, user, address.Host)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	return nil
+}
+
+// the mentions are checked by db, which sees what's already on this host, and everything else is written with tx
+func importArchive(db *sqlx.DB, tx *sqlx.Tx, user *User, archive *Archive, from *Address) (*importedArchive, error) {
+	imported := &importedArchive{pendingFields: map[string]*Note{}}
+	author := LocalAddress(user.Handle)
+
+	if len(archive.Profile.ReplyPolicy) > 0 {
+		user.ReplyPolicy = archive.Profile.ReplyPolicy
+	}
+	if len(archive.Profile.Status) > 140 || len(archive.Profile.Biography) > 140 {
+		return nil, ArchiveError("The archive's status or essence is too long.")
+	}
+	status, err := importMentions(db, archive.Profile.Status, archive.Profile.StatusMentions, author)
+	if err != nil {
+		return nil, err
+	}
+	essence, err := importMentions(db, archive.Profile.Biography, archive.Profile.BiographyMentions, author)
+	if err != nil {
+		return nil, err
+	}
+	user.Status = status.Text
+	user.StatusLink.String = archive.Profile.StatusLink
+	user.StatusLink.Valid = len(archive.Profile.StatusLink) > 0
+	user.StatusPending = status.Pending
+	user.Biography = essence.Text
+	user.BiographyLink.String = archive.Profile.BiographyLink
+	user.BiographyLink.Valid = len(archive.Profile.BiographyLink) > 0
+	user.BiographyPending = essence.Pending
+	_, err = tx.NamedExec("UPDATE User SET Status = :Status, StatusLink = :StatusLink, StatusPending = :StatusPending, " +
+		"Biography = :Biography, BiographyLink = :BiographyLink, BiographyPending = :BiographyPending, ReplyPolicy = :ReplyPolicy " +
+		"WHERE UserId = :UserId", user)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec("DELETE FROM `ProfileMention` WHERE UserId = ?", user.UserId)
+	if err != nil {
+		return nil, err
+	}
+	for field, note := range map[string]*Note{ProfileStatus: status, ProfileEssence: essence} {
+		for _, m := range note.Mentions {
+			_, err = tx.Exec("INSERT INTO `ProfileMention` (`UserId`, `Field`, `Position`, `Handle`, `Host`, `Resolved`) " +
+				"VALUES (?, ?, ?, ?, ?, ?)", user.UserId, field, m.Position, m.Handle, m.Host, m.Resolved)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if note.Pending {
+			imported.pendingFields[field] = note
+		}
+	}
+
+	groupIds := map[int64]int64{}
+	for _, g := range archive.Groups {
+		if len(g.Name) == 0 {
+			return nil, ArchiveError("A group in the archive has no name.")
+		}
+		result, err := tx.Exec("INSERT INTO `Group` (`UserId`, `Name`) VALUES (?, ?)", user.UserId, g.Name)
+		if err != nil {
+			return nil, err
+		}
+		groupIds[g.GroupId], err = result.LastInsertId()
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range g.Members {
+			address, err := ParseAddress(s)
+			if err != nil {
+				return nil, ArchiveError("Invalid group member " + s + ".")
+			}
+			_, err = tx.Exec("INSERT IGNORE INTO GroupMember (`GroupId`, `Handle`, `Host`) VALUES (?, ?, ?)",
+				groupIds[g.GroupId], address.Handle, address.Host)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for table, list := range map[string][]string{"Mute": archive.Mutes, "Block": archive.Blocks, "Follow": archive.Follows} {
+		for _, s := range list {
+			// mutes and blocks may be wildcards
+			address, err := ParseAddressPattern(s)
+			if err != nil || (table == "Follow" && address.Handle == "*") {
+				return nil, ArchiveError("Invalid address " + s + ".")
+			}
+			if address.IsLocal() && strings.EqualFold(address.Handle, user.Handle) {
+				continue
+			}
+			if table == "Follow" {
+				_, err = tx.Exec("INSERT IGNORE INTO `Follow` (`UserId`, `Handle`, `Host`, `CreatedDate`) VALUES (?, ?, ?, ?)",
+					user.UserId, address.Handle, address.Host, time.Now())
+			} else {
+				_, err = tx.Exec("INSERT IGNORE INTO `" + table + "` (`UserId`, `Handle`, `Host`) VALUES (?, ?, ?)",
+					user.UserId, address.Handle, address.Host)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// notes that were local on the archive's host keep their relationships by getting new IDs here
+	noteIds := map[int64]int64{}
+	threadIds := map[int64]int64{}
+	for _, a := range archive.Notes {
+		if len(a.Text) > 140 || (len(a.Text) == 0 && a.RepostOfId == 0) {
+			return nil, ArchiveError("A note in the archive is too long or empty.")
+		}
+		if a.Date <= 0 || a.Date > archive.ExportedDate {
+			return nil, ArchiveError("A note in the archive is dated after the archive was made.")
+		}
+		note, err := importMentions(db, a.Text, a.Mentions, author)
+		if err != nil {
+			return nil, err
+		}
+		note.UserId = user.UserId
+		note.Edited = a.Edited
+		note.Link.String = a.Link
+		note.Link.Valid = len(a.Link) > 0
+		note.LinkType.String = a.LinkType
+		note.LinkType.Valid = len(a.LinkType) > 0
+		note.Date.Time = time.Unix(a.Date, 0)
+		note.Date.Valid = true
+		note.ImportedFrom = from.String()
+
+		if a.GroupId != 0 {
+			groupId, ok := groupIds[a.GroupId]
+			if !ok {
+				return nil, ArchiveError("A note in the archive belongs to a group that isn't in it.")
+			}
+			note.GroupId = groupId
+		}
+
+		if a.ReplyToId > 0 {
+			note.ReplyToId, note.ReplyToHost = importedNoteRef(a.ReplyToId, a.ReplyToHost, from, noteIds)
+			if len(note.ReplyToHost) == 0 {
+				if parentThread, ok := threadIds[note.ReplyToId]; ok {
+					note.ThreadId = parentThread
+				}
+				if note.ThreadId == 0 {
+					note.ThreadId = note.ReplyToId
+				}
+			}
+		}
+
+		// the via isn't checked here, where there's no one to tell if it's not allowed, so it's left out
+		// the archive's copy of a remote note could say anything, so the repost waits for a fresh one, see JobRepostCopy
+		if a.RepostOfId > 0 {
+			note.RepostOfId, note.RepostOfHost = importedNoteRef(a.RepostOfId, a.RepostOfHost, from, noteIds)
+		}
+
+		result, err := tx.NamedExec("INSERT INTO `Note` (`UserId`, `Text`, `Link`, `LinkType`, `Date`, `Edited`, `GroupId`, `Pending`, " +
+				"`ReplyToId`, `ReplyToHost`, `ThreadId`, `RepostOfId`, `RepostOfHost`, `ImportedFrom`) " +
+				"VALUES (:UserId, :Text, :Link, :LinkType, :Date, :Edited, :GroupId, :Pending, " +
+				":ReplyToId, :ReplyToHost, :ThreadId, :RepostOfId, :RepostOfHost, :ImportedFrom)", note)
+		if err != nil {
+			return nil, err
+		}
+		note.NoteId, err = result.LastInsertId()
+		if err != nil {
+			return nil, err
+		}
+		noteIds[a.NoteId] = note.NoteId
+		threadIds[note.NoteId] = note.ThreadId
+
+		for i := range note.Mentions {
+			note.Mentions[i].NoteId = note.NoteId
+			_, err = tx.NamedExec("INSERT INTO `Mention` (`NoteId`, `Position`, `Handle`, `Host`, `Resolved`) " +
+				"VALUES (:NoteId, :Position, :Handle, :Host, :Resolved)", &note.Mentions[i])
+			if err != nil {
+				return nil, err
+			}
+		}
+		if note.Pending {
+			imported.pendingNotes = append(imported.pendingNotes, note)
+		}
+		if len(note.RepostOfHost) > 0 {
+			imported.remoteReposts = append(imported.remoteReposts, note)
+		}
+	}
+
+	for _, b := range archive.Bookmarks {
+		noteId, noteHost := importedNoteRef(b.NoteId, b.NoteHost, from, noteIds)
+		_, err = tx.Exec("INSERT IGNORE INTO `Bookmark` (`UserId`, `NoteId`, `NoteHost`, `CreatedDate`) VALUES (?, ?, ?, ?)",
+			user.UserId, noteId, noteHost, time.Unix(b.Date, 0))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return imported, nil
+}
+
+// a note with the text and the archive's mentions, resolved again as if it had just been posted
+// mentions that don't resolve and make the text too long are dealt with like ProcessMentions does
+func importMentions(db *sqlx.DB, text string, list []ArchiveMention, author *Address) (*Note, error) {
+	note := &Note{Text: text, Mentions: []Mention{}}
+	for _, m := range list {
+		address, err := ParseAddress(m.Address)
+		if err != nil {
+			return nil, ArchiveError("Invalid mention " + m.Address + ".")
+		}
+		note.Mentions = append(note.Mentions, Mention{Position: m.Position, Handle: address.Handle, Host: address.Host})
+	}
+	ok, err := ResolveLocalMentions(db, note, author)
+	if err != nil {
+		return nil, err
+	}
+	if !ok && !note.Pending {
+		note.Text, note.Mentions = fitUnresolvedMentions(note.Text, note.Mentions)
+	}
+	return note, nil
+}
+
+// translate a reference to a note in the archive into a reference from this host
+// the host is empty if the note is now on this host
+func importedNoteRef(noteId int64, host string, from *Address, noteIds map[int64]int64) (int64, string) {
+	if strings.EqualFold(host, from.Host) {
+		if id, ok := noteIds[noteId]; ok {
+			return id, ""
+		}
+	}
+	if strings.EqualFold(host, cfg.Api.Host) {
+		return noteId, ""
+	}
+	return noteId, host
+}
+
+// handle the export and import commands, which work on the database without running the server
+// returns false if the arguments aren't a command
+func RunCommand(db *sqlx.DB, args []string) (bool, error) {
+	if len(args) < 1 {
+		return false, nil
+	}
+	switch args[0] {
+	case "export":
+		if len(args) < 2 {
+			return true, errors.New("usage: imp export <handle> [archive file]")
+		}
+		user, err := FetchUserByHandle(db, args[1])
+		if err != nil {
+			return true, err
+		}
+		if user == nil {
+			return true, errors.New("There is no user with that handle.")
+		}
+		archive, err := BuildArchive(db, user)
+		if err != nil {
+			return true, err
+		}
+		data, err := json.MarshalIndent(archive, "", "  ")
+		if err != nil {
+			return true, err
+		}
+		if len(args) > 2 {
+			return true, ioutil.WriteFile(args[2], data, 0600)
+		}
+		_, err = os.Stdout.Write(data)
+		return true, err
+
+	case "import":
+		if len(args) < 3 {
+			return true, errors.New("usage: imp import <handle> <archive file>")
+		}
+		user, err := FetchUserByHandle(db, args[1])
+		if err != nil {
+			return true, err
+		}
+		if user == nil {
+			return true, errors.New("There is no user with that handle.")
+		}
+		data, err := ioutil.ReadFile(args[2])
+		if err != nil {
+			return true, err
+		}
+		archive := new(Archive)
+		err = json.Unmarshal(data, archive)
+		if err != nil {
+			return true, err
+		}
+		return true, ImportArchive(db, user, archive)
+
+	case "rehash-tokens":
+		return true, RehashTokens(db)
+	}
+	return false, nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func insertTestNote(t *testing.T, tdb *sqlx.DB, note *Note) int64 {
+	note.Date.Time = time.Now().Add(-time.Hour).Truncate(time.Second)
+	note.Date.Valid = true
+	result, err := tdb.NamedExec("INSERT INTO `Note` (`UserId`, `Text`, `Date`, `GroupId`, `ReplyToId`, `ThreadId`, `RepostOfId`) " +
+		"VALUES (:UserId, :Text, :Date, :GroupId, :ReplyToId, :ThreadId, :RepostOfId)", note)
+	if err != nil {
+		t.Fatal(err)
+	}
+	note.NoteId, err = result.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return note.NoteId
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	tdb := openTestDB(t)
+	useOfflineFederation(t)
+
+	// alice has an account on old.example, and carol one here
+	cfg.Api.Host = "old.example"
+	alice := insertTestUser(t, tdb, "alice")
+	insertTestUser(t, tdb, "carol")
+	group, err := tdb.Exec("INSERT INTO `Group` (`UserId`, `Name`) VALUES (?, 'friends')", alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	groupId, _ := group.LastInsertId()
+	first := insertTestNote(t, tdb, &Note{UserId: alice, Text: "hello"})
+	insertTestNote(t, tdb, &Note{UserId: alice, Text: "again", ReplyToId: first, ThreadId: first})
+	insertTestNote(t, tdb, &Note{UserId: alice, Text: "just us", GroupId: groupId})
+	insertTestNote(t, tdb, &Note{UserId: alice, RepostOfId: first})
+	mentioning := insertTestNote(t, tdb, &Note{UserId: alice, Text: "hi @0"})
+	tdb.MustExec("INSERT INTO `Mention` (`NoteId`, `Position`, `Handle`, `Host`, `Resolved`) VALUES (?, 0, 'carol', ?, 1)", mentioning, testHost)
+	tdb.MustExec("INSERT INTO `Bookmark` (`UserId`, `NoteId`, `NoteHost`, `CreatedDate`) VALUES (?, ?, '', ?)", alice, first, time.Now())
+	tdb.MustExec("INSERT INTO `Mute` (`UserId`, `Handle`, `Host`) VALUES (?, 'dave', 'elsewhere.example')", alice)
+
+	user, _ := FetchUser(tdb, alice)
+	exported, err := BuildArchive(tdb, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exported.Notes) != 5 {
+		t.Fatalf("exported %d notes, want 5", len(exported.Notes))
+	}
+
+	// alice moves here
+	cfg.Api.Host = testHost
+	moved := insertTestUser(t, tdb, "alice2")
+	user, _ = FetchUser(tdb, moved)
+	err = ImportArchive(tdb, user, exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, _ = FetchUser(tdb, moved)
+	archive, err := BuildArchive(tdb, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(archive.Notes) != len(exported.Notes) {
+		t.Fatalf("imported %d notes, want %d", len(archive.Notes), len(exported.Notes))
+	}
+	for i := range archive.Notes {
+		if archive.Notes[i].Text != exported.Notes[i].Text || archive.Notes[i].Date != exported.Notes[i].Date {
+			t.Errorf("note %d is %q from %d, want %q from %d", i, archive.Notes[i].Text, archive.Notes[i].Date,
+				exported.Notes[i].Text, exported.Notes[i].Date)
+		}
+	}
+	notes := archive.Notes
+	if notes[1].ReplyToId != notes[0].NoteId || notes[1].ReplyToHost != testHost || notes[1].ThreadId != notes[0].NoteId {
+		t.Errorf("the reply refers to %d!%s in thread %d, want %d", notes[1].ReplyToId, notes[1].ReplyToHost, notes[1].ThreadId, notes[0].NoteId)
+	}
+	if len(archive.Groups) != 1 || archive.Groups[0].Name != "friends" || notes[2].GroupId != archive.Groups[0].GroupId {
+		t.Errorf("the group note is in group %d of %+v", notes[2].GroupId, archive.Groups)
+	}
+	if notes[3].RepostOfId != notes[0].NoteId || notes[3].RepostOfHost != testHost || len(notes[3].RepostCopy) > 0 {
+		t.Errorf("the repost refers to %d!%s, want a link to %d", notes[3].RepostOfId, notes[3].RepostOfHost, notes[0].NoteId)
+	}
+	// carol is a user of this host now, and she can be mentioned, so the mention resolves right away
+	if len(notes[4].Mentions) != 1 || notes[4].Mentions[0].Address != "carol!" + testHost || !notes[4].Mentions[0].Resolved {
+		t.Errorf("the mentions are %+v, want carol resolved", notes[4].Mentions)
+	}
+	if len(archive.Bookmarks) != 1 || archive.Bookmarks[0].NoteId != notes[0].NoteId || archive.Bookmarks[0].NoteHost != testHost {
+		t.Errorf("the bookmarks are %+v, want the first note", archive.Bookmarks)
+	}
+	if len(archive.Mutes) != 1 || archive.Mutes[0] != "dave!elsewhere.example" {
+		t.Errorf("the mutes are %v", archive.Mutes)
+	}
+
+	var from string
+	tdb.Get(&from, "SELECT ImportedFrom FROM Note WHERE UserId = ? LIMIT 1", moved)
+	if from != "alice!old.example" {
+		t.Errorf("the notes were imported from %q, want alice!old.example", from)
+	}
+}
+
+func TestImportArchiveTrustsNothing(t *testing.T) {
+	tdb := openTestDB(t)
+	useOfflineFederation(t)
+	mallory := insertTestUser(t, tdb, "mallory")
+	insertTestUser(t, tdb, "alice")
+	user, _ := FetchUser(tdb, mallory)
+
+	now := time.Now().Unix()
+	archive := &Archive{
+		Format: ArchiveFormat,
+		Version: ArchiveVersion,
+		Address: "mallory!evil.example",
+		ExportedDate: now,
+		Notes: []ArchiveNote{
+			{NoteId: 1, Text: "hi @0", Date: now - 100, Via: "alice!" + testHost,
+				Mentions: []ArchiveMention{{Position: 0, Address: "ghost!" + testHost, Resolved: true}}},
+			{NoteId: 2, Date: now - 50, RepostOfId: 7, RepostOfHost: "other.example", RepostCopy: `{"Text":"forged"}`},
+		},
+	}
+	err := ImportArchive(tdb, user, archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	notes := []Note{}
+	err = tdb.Select(&notes, "SELECT * FROM Note WHERE UserId = ? ORDER BY NoteId", mallory)
+	if err != nil || len(notes) != 2 {
+		t.Fatalf("imported %d notes, %v", len(notes), err)
+	}
+	if len(notes[0].ViaHandle) > 0 || notes[0].Pending || notes[0].ImportedFrom != "mallory!evil.example" {
+		t.Errorf("imported %+v, want no via, not pending, and imported from mallory!evil.example", notes[0])
+	}
+	err = AttachMentions(tdb, notes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notes[0].Mentions) != 1 || notes[0].Mentions[0].Resolved {
+		t.Errorf("the mentions are %+v, want ghost unresolved", notes[0].Mentions)
+	}
+
+	// the repost has no copy until one comes from its host
+	if notes[1].RepostCopy.Valid {
+		t.Errorf("the repost kept the archive's copy %q", notes[1].RepostCopy.String)
+	}
+	err = AttachReposts(tdb, notes, UserPrincipal(user))
+	if err != nil || notes[1].Original != nil {
+		t.Errorf("AttachReposts = %v with original %v, want no original yet", err, notes[1].Original)
+	}
+	jobs := []FederationJob{}
+	tdb.Select(&jobs, "SELECT * FROM FederationJob WHERE Kind = ?", JobRepostCopy)
+	if len(jobs) != 1 || jobs[0].Host != "other.example" || jobs[0].Path != "/note/7" || !jobs[0].AsGuest {
+		t.Errorf("the repost copy jobs are %+v", jobs)
+	}
+	err = SaveRepostCopy(tdb, mallory, "other.example", 7, map[string]interface{}{"Text": "real", "CanReply": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cached string
+	tdb.Get(&cached, "SELECT RepostCopy FROM Note WHERE NoteId = ?", notes[1].NoteId)
+	if cached != `{"Text":"real"}` {
+		t.Errorf("the repost's copy is %q", cached)
+	}
+}
+
+func TestImportArchiveRejectsNotesDatedAfterTheArchive(t *testing.T) {
+	tdb := openTestDB(t)
+	mallory := insertTestUser(t, tdb, "mallory")
+	user, _ := FetchUser(tdb, mallory)
+
+	now := time.Now().Unix()
+	archive := &Archive{
+		Format: ArchiveFormat,
+		Version: ArchiveVersion,
+		Address: "mallory!evil.example",
+		ExportedDate: now - 3600,
+		Notes: []ArchiveNote{
+			{NoteId: 1, Text: "old", Date: now - 7200},
+			{NoteId: 2, Text: "pinned to the top", Date: now + 86400},
+		},
+	}
+	err := ImportArchive(tdb, user, archive)
+	if _, ok := err.(ArchiveError); !ok {
+		t.Errorf("ImportArchive = %v, want an ArchiveError", err)
+	}
+	var count int
+	tdb.Get(&count, "SELECT COUNT(*) FROM Note")
+	if count != 0 {
+		t.Errorf("%d notes were imported, want none", count)
+	}
+}
+
+func TestImportArchiveRequiresPosting(t *testing.T) {
+	tdb := openTestDB(t)
+	saved := cfg.Policy.RequireValidEmail
+	cfg.Policy.RequireValidEmail = true
+	defer func() { cfg.Policy.RequireValidEmail = saved }()
+
+	mallory := insertTestUser(t, tdb, "mallory")
+	archive := `{"Format":"imp-archive","Version":1,"Address":"mallory!evil.example","Notes":[]}`
+	r := httptest.NewRequest("POST", "/user/mallory/archive", strings.NewReader(url.Values{"archive": {archive}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Authorization", testAuthorization(t, tdb, mallory))
+	r = mux.SetURLVars(r, map[string]string{"handle": "mallory"})
+	rw := httptest.NewRecorder()
+	ImportArchiveHandler(rw, r)
+	if rw.Code != 403 {
+		t.Errorf("status %d, want 403 for a user who hasn't verified their email", rw.Code)
+	}
+}
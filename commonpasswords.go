@@ -0,0 +1,25 @@
+package main
+
+// The most common passwords in published breach lists, which are always rejected,
+// whether or not the [policy] config section names a breachedpasswordfile.
+// Their character mix can make them look harder to guess than they are, like "iloveyou" or "Passw0rd".
+// They are compared in lower case, so "ILoveYou" is rejected too.
+var commonPasswords = map[string]bool{}
+
+func init() {
+	for _, p := range []string{
+		"000000", "00000000", "1111111", "11111111", "112233", "121212", "123123", "123123123", "1234567",
+		"12345678", "123456789", "1234567890", "123321", "123qwe", "131313", "147258369", "159753", "1q2w3e",
+		"1q2w3e4r", "1q2w3e4r5t", "1qaz2wsx", "222222", "555555", "654321", "666666", "696969", "7777777",
+		"888888", "987654321", "aa123456", "abc123", "abcd1234", "access", "admin123", "alexander", "asdfghjkl",
+		"ashley", "azerty", "babygirl", "baseball", "basketball", "batman", "bluesky", "butterfly", "charlie",
+		"chocolate", "computer", "cookie", "daniel", "dragon", "football", "freedom", "friends", "hello123",
+		"hockey", "iloveu", "iloveyou", "iloveyou1", "iloveyou2", "jennifer", "jessica", "jordan23", "letmein",
+		"liverpool", "lovely", "loveme", "lovelove", "master", "michael", "monkey", "mustang", "nicole",
+		"password", "password1", "password12", "password123", "passw0rd", "p@ssw0rd", "p@ssword", "pokemon",
+		"princess", "princess1", "qazwsx", "qwe123", "qwerty", "qwerty1", "qwerty123", "qwertyuiop", "sunshine",
+		"superman", "trustno1", "welcome", "welcome1", "whatever", "zaq12wsx", "zxcvbnm", "zxcvbnm1",
+	} {
+		commonPasswords[p] = true
+	}
+}
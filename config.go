@@ -11,8 +11,12 @@ type Config struct {
 	Server struct {
 		Host string
 		Port string
+		// optional, for answering discovery over plain HTTP
+		HTTPPort string
 		Certificate string
 		Key string
+		TokenKey string
+		SigningKey string
 	}
 	Database struct {
 		Database string
@@ -24,7 +28,18 @@ type Config struct {
 		Address string
 		User string
 		Host string
+		Port string
 		Password string
+		Sink string
+	}
+	Policy struct {
+		RequireValidEmail bool
+		MinimumPasswordLength int
+		MinimumPasswordEntropy int
+		BreachedPasswordFile string
+		ReservedHandle []string
+		TokenIdleDays int
+		TokenLifetimeDays int
 	}
 }
 
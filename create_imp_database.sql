@@ -22,6 +22,146 @@ SET time_zone = "+00:00";
 
 -- --------------------------------------------------------
 
+--
+-- Table structure for table `Block`
+--
+
+CREATE TABLE `Block` (
+  `UserId` int(11) NOT NULL,
+  `Handle` varchar(16) NOT NULL,
+  `Host` varchar(255) NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=latin1;
+
+-- --------------------------------------------------------
+
+--
+-- Table structure for table `Bookmark`
+--
+
+CREATE TABLE `Bookmark` (
+  `UserId` int(11) NOT NULL,
+  `NoteId` int(11) NOT NULL,
+  `NoteHost` varchar(255) NOT NULL DEFAULT '',
+  `CreatedDate` datetime NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=latin1;
+
+-- --------------------------------------------------------
+
+--
+-- Table structure for table `Conversation`
+--
+
+CREATE TABLE `Conversation` (
+`ConversationId` int(11) NOT NULL,
+  `MemberKey` char(64) NOT NULL,
+  `CreatedDate` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=latin1;
+
+-- --------------------------------------------------------
+
+--
+-- Table structure for table `ConversationMember`
+--
+
+CREATE TABLE `ConversationMember` (
+  `ConversationId` int(11) NOT NULL,
+  `Handle` varchar(16) NOT NULL,
+  `Host` varchar(255) NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=latin1;
+
+-- --------------------------------------------------------
+
+--
+-- Table structure for table `EncryptedMessage`
+--
+
+CREATE TABLE `EncryptedMessage` (
+`EncryptedMessageId` int(11) NOT NULL,
+  `UserId` int(11) NOT NULL,
+  `Handle` varchar(16) NOT NULL,
+  `Host` varchar(255) NOT NULL,
+  `Fingerprint` char(64) NOT NULL,
+  `Ciphertext` text NOT NULL,
+  `Date` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=latin1;
+
+-- --------------------------------------------------------
+
+--
+-- Table structure for table `Favorite`
+--
+
+CREATE TABLE `Favorite` (
+  `NoteId` int(11) NOT NULL,
+  `NoteHost` varchar(255) NOT NULL DEFAULT '',
+  `Handle` varchar(16) NOT NULL,
+  `Host` varchar(255) NOT NULL,
+  `CreatedDate` datetime NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=latin1;
+
+-- --------------------------------------------------------
+
+--
+-- Table structure for table `FederationJob`
+--
+
+CREATE TABLE `FederationJob` (
+`JobId` int(11) NOT NULL,
+  `UserId` int(11) NOT NULL DEFAULT '0',
+  `Kind` varchar(32) NOT NULL,
+  `Host` varchar(255) NOT NULL,
+  `Method` varchar(8) NOT NULL,
+  `Path` varchar(512) NOT NULL,
+  `Body` mediumtext NOT NULL,
+  `AsGuest` tinyint(1) NOT NULL DEFAULT '0',
+  `Handle` varchar(16) NOT NULL DEFAULT '',
+  `Status` varchar(16) NOT NULL,
+  `Attempts` int(11) NOT NULL DEFAULT '0',
+  `NextAttemptDate` datetime NOT NULL,
+  `LastError` varchar(255) NOT NULL DEFAULT '',
+  `CreatedDate` datetime NOT NULL,
+  `CompletedDate` datetime DEFAULT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=latin1;
+
+-- --------------------------------------------------------
+
+--
+-- Table structure for table `Follow`
+--
+
+CREATE TABLE `Follow` (
+  `UserId` int(11) NOT NULL,
+  `Handle` varchar(16) NOT NULL,
+  `Host` varchar(255) NOT NULL,
+  `CreatedDate` datetime NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=latin1;
+
+-- --------------------------------------------------------
+
+--
+-- Table structure for table `Group`
+--
+
+CREATE TABLE `Group` (
+`GroupId` int(11) NOT NULL,
+  `UserId` int(11) NOT NULL,
+  `Name` varchar(140) NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=latin1;
+
+-- --------------------------------------------------------
+
+--
+-- Table structure for table `GroupMember`
+--
+
+CREATE TABLE `GroupMember` (
+  `GroupId` int(11) NOT NULL,
+  `Handle` varchar(16) NOT NULL,
+  `Host` varchar(255) NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=latin1;
+
+-- --------------------------------------------------------
+
 --
 -- Table structure for table `Guest`
 --
@@ -30,7 +170,8 @@ CREATE TABLE `Guest` (
 `GuestId` int(11) NOT NULL,
   `Handle` varchar(16) NOT NULL,
   `HostId` int(11) NOT NULL,
-  `Token` varchar(255) NOT NULL,
+  `TokenPrefix` char(8) COLLATE latin1_bin NOT NULL,
+  `TokenHash` char(64) NOT NULL,
   `CreatedDate` datetime NOT NULL
 ) ENGINE=InnoDB DEFAULT CHARSET=latin1;
 
@@ -41,7 +182,7 @@ CREATE TABLE `Guest` (
 --
 
 CREATE TABLE `HandleLimit` (
-  `Handle` varchar(16) NOT NULL,
+  `Handle` varchar(254) NOT NULL,
   `LoginAttemptCount` int(11) NOT NULL,
   `LastAttemptDate` datetime NOT NULL,
   `NextLoginDelay` int(11) NOT NULL
@@ -56,7 +197,11 @@ CREATE TABLE `HandleLimit` (
 CREATE TABLE `Host` (
 `HostId` int(11) NOT NULL,
   `Name` varchar(255) NOT NULL,
-  `Location` varchar(255) NOT NULL DEFAULT ''
+  `Location` varchar(255) NOT NULL DEFAULT '',
+  `Version` varchar(16) NOT NULL DEFAULT '',
+  `LocationDate` datetime DEFAULT NULL,
+  `PublicKey` varchar(64) NOT NULL DEFAULT '',
+  `PublicKeyDate` datetime DEFAULT NULL
 ) ENGINE=InnoDB DEFAULT CHARSET=latin1;
 
 -- --------------------------------------------------------
@@ -74,6 +219,48 @@ CREATE TABLE `IPLimit` (
 
 -- --------------------------------------------------------
 
+--
+-- Table structure for table `Mention`
+--
+
+CREATE TABLE `Mention` (
+  `NoteId` int(11) NOT NULL,
+  `Position` int(11) NOT NULL,
+  `Handle` varchar(16) NOT NULL,
+  `Host` varchar(255) NOT NULL,
+  `Resolved` tinyint(1) NOT NULL DEFAULT '0'
+) ENGINE=InnoDB DEFAULT CHARSET=latin1;
+
+-- --------------------------------------------------------
+
+--
+-- Table structure for table `Message`
+--
+
+CREATE TABLE `Message` (
+`MessageId` int(11) NOT NULL,
+  `ConversationId` int(11) NOT NULL,
+  `Handle` varchar(16) NOT NULL,
+  `Host` varchar(255) NOT NULL,
+  `Text` varchar(140) NOT NULL,
+  `Link` text,
+  `Date` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=latin1;
+
+-- --------------------------------------------------------
+
+--
+-- Table structure for table `Mute`
+--
+
+CREATE TABLE `Mute` (
+  `UserId` int(11) NOT NULL,
+  `Handle` varchar(16) NOT NULL,
+  `Host` varchar(255) NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=latin1;
+
+-- --------------------------------------------------------
+
 --
 -- Table structure for table `Note`
 --
@@ -87,7 +274,76 @@ CREATE TABLE `Note` (
   `Date` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
   `Edited` tinyint(1) NOT NULL DEFAULT '0',
   `Deleted` tinyint(1) NOT NULL DEFAULT '0',
-  `GroupId` int(11) NOT NULL
+  `GroupId` int(11) NOT NULL,
+  `Pending` tinyint(1) NOT NULL DEFAULT '0',
+  `ReplyToId` int(11) NOT NULL DEFAULT '0',
+  `ReplyToHost` varchar(255) NOT NULL DEFAULT '',
+  `ThreadId` int(11) NOT NULL DEFAULT '0',
+  `RepostOfId` int(11) NOT NULL DEFAULT '0',
+  `RepostOfHost` varchar(255) NOT NULL DEFAULT '',
+  `RepostCopy` text,
+  `ViaHandle` varchar(16) NOT NULL DEFAULT '',
+  `ViaHost` varchar(255) NOT NULL DEFAULT '',
+  `ImportedFrom` varchar(273) NOT NULL DEFAULT ''
+) ENGINE=InnoDB DEFAULT CHARSET=latin1;
+
+-- --------------------------------------------------------
+
+--
+-- Table structure for table `ProfileMention`
+--
+
+CREATE TABLE `ProfileMention` (
+  `UserId` int(11) NOT NULL,
+  `Field` varchar(16) NOT NULL,
+  `Position` int(11) NOT NULL,
+  `Handle` varchar(16) NOT NULL,
+  `Host` varchar(255) NOT NULL,
+  `Resolved` tinyint(1) NOT NULL DEFAULT '0'
+) ENGINE=InnoDB DEFAULT CHARSET=latin1;
+
+-- --------------------------------------------------------
+
+--
+-- Table structure for table `PublicKey`
+--
+
+CREATE TABLE `PublicKey` (
+  `UserId` int(11) NOT NULL,
+  `Fingerprint` char(64) NOT NULL,
+  `Key` text NOT NULL,
+  `CreatedDate` datetime NOT NULL,
+  `RetiredDate` datetime DEFAULT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=latin1;
+
+-- --------------------------------------------------------
+
+--
+-- Table structure for table `RemoteFetch`
+--
+
+CREATE TABLE `RemoteFetch` (
+  `UserId` int(11) NOT NULL,
+  `Handle` varchar(16) NOT NULL,
+  `Host` varchar(255) NOT NULL,
+  `FetchedDate` datetime NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=latin1;
+
+-- --------------------------------------------------------
+
+--
+-- Table structure for table `RemoteNote`
+--
+
+CREATE TABLE `RemoteNote` (
+  `UserId` int(11) NOT NULL,
+  `Handle` varchar(16) NOT NULL,
+  `Host` varchar(255) NOT NULL,
+  `NoteId` int(11) NOT NULL,
+  `Date` datetime NOT NULL,
+  `Data` mediumtext NOT NULL,
+  `First` tinyint(1) NOT NULL DEFAULT '0',
+  `FetchedDate` datetime NOT NULL
 ) ENGINE=InnoDB DEFAULT CHARSET=latin1;
 
 -- --------------------------------------------------------
@@ -100,14 +356,23 @@ CREATE TABLE `User` (
 `UserId` int(11) NOT NULL,
   `Handle` varchar(16) NOT NULL,
   `Status` varchar(140) NOT NULL DEFAULT '',
+  `StatusLink` text,
+  `StatusDate` datetime DEFAULT NULL,
+  `StatusPending` tinyint(1) NOT NULL DEFAULT '0',
   `Biography` varchar(140) NOT NULL DEFAULT '',
+  `BiographyLink` text,
+  `BiographyPending` tinyint(1) NOT NULL DEFAULT '0',
   `Email` varchar(254) NOT NULL,
   `IsValidEmail` tinyint(1) NOT NULL DEFAULT '0',
   `EmailValidationToken` varchar(50) DEFAULT NULL,
-  `EmailValidationDate` date DEFAULT NULL,
+  `EmailValidationDate` datetime DEFAULT NULL,
   `PasswordHash` varchar(60) NOT NULL,
+  `PasswordResetHash` char(64) DEFAULT NULL,
+  `PasswordResetDate` datetime DEFAULT NULL,
   `JoinedDate` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
-  `IsDisabled` tinyint(1) NOT NULL DEFAULT '0'
+  `IsDisabled` tinyint(1) NOT NULL DEFAULT '0',
+  `ReplyPolicy` varchar(16) NOT NULL DEFAULT 'everyone',
+  `MovedTo` varchar(272) NOT NULL DEFAULT ''
 ) ENGINE=InnoDB DEFAULT CHARSET=latin1;
 
 -- --------------------------------------------------------
@@ -119,8 +384,8 @@ CREATE TABLE `User` (
 CREATE TABLE `UserHost` (
   `UserId` int(11) NOT NULL,
   `HostId` int(11) NOT NULL,
-  `Nonce` varchar(50) NOT NULL,
-  `Token` varchar(255) NOT NULL,
+  `Nonce` varchar(50) COLLATE latin1_bin NOT NULL,
+  `Token` varchar(512) NOT NULL,
   `CreatedDate` datetime NOT NULL
 ) ENGINE=InnoDB DEFAULT CHARSET=latin1;
 
@@ -131,21 +396,85 @@ CREATE TABLE `UserHost` (
 --
 
 CREATE TABLE `UserToken` (
-  `Token` varchar(50) NOT NULL,
+`TokenId` int(11) NOT NULL,
+  `TokenPrefix` char(8) COLLATE latin1_bin NOT NULL,
+  `TokenHash` char(64) NOT NULL,
   `UserId` int(11) NOT NULL,
-  `LoginTime` date NOT NULL,
-  `LastSeenTime` date NOT NULL
+  `LoginTime` datetime NOT NULL,
+  `LastSeenTime` datetime NOT NULL,
+  `IP` varchar(45) NOT NULL DEFAULT '',
+  `UserAgent` varchar(255) NOT NULL DEFAULT ''
 ) ENGINE=InnoDB DEFAULT CHARSET=latin1;
 
 --
 -- Indexes for dumped tables
 --
 
+--
+-- Indexes for table `Block`
+--
+ALTER TABLE `Block`
+ ADD PRIMARY KEY (`UserId`,`Handle`,`Host`);
+
+--
+-- Indexes for table `Bookmark`
+--
+ALTER TABLE `Bookmark`
+ ADD PRIMARY KEY (`UserId`,`NoteId`,`NoteHost`);
+
+--
+-- Indexes for table `Conversation`
+--
+ALTER TABLE `Conversation`
+ ADD PRIMARY KEY (`ConversationId`), ADD UNIQUE KEY `MemberKey` (`MemberKey`);
+
+--
+-- Indexes for table `ConversationMember`
+--
+ALTER TABLE `ConversationMember`
+ ADD PRIMARY KEY (`ConversationId`,`Handle`,`Host`), ADD KEY `Handle` (`Handle`,`Host`);
+
+--
+-- Indexes for table `EncryptedMessage`
+--
+ALTER TABLE `EncryptedMessage`
+ ADD PRIMARY KEY (`EncryptedMessageId`), ADD KEY `UserId` (`UserId`);
+
+--
+-- Indexes for table `Favorite`
+--
+ALTER TABLE `Favorite`
+ ADD PRIMARY KEY (`NoteId`,`NoteHost`,`Handle`,`Host`), ADD KEY `Handle` (`Handle`,`Host`);
+
+--
+-- Indexes for table `FederationJob`
+--
+ALTER TABLE `FederationJob`
+ ADD PRIMARY KEY (`JobId`), ADD KEY `Status` (`Status`,`NextAttemptDate`), ADD KEY `UserId` (`UserId`);
+
+--
+-- Indexes for table `Follow`
+--
+ALTER TABLE `Follow`
+ ADD PRIMARY KEY (`UserId`,`Handle`,`Host`);
+
+--
+-- Indexes for table `Group`
+--
+ALTER TABLE `Group`
+ ADD PRIMARY KEY (`GroupId`), ADD KEY `UserId` (`UserId`);
+
+--
+-- Indexes for table `GroupMember`
+--
+ALTER TABLE `GroupMember`
+ ADD PRIMARY KEY (`GroupId`,`Handle`,`Host`);
+
 --
 -- Indexes for table `Guest`
 --
 ALTER TABLE `Guest`
- ADD PRIMARY KEY (`GuestId`), ADD UNIQUE KEY `Token` (`Token`), ADD UNIQUE KEY `Handle` (`Handle`,`HostId`);
+ ADD PRIMARY KEY (`GuestId`), ADD UNIQUE KEY `TokenHash` (`TokenHash`), ADD KEY `TokenPrefix` (`TokenPrefix`), ADD UNIQUE KEY `Handle` (`Handle`,`HostId`);
 
 --
 -- Indexes for table `HandleLimit`
@@ -165,11 +494,53 @@ ALTER TABLE `Host`
 ALTER TABLE `IPLimit`
  ADD PRIMARY KEY (`IP`);
 
+--
+-- Indexes for table `Mention`
+--
+ALTER TABLE `Mention`
+ ADD PRIMARY KEY (`NoteId`,`Position`);
+
+--
+-- Indexes for table `Message`
+--
+ALTER TABLE `Message`
+ ADD PRIMARY KEY (`MessageId`), ADD KEY `ConversationId` (`ConversationId`);
+
+--
+-- Indexes for table `Mute`
+--
+ALTER TABLE `Mute`
+ ADD PRIMARY KEY (`UserId`,`Handle`,`Host`);
+
 --
 -- Indexes for table `Note`
 --
 ALTER TABLE `Note`
- ADD PRIMARY KEY (`NoteId`);
+ ADD PRIMARY KEY (`NoteId`), ADD KEY `ThreadId` (`ThreadId`), ADD KEY `RepostOfId` (`RepostOfId`,`RepostOfHost`);
+
+--
+-- Indexes for table `ProfileMention`
+--
+ALTER TABLE `ProfileMention`
+ ADD PRIMARY KEY (`UserId`,`Field`,`Position`);
+
+--
+-- Indexes for table `PublicKey`
+--
+ALTER TABLE `PublicKey`
+ ADD PRIMARY KEY (`UserId`,`Fingerprint`);
+
+--
+-- Indexes for table `RemoteFetch`
+--
+ALTER TABLE `RemoteFetch`
+ ADD PRIMARY KEY (`UserId`,`Handle`,`Host`);
+
+--
+-- Indexes for table `RemoteNote`
+--
+ALTER TABLE `RemoteNote`
+ ADD PRIMARY KEY (`UserId`,`Host`,`NoteId`), ADD KEY `Author` (`UserId`,`Handle`,`Host`,`NoteId`);
 
 --
 -- Indexes for table `User`
@@ -187,12 +558,32 @@ ALTER TABLE `UserHost`
 -- Indexes for table `UserToken`
 --
 ALTER TABLE `UserToken`
- ADD PRIMARY KEY (`Token`);
+ ADD PRIMARY KEY (`TokenId`), ADD UNIQUE KEY `TokenHash` (`TokenHash`), ADD KEY `TokenPrefix` (`TokenPrefix`), ADD KEY `UserId` (`UserId`);
 
 --
 -- AUTO_INCREMENT for dumped tables
 --
 
+--
+-- AUTO_INCREMENT for table `Conversation`
+--
+ALTER TABLE `Conversation`
+MODIFY `ConversationId` int(11) NOT NULL AUTO_INCREMENT;
+--
+-- AUTO_INCREMENT for table `EncryptedMessage`
+--
+ALTER TABLE `EncryptedMessage`
+MODIFY `EncryptedMessageId` int(11) NOT NULL AUTO_INCREMENT;
+--
+-- AUTO_INCREMENT for table `FederationJob`
+--
+ALTER TABLE `FederationJob`
+MODIFY `JobId` int(11) NOT NULL AUTO_INCREMENT;
+--
+-- AUTO_INCREMENT for table `Group`
+--
+ALTER TABLE `Group`
+MODIFY `GroupId` int(11) NOT NULL AUTO_INCREMENT;
 --
 -- AUTO_INCREMENT for table `Guest`
 --
@@ -204,6 +595,11 @@ MODIFY `GuestId` int(11) NOT NULL AUTO_INCREMENT;
 ALTER TABLE `Host`
 MODIFY `HostId` int(11) NOT NULL AUTO_INCREMENT;
 --
+-- AUTO_INCREMENT for table `Message`
+--
+ALTER TABLE `Message`
+MODIFY `MessageId` int(11) NOT NULL AUTO_INCREMENT;
+--
 -- AUTO_INCREMENT for table `Note`
 --
 ALTER TABLE `Note`
@@ -213,6 +609,11 @@ MODIFY `NoteId` int(11) NOT NULL AUTO_INCREMENT;
 --
 ALTER TABLE `User`
 MODIFY `UserId` int(11) NOT NULL AUTO_INCREMENT;
+--
+-- AUTO_INCREMENT for table `UserToken`
+--
+ALTER TABLE `UserToken`
+MODIFY `TokenId` int(11) NOT NULL AUTO_INCREMENT;
 /*!40101 SET CHARACTER_SET_CLIENT=@OLD_CHARACTER_SET_CLIENT */;
 /*!40101 SET CHARACTER_SET_RESULTS=@OLD_CHARACTER_SET_RESULTS */;
 /*!40101 SET COLLATION_CONNECTION=@OLD_COLLATION_CONNECTION */;
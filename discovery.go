@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/net/html"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Finding where a host's IMP API is, as described under Service Discovery in the README.
+// Each URL of the search can answer with the IMP-API-Location header, a redirect, or an HTML page
+// with the header in a meta tag. A location isn't believed until the API itself confirms it over HTTPS.
+// Results are kept in the Host table for a while, so hosts aren't searched for on every request.
+
+const (
+	DiscoveryTimeoutSeconds = 10
+	// give up on the whole search after this long
+	DiscoveryTotalTimeoutSeconds = 30
+	// the most redirects and pointers to another location to follow, which also stops loops
+	MaximumDiscoveryHops = 5
+	// the meta tag has to be in the head, so there's no need to read a whole page
+	MaximumDiscoveryPageLength = 64 * 1024
+	// how long a discovered location is trusted before it's checked again
+	HostLocationTTLHours = 24
+	// how long to wait before searching again for a host that couldn't be found
+	FailedDiscoveryRetryMinutes = 5
+)
+
+// redirects are followed by discoverLocation itself, so it can count them and check each step
+var discoveryClient = &http.Client{
+	Timeout: DiscoveryTimeoutSeconds * time.Second,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// make sure the host's location is known and not too old, searching for it if need be
+func LocateHost(db *sqlx.DB, host *Host) error {
+	if host.LocationDate.Valid {
+		age := time.Since(host.LocationDate.Time)
+		if len(host.Location) > 0 && age < HostLocationTTLHours * time.Hour {
+			return nil
+		}
+		if len(host.Location) == 0 && age < FailedDiscoveryRetryMinutes * time.Minute {
+			return errors.New("Could not locate the IMP host " + host.Name + ".")
+		}
+	}
+
+	err := DiscoverHost(db, host)
+	if err != nil && len(host.Location) > 0 {
+		// the host may be down for a moment, keep using the old location until it can be found again
+		log.Println(err)
+		return nil
+	}
+	return err
+}
+
+// search for the host's location and save what was found
+// if nothing was, the old location is kept, but the attempt is still recorded
+func DiscoverHost(db *sqlx.DB, host *Host) error {
+	location, version, err := discoverLocation(host.Name)
+	if err == nil {
+		host.Location = location
+		host.Version = version
+	}
+	host.LocationDate.Time = time.Now()
+	host.LocationDate.Valid = true
+	if host.HostId == 0 {
+		// not saved yet, see VerifyHostRequest
+		return err
+	}
+
+	_, dbErr := db.NamedExec("UPDATE Host SET Location = :Location, Version = :Version, LocationDate = :LocationDate " +
+		"WHERE HostId = :HostId", host)
+	if err != nil {
+		return err
+	}
+	return dbErr
+}
+
+func discoverLocation(hostname string) (location string, version string, err error) {
+	urls := []string{
+		"https://" + hostname + "/",
+		"https://" + hostname + ":" + IMPDefaultPort + "/",
+		"http://" + hostname + "/",
+	}
+	visited := map[string]bool{}
+	hops := 0
+	deadline := time.Now().Add(DiscoveryTotalTimeoutSeconds * time.Second)
+	err = errors.New("Could not locate the IMP host " + hostname + ".")
+
+	for len(urls) > 0 && time.Now().Before(deadline) {
+		var lurl string
+		lurl, urls = urls[0], urls[1:]
+		if visited[normalizeDiscoveryURL(lurl)] {
+			continue
+		}
+		visited[normalizeDiscoveryURL(lurl)] = true
+
+		found, foundVersion, next, stepErr := discoveryStep(lurl)
+		if stepErr != nil {
+			// that didn't work, try the next one
+			err = stepErr
+			continue
+		}
+		if len(found) > 0 {
+			return found, foundVersion, nil
+		}
+
+		// go there next, ahead of the rest of the search
+		hops++
+		if hops > MaximumDiscoveryHops {
+			return "", "", errors.New("Too many redirects while locating the IMP host " + hostname + ".")
+		}
+		urls = append([]string{next}, urls...)
+	}
+	return "", "", err
+}
+
+// fetch one URL of the search, and return either the location it confirms or the next URL to try
+func discoveryStep(lurl string) (location string, version string, next string, err error) {
+	resp, err := discoveryClient.Get(lurl)
+	if err != nil {
+		return "", "", "", err
+	}
+	defer resp.Body.Close()
+
+	value := resp.Header.Get(IMPLocationHeader)
+	if len(value) == 0 && resp.StatusCode == http.StatusOK &&
+		strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		value, err = findMetaLocation(io.LimitReader(resp.Body, MaximumDiscoveryPageLength))
+		if err != nil {
+			return "", "", "", err
+		}
+	}
+
+	if len(value) > 0 {
+		version, location, err = ParseLocationValue(value)
+		if err != nil {
+			return "", "", "", err
+		}
+		// only the API itself, over HTTPS, can confirm where it is
+		if normalizeDiscoveryURL(lurl) == normalizeDiscoveryURL("https://" + location) {
+			return location, version, "", nil
+		}
+		return "", "", "https://" + location, nil
+	}
+
+	if resp.StatusCode >= 300 && resp.StatusCode < 400 {
+		target, err := resp.Location()
+		if err != nil {
+			return "", "", "", err
+		}
+		return "", "", target.String(), nil
+	}
+	return "", "", "", errors.New(lurl + " is not an IMP host: " + resp.Status)
+}
+
+// split a value like 0.9;imp.example.com/api into its version and location
+func ParseLocationValue(value string) (version string, location string, err error) {
+	parts := strings.SplitN(value, ";", 2)
+	if len(parts) != 2 {
+		return "", "", errors.New("The IMP-API-Location has no version: " + value)
+	}
+	version = strings.TrimSpace(parts[0])
+	location = strings.TrimSuffix(strings.TrimSpace(parts[1]), "/")
+	if len(location) == 0 || strings.Contains(location, "://") {
+		return "", "", errors.New("The IMP-API-Location is malformed: " + value)
+	}
+	if !IsCompatibleVersion(version) {
+		return "", "", errors.New("Version " + version + " of the IMP API is not supported.")
+	}
+	return version, location, nil
+}
+
+// versions with the same major number work together, except that before 1.0 the minor number has to match too
+func IsCompatibleVersion(version string) bool {
+	ours := cfg.Api.Version
+	if len(ours) == 0 || version == ours {
+		return true
+	}
+	ourParts := strings.SplitN(ours, ".", 3)
+	theirParts := strings.SplitN(version, ".", 3)
+	if len(ourParts) < 2 || len(theirParts) < 2 || ourParts[0] != theirParts[0] {
+		return false
+	}
+	return ourParts[0] != "0" || ourParts[1] == theirParts[1]
+}
+
+// the content of <meta http-equiv="IMP-API-Location" content="..." /> in the page's head, or "" if there isn't one
+func findMetaLocation(r io.Reader) (string, error) {
+	z := html.NewTokenizer(r)
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			if z.Err() == io.EOF {
+				return "", nil
+			}
+			return "", z.Err()
+		case html.StartTagToken, html.SelfClosingTagToken:
+			t := z.Token()
+			if t.Data == "body" {
+				return "", nil
+			}
+			if t.Data != "meta" {
+				continue
+			}
+			var equiv, content string
+			for _, attr := range t.Attr {
+				switch strings.ToLower(attr.Key) {
+				case "http-equiv":
+					equiv = attr.Val
+				case "content":
+					content = attr.Val
+				}
+			}
+			if strings.EqualFold(equiv, IMPLocationHeader) && len(content) > 0 {
+				return content, nil
+			}
+		}
+	}
+}
+
+// so that https://example.com and https://EXAMPLE.com/ are the same step of the search
+func normalizeDiscoveryURL(lurl string) string {
+	lurl = strings.TrimSuffix(lurl, "/")
+	i := strings.Index(lurl, "://")
+	if i < 0 {
+		return lurl
+	}
+	rest := lurl[i + 3:]
+	j := strings.Index(rest, "/")
+	if j < 0 {
+		return strings.ToLower(lurl)
+	}
+	return strings.ToLower(lurl[:i + 3 + j]) + rest[j:]
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLocationValue(t *testing.T) {
+	saved := cfg.Api.Version
+	defer func() { cfg.Api.Version = saved }()
+	cfg.Api.Version = "0.9"
+
+	tests := []struct {
+		value string
+		version string
+		location string
+		ok bool
+	}{
+		{"0.9;imp.example.com", "0.9", "imp.example.com", true},
+		{"0.9;imp.example.com/api/", "0.9", "imp.example.com/api", true},
+		{" 0.9 ; example.com:5039 ", "0.9", "example.com:5039", true},
+		{"0.9.3;example.com", "0.9.3", "example.com", true},
+
+		{"", "", "", false},
+		{"imp.example.com", "", "", false},
+		{"0.9;", "", "", false},
+		{"0.9;/", "", "", false},
+		{"0.9;https://imp.example.com", "", "", false},
+		{"0.8;imp.example.com", "", "", false},
+		{"1.0;imp.example.com", "", "", false},
+	}
+	for _, test := range tests {
+		version, location, err := ParseLocationValue(test.value)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("ParseLocationValue(%q) = %q, %q, want an error", test.value, version, location)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseLocationValue(%q) failed: %v", test.value, err)
+			continue
+		}
+		if version != test.version || location != test.location {
+			t.Errorf("ParseLocationValue(%q) = %q, %q, want %q, %q", test.value, version, location, test.version, test.location)
+		}
+	}
+}
+
+func TestIsCompatibleVersion(t *testing.T) {
+	saved := cfg.Api.Version
+	defer func() { cfg.Api.Version = saved }()
+
+	tests := []struct {
+		ours string
+		theirs string
+		want bool
+	}{
+		// without a version of our own, anything goes
+		{"", "0.1", true},
+		{"", "", true},
+		{"0.9", "0.9", true},
+		{"0.9", "0.9.1", true},
+		{"0.9.1", "0.9.2", true},
+		{"0.9", "0.8", false},
+		{"0.9", "0.10", false},
+		{"0.9", "1.0", false},
+		{"1.0", "1.4", true},
+		{"1.2.3", "1.0", true},
+		{"1.0", "2.0", false},
+		{"1.0", "1", false},
+		{"1.0", "", false},
+		{"1.0", "one.0", false},
+	}
+	for _, test := range tests {
+		cfg.Api.Version = test.ours
+		if got := IsCompatibleVersion(test.theirs); got != test.want {
+			t.Errorf("with version %q, IsCompatibleVersion(%q) = %v, want %v", test.ours, test.theirs, got, test.want)
+		}
+	}
+}
+
+func TestFindMetaLocation(t *testing.T) {
+	tests := []struct {
+		page string
+		want string
+	}{
+		{`<html><head><meta http-equiv="IMP-API-Location" content="0.9;imp.example.com" /></head></html>`, "0.9;imp.example.com"},
+		{`<html><head><META HTTP-EQUIV="imp-api-location" CONTENT="0.9;imp.example.com"></head></html>`, "0.9;imp.example.com"},
+		{`<!DOCTYPE html><html><head><title>Hi</title><meta charset="utf-8">` +
+			`<meta content="0.9;a.example.com" http-equiv="IMP-API-Location"></head><body></body></html>`, "0.9;a.example.com"},
+		// the first one wins
+		{`<head><meta http-equiv="IMP-API-Location" content="0.9;a.example.com">` +
+			`<meta http-equiv="IMP-API-Location" content="0.9;b.example.com"></head>`, "0.9;a.example.com"},
+		{`<head><meta http-equiv="IMP-API-Location" content=""></head>`, ""},
+		{`<head><meta http-equiv="refresh" content="0;url=https://example.com/"></head>`, ""},
+		{`<head><meta name="IMP-API-Location" content="0.9;imp.example.com"></head>`, ""},
+		// only the head counts
+		{`<html><head></head><body><meta http-equiv="IMP-API-Location" content="0.9;imp.example.com"></body></html>`, ""},
+		{``, ""},
+		{`not html at all`, ""},
+	}
+	for _, test := range tests {
+		got, err := findMetaLocation(strings.NewReader(test.page))
+		if err != nil {
+			t.Errorf("findMetaLocation(%q) failed: %v", test.page, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("findMetaLocation(%q) = %q, want %q", test.page, got, test.want)
+		}
+	}
+}
+
+// make discovery use the client for the rest of the test
+func useDiscoveryClient(t *testing.T, client *http.Client) {
+	saved := discoveryClient
+	client.CheckRedirect = saved.CheckRedirect
+	discoveryClient = client
+	t.Cleanup(func() { discoveryClient = saved })
+}
+
+// an IMP host served over HTTPS by the handler, and the name to search for it by
+func discoveryServer(t *testing.T, handler http.HandlerFunc) (hostname string) {
+	server := httptest.NewTLSServer(handler)
+	t.Cleanup(server.Close)
+	useDiscoveryClient(t, server.Client())
+	saved := cfg.Api.Version
+	cfg.Api.Version = "0.9"
+	t.Cleanup(func() { cfg.Api.Version = saved })
+	return strings.TrimPrefix(server.URL, "https://")
+}
+
+func TestDiscoveryFollowsRedirects(t *testing.T) {
+	var hostname string
+	hostname = discoveryServer(t, func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			http.Redirect(rw, r, "/moved", http.StatusMovedPermanently)
+		case "/moved":
+			http.Redirect(rw, r, "/api", http.StatusFound)
+		case "/api":
+			rw.Header().Set(IMPLocationHeader, "0.9;" + hostname + "/api")
+		default:
+			http.NotFound(rw, r)
+		}
+	})
+
+	location, version, err := discoverLocation(hostname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if location != hostname + "/api" || version != "0.9" {
+		t.Errorf("discoverLocation = %q, %q, want %q, \"0.9\"", location, version, hostname + "/api")
+	}
+}
+
+func TestDiscoveryFollowsTheMetaTag(t *testing.T) {
+	var hostname string
+	hostname = discoveryServer(t, func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+			fmt.Fprint(rw, `<html><head><meta http-equiv="IMP-API-Location" content="0.9;` + hostname + `/api" /></head></html>`)
+		case "/api":
+			rw.Header().Set(IMPLocationHeader, "0.9;" + hostname + "/api")
+		default:
+			http.NotFound(rw, r)
+		}
+	})
+
+	location, _, err := discoverLocation(hostname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if location != hostname + "/api" {
+		t.Errorf("discoverLocation = %q, want %q", location, hostname + "/api")
+	}
+}
+
+func TestDiscoveryRequiresTheAPIToConfirmItsLocation(t *testing.T) {
+	// the page points at an API that doesn't answer
+	var hostname string
+	hostname = discoveryServer(t, func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			rw.Header().Set(IMPLocationHeader, "0.9;" + hostname + "/api")
+			return
+		}
+		http.NotFound(rw, r)
+	})
+
+	if location, _, err := discoverLocation(hostname); err == nil {
+		t.Errorf("discoverLocation = %q, want an error", location)
+	}
+}
+
+func TestDiscoveryRejectsIncompatibleVersions(t *testing.T) {
+	var hostname string
+	hostname = discoveryServer(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set(IMPLocationHeader, "2.0;" + hostname)
+	})
+
+	if location, _, err := discoverLocation(hostname); err == nil {
+		t.Errorf("discoverLocation = %q, want an error", location)
+	}
+}
+
+func TestDiscoveryStopsAfterTooManyHops(t *testing.T) {
+	requests := 0
+	hostname := discoveryServer(t, func(rw http.ResponseWriter, r *http.Request) {
+		requests++
+		n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		http.Redirect(rw, r, "/" + strconv.Itoa(n + 1), http.StatusFound)
+	})
+
+	_, _, err := discoverLocation(hostname)
+	if err == nil {
+		t.Fatal("discoverLocation followed redirects forever")
+	}
+	if requests != MaximumDiscoveryHops + 1 {
+		t.Errorf("made %d requests, want %d", requests, MaximumDiscoveryHops + 1)
+	}
+}
+
+func TestDiscoveryDoesNotLoop(t *testing.T) {
+	requests := 0
+	hostname := discoveryServer(t, func(rw http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path == "/a" {
+			http.Redirect(rw, r, "/b", http.StatusFound)
+		} else {
+			http.Redirect(rw, r, "/a", http.StatusFound)
+		}
+	})
+
+	if _, _, err := discoverLocation(hostname); err == nil {
+		t.Fatal("discoverLocation found a location in a redirect loop")
+	}
+	// /, /a and /b once each
+	if requests != 3 {
+		t.Errorf("made %d requests, want 3", requests)
+	}
+}
+
+// fails every request, and counts them
+type offlineTransport struct {
+	requests int
+}
+
+func (o *offlineTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	o.requests++
+	return nil, errors.New("offline")
+}
+
+func TestLocateHostUsesCachedLocations(t *testing.T) {
+	offline := &offlineTransport{}
+	useDiscoveryClient(t, &http.Client{Transport: offline})
+
+	// found recently, so there's no need to look again
+	host := &Host{Name: "a.example", Location: "imp.a.example"}
+	host.LocationDate.Time = time.Now().Add(-(HostLocationTTLHours - 1) * time.Hour)
+	host.LocationDate.Valid = true
+	if err := LocateHost(nil, host); err != nil || host.Location != "imp.a.example" {
+		t.Errorf("LocateHost = %v with location %q, want the cached location", err, host.Location)
+	}
+
+	// not found recently, so don't look again yet
+	host = &Host{Name: "b.example"}
+	host.LocationDate.Time = time.Now().Add(-time.Minute)
+	host.LocationDate.Valid = true
+	if err := LocateHost(nil, host); err == nil {
+		t.Error("LocateHost found a host that couldn't be found a minute ago")
+	}
+
+	if offline.requests > 0 {
+		t.Errorf("made %d requests for cached locations", offline.requests)
+	}
+}
+
+func TestLocateHostKeepsAStaleLocationWhileTheHostIsDown(t *testing.T) {
+	tdb := openTestDB(t)
+	offline := &offlineTransport{}
+	useDiscoveryClient(t, &http.Client{Transport: offline})
+
+	host, err := FetchHost(tdb, "a.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host.Location = "imp.a.example"
+	stale := time.Now().Add(-(HostLocationTTLHours + 1) * time.Hour)
+	host.LocationDate.Time = stale
+	host.LocationDate.Valid = true
+
+	err = LocateHost(tdb, host)
+	if err != nil || host.Location != "imp.a.example" {
+		t.Errorf("LocateHost = %v with location %q, want the old location", err, host.Location)
+	}
+	if offline.requests == 0 {
+		t.Error("LocateHost didn't look for a host whose location is stale")
+	}
+
+	// the attempt is remembered, so the next request doesn't search again
+	saved, err := FetchHost(tdb, "a.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Location != "imp.a.example" || !saved.LocationDate.Valid || !saved.LocationDate.Time.After(stale) {
+		t.Errorf("saved location %q at %v, want the old location at a later time", saved.Location, saved.LocationDate.Time)
+	}
+}
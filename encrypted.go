@@ -0,0 +1,380 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Encrypted messages are encrypted by the sender's client with the recipient's public key.
+// The host only ever sees the ciphertext and the fingerprint of the key it was encrypted with,
+// and does nothing but route it to the recipient's host.
+
+const (
+	MaximumPublicKeyLength = 4096
+	MaximumCiphertextLength = 8192
+)
+
+// A user's public key. When the user rotates their key, the old one is retired but kept,
+// so clients can still tell which key old messages were encrypted with.
+type PublicKey struct {
+	UserId int64
+	Fingerprint string
+	Key string
+	CreatedDate mysql.NullTime
+	RetiredDate mysql.NullTime
+}
+
+func (k *PublicKey) AsMap() map[string]interface{} {
+	m := map[string]interface{}{
+		"Fingerprint": k.Fingerprint,
+		"Key": k.Key,
+		"CreatedDate": k.CreatedDate.Time.Unix(),
+	}
+	if k.RetiredDate.Valid {
+		m["RetiredDate"] = k.RetiredDate.Time.Unix()
+	}
+	return m
+}
+
+type EncryptedMessage struct {
+	EncryptedMessageId int64
+	// the local recipient
+	UserId int64
+	// the sender
+	Handle string
+	Host string
+	Fingerprint string
+	Ciphertext string
+	Date mysql.NullTime
+}
+
+func (m *EncryptedMessage) AsMap() map[string]interface{} {
+	return map[string]interface{}{
+		"EncryptedMessageId": m.EncryptedMessageId,
+		"From": m.Handle + "!" + m.Host,
+		"Fingerprint": m.Fingerprint,
+		"Ciphertext": m.Ciphertext,
+		"Date": m.Date.Time.Unix(),
+	}
+}
+
+func keyFingerprint(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// publish a new public key for the authenticated user, retiring the current one
+func PutPublicKeyHandler(rw http.ResponseWriter, r *http.Request) {
+	user, ok := listOwnerFromRequest(rw, r)
+	if !ok {
+		return
+	}
+
+	r.ParseForm()
+	key := strings.TrimSpace(r.PostFormValue("key"))
+	if len(key) == 0 || len(key) > MaximumPublicKeyLength {
+		sendError(rw, http.StatusBadRequest, "Key must be 1 to " + strconv.Itoa(MaximumPublicKeyLength) + " characters.")
+		return
+	}
+
+	k := PublicKey{UserId: user.UserId, Fingerprint: keyFingerprint(key), Key: key}
+	k.CreatedDate.Time = time.Now()
+	k.CreatedDate.Valid = true
+
+	var count int64
+	err := db.Get(&count, "SELECT COUNT(*) FROM PublicKey WHERE UserId = ? AND Fingerprint = ?", k.UserId, k.Fingerprint)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if count > 0 {
+		sendError(rw, http.StatusConflict, "That key has already been published.")
+		return
+	}
+
+	_, err = db.Exec("UPDATE PublicKey SET RetiredDate = ? WHERE UserId = ? AND RetiredDate IS NULL", k.CreatedDate, k.UserId)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	_, err = db.NamedExec("INSERT INTO `PublicKey` (`UserId`, `Fingerprint`, `Key`, `CreatedDate`) " +
+		"VALUES (:UserId, :Fingerprint, :Key, :CreatedDate)", &k)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sendData(rw, http.StatusCreated, k.AsMap())
+}
+
+// a local user's keys, current first, for local users and guests alike
+func ListPublicKeysHandler(rw http.ResponseWriter, r *http.Request) {
+	viewer, err := FetchPrincipal(db, r)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if viewer == nil {
+		sendError(rw, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	listPublicKeys(rw, viewer, mux.Vars(r)["handle"])
+}
+
+// users who have blocked the viewer don't exist as far as the viewer knows
+func listPublicKeys(rw http.ResponseWriter, viewer *Principal, handle string) {
+	user, err := FetchUserByHandle(db, handle)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	allowed := false
+	if user != nil {
+		allowed, err = CanMention(db, viewer.Address, LocalAddress(user.Handle))
+		if err != nil {
+			fmt.Println(err)
+			sendError(rw, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	if !allowed {
+		sendError(rw, http.StatusNotFound, "There is no user with that handle.")
+		return
+	}
+
+	keys := []PublicKey{}
+	err = db.Select(&keys, "SELECT * FROM PublicKey WHERE UserId = ? ORDER BY RetiredDate IS NOT NULL, CreatedDate DESC", user.UserId)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	list := []interface{}{}
+	for _, k := range keys {
+		list = append(list, k.AsMap())
+	}
+	sendData(rw, http.StatusOK, list)
+}
+
+// lets a local user fetch anyone's keys, from this host or through the user's guest token for another host
+func GetAddressKeysHandler(rw http.ResponseWriter, r *http.Request) {
+	user, ok := messageUserFromRequest(rw, r)
+	if !ok {
+		return
+	}
+
+	address, err := ParseAddress(mux.Vars(r)["address"])
+	if err != nil {
+		sendError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+	if address.IsLocal() {
+		listPublicKeys(rw, UserPrincipal(user), address.Handle)
+		return
+	}
+
+	keys := []map[string]interface{}{}
+	err = FederationGet(db, user, address.Host, "/user/" + address.Handle + "/key", nil, &keys)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusBadGateway, "Could not retrieve keys from " + address.Host + ".")
+		return
+	}
+	sendData(rw, http.StatusOK, keys)
+}
+
+// route an encrypted message to a local recipient, or from a local sender to the recipient's host
+func PostEncryptedMessageHandler(rw http.ResponseWriter, r *http.Request) {
+	sender, err := FetchPrincipal(db, r)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if sender == nil {
+		sendError(rw, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	r.ParseForm()
+	to, err := ParseAddress(r.PostFormValue("to"))
+	if err != nil {
+		sendError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+	fingerprint := r.PostFormValue("fingerprint")
+	if len(fingerprint) == 0 {
+		sendError(rw, http.StatusBadRequest, "Missing fingerprint.")
+		return
+	}
+	ciphertext := r.PostFormValue("ciphertext")
+	if len(ciphertext) == 0 || len(ciphertext) > MaximumCiphertextLength {
+		sendError(rw, http.StatusBadRequest, "Ciphertext must be 1 to " + strconv.Itoa(MaximumCiphertextLength) + " characters.")
+		return
+	}
+	// we can't read it, but it should at least be base64
+	if _, err = base64.StdEncoding.DecodeString(ciphertext); err != nil {
+		sendError(rw, http.StatusBadRequest, "Ciphertext must be base64 encoded.")
+		return
+	}
+
+	if !to.IsLocal() {
+		// guests' hosts deliver straight to the recipient's host
+		if sender.IsGuest() {
+			sendError(rw, http.StatusBadRequest, "The recipient is not on this host.")
+			return
+		}
+		user, err := FetchUser(db, sender.UserId())
+		if err != nil || user == nil {
+			fmt.Println(err)
+			sendError(rw, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+
+		job := &FederationJob{UserId: user.UserId, Kind: JobEncryptedMessage, Host: to.Host, Method: "POST", Path: "/encrypted", AsGuest: true}
+		err = EnqueueFederationJob(db, job, url.Values{"to": {to.String()}, "fingerprint": {fingerprint}, "ciphertext": {ciphertext}})
+		if err != nil {
+			fmt.Println(err)
+			sendError(rw, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		// at this point we don't know how the recipient's host will respond, so send 202 Accepted
+		sendData(rw, http.StatusAccepted, map[string]interface{}{
+				"JobId": job.JobId,
+			})
+		return
+	}
+
+	recipient, err := FetchUserByHandle(db, to.Handle)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	allowed := false
+	if recipient != nil {
+		allowed, err = CanMention(db, sender.Address, LocalAddress(recipient.Handle))
+		if err != nil {
+			fmt.Println(err)
+			sendError(rw, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	if !allowed {
+		sendError(rw, http.StatusNotFound, "There is no user with that address.")
+		return
+	}
+
+	// the recipient must be able to tell which of their keys to decrypt with
+	var count int64
+	err = db.Get(&count, "SELECT COUNT(*) FROM PublicKey WHERE UserId = ? AND Fingerprint = ?", recipient.UserId, fingerprint)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if count == 0 {
+		sendError(rw, http.StatusBadRequest, "That fingerprint doesn't match any of the recipient's keys.")
+		return
+	}
+
+	m := EncryptedMessage{
+		UserId: recipient.UserId,
+		Handle: sender.Address.Handle,
+		Host: sender.Address.Host,
+		Fingerprint: fingerprint,
+		Ciphertext: ciphertext,
+	}
+	m.Date.Time = time.Now()
+	m.Date.Valid = true
+	result, err := db.NamedExec("INSERT INTO `EncryptedMessage` (`UserId`, `Handle`, `Host`, `Fingerprint`, `Ciphertext`, `Date`) " +
+		"VALUES (:UserId, :Handle, :Host, :Fingerprint, :Ciphertext, :Date)", &m)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	m.EncryptedMessageId, err = result.LastInsertId()
+	if err != nil {
+		fmt.Println(err)
+	}
+	sendData(rw, http.StatusCreated, m.AsMap())
+}
+
+// the authenticated user's encrypted messages, newest first, except those from senders they've muted
+func ListEncryptedMessagesHandler(rw http.ResponseWriter, r *http.Request) {
+	user, ok := messageUserFromRequest(rw, r)
+	if !ok {
+		return
+	}
+
+	r.ParseForm()
+	where := " WHERE UserId = ?" +
+		" AND NOT EXISTS (SELECT * FROM Mute WHERE Mute.UserId = EncryptedMessage.UserId" +
+		" AND (Mute.Handle = EncryptedMessage.Handle OR Mute.Handle = '*') AND Mute.Host = EncryptedMessage.Host)"
+	sinceId := validIntFormValue(r, "since_id", 0)
+	if sinceId > 0 {
+		where += " AND EncryptedMessageId > " + strconv.Itoa(sinceId)
+	}
+	beforeId := validIntFormValue(r, "before_id", 0)
+	if beforeId > 0 {
+		where += " AND EncryptedMessageId < " + strconv.Itoa(beforeId)
+	}
+	count := validIntFormValue(r, "count", MaximumNotesReturned)
+	if count > MaximumNotesReturned || count <= 0 {
+		count = MaximumNotesReturned
+	}
+
+	messages := []EncryptedMessage{}
+	err := db.Select(&messages, "SELECT * FROM EncryptedMessage" + where +
+		" ORDER BY EncryptedMessageId DESC LIMIT " + strconv.Itoa(count), user.UserId)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	list := []interface{}{}
+	for _, m := range messages {
+		list = append(list, m.AsMap())
+	}
+	sendData(rw, http.StatusOK, list)
+}
+
+func DeleteEncryptedMessageHandler(rw http.ResponseWriter, r *http.Request) {
+	user, ok := messageUserFromRequest(rw, r)
+	if !ok {
+		return
+	}
+
+	messageId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		sendError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM `EncryptedMessage` WHERE EncryptedMessageId = ? AND UserId = ?", messageId, user.UserId)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		sendError(rw, http.StatusNotFound, "There is no message with that ID.")
+		return
+	}
+	sendData(rw, http.StatusNoContent, "")
+}
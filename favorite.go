@@ -0,0 +1,370 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A favorite of a note on this host by anyone, local user or guest, if NoteHost is empty.
+// Otherwise a local user's favorite of a note on NoteHost, which that host also knows about.
+type Favorite struct {
+	NoteId int64
+	NoteHost string
+	Handle string
+	Host string
+	CreatedDate mysql.NullTime
+}
+
+// a private favorite, only for local users
+type Bookmark struct {
+	UserId int64
+	NoteId int64
+	NoteHost string
+	CreatedDate mysql.NullTime
+}
+
+func PutFavoriteHandler(rw http.ResponseWriter, r *http.Request) {
+	setFavorite(rw, r, true)
+}
+
+func DeleteFavoriteHandler(rw http.ResponseWriter, r *http.Request) {
+	setFavorite(rw, r, false)
+}
+
+func setFavorite(rw http.ResponseWriter, r *http.Request, favorite bool) {
+	principal, err := FetchPrincipal(db, r)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if principal == nil {
+		sendError(rw, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	noteId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		sendError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	r.ParseForm()
+	noteHost := r.PostFormValue("host")
+	if strings.EqualFold(noteHost, cfg.Api.Host) {
+		noteHost = ""
+	}
+
+	var job *FederationJob
+	if len(noteHost) == 0 {
+		// anyone who can see the note can favorite it
+		note, status, message := fetchVisibleNote(int64(noteId), principal)
+		if note == nil {
+			sendError(rw, status, message)
+			return
+		}
+	} else {
+		// guests can only favorite notes on this host
+		if principal.IsGuest() {
+			sendError(rw, http.StatusBadRequest, "There is no note with that ID.")
+			return
+		}
+		user, err := FetchUser(db, principal.UserId())
+		if err != nil || user == nil {
+			fmt.Println(err)
+			sendError(rw, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+
+		// let the note's host know, it keeps the count
+		method := "PUT"
+		if !favorite {
+			method = "DELETE"
+		}
+		job = &FederationJob{UserId: user.UserId, Kind: JobFavorite, Host: noteHost, Method: method,
+			Path: "/note/" + strconv.Itoa(noteId) + "/favorite", AsGuest: true}
+		err = EnqueueFederationJob(db, job, nil)
+		if err != nil {
+			fmt.Println(err)
+			sendError(rw, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	if favorite {
+		f := Favorite{NoteId: int64(noteId), NoteHost: noteHost, Handle: principal.Address.Handle, Host: principal.Address.Host}
+		f.CreatedDate.Time = time.Now()
+		f.CreatedDate.Valid = true
+		_, err = db.NamedExec("INSERT IGNORE INTO `Favorite` (`NoteId`, `NoteHost`, `Handle`, `Host`, `CreatedDate`) " +
+			"VALUES (:NoteId, :NoteHost, :Handle, :Host, :CreatedDate)", &f)
+	} else {
+		_, err = db.Exec("DELETE FROM `Favorite` WHERE NoteId = ? AND NoteHost = ? AND Handle = ? AND Host = ?",
+			noteId, noteHost, principal.Address.Handle, principal.Address.Host)
+	}
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if job != nil {
+		// the note's host hasn't heard about it yet
+		sendData(rw, http.StatusAccepted, map[string]interface{}{
+				"JobId": job.JobId,
+			})
+	} else if favorite {
+		sendData(rw, http.StatusOK, "")
+	} else {
+		sendData(rw, http.StatusNoContent, "")
+	}
+}
+
+// a user's favorites are public, except to users they've blocked
+func ListFavoritesHandler(rw http.ResponseWriter, r *http.Request) {
+	viewer, err := FetchPrincipal(db, r)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if viewer == nil {
+		sendError(rw, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	user, err := FetchUserByHandle(db, mux.Vars(r)["handle"])
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	blocked := false
+	if user != nil {
+		blocked, err = IsBlocking(db, user.UserId, viewer.Address)
+		if err != nil {
+			fmt.Println(err)
+			sendError(rw, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	if user == nil || blocked {
+		sendError(rw, http.StatusNotFound, "There is no user with that handle.")
+		return
+	}
+
+	favorites := []Favorite{}
+	err = db.Select(&favorites, "SELECT * FROM Favorite WHERE Handle = ? AND Host = ? ORDER BY CreatedDate DESC",
+		user.Handle, cfg.Api.Host)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	list := []interface{}{}
+	for _, f := range favorites {
+		m, err := savedNoteAsMap(f.NoteId, f.NoteHost, f.CreatedDate, viewer)
+		if err != nil {
+			fmt.Println(err)
+			sendError(rw, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if m != nil {
+			list = append(list, m)
+		}
+	}
+	sendData(rw, http.StatusOK, list)
+}
+
+func PutBookmarkHandler(rw http.ResponseWriter, r *http.Request) {
+	setBookmark(rw, r, true)
+}
+
+func DeleteBookmarkHandler(rw http.ResponseWriter, r *http.Request) {
+	setBookmark(rw, r, false)
+}
+
+func setBookmark(rw http.ResponseWriter, r *http.Request, bookmark bool) {
+	token, err := FetchToken(db, r)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if token == nil {
+		sendError(rw, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	noteId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		sendError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	r.ParseForm()
+	noteHost := r.PostFormValue("host")
+	if strings.EqualFold(noteHost, cfg.Api.Host) {
+		noteHost = ""
+	}
+
+	if bookmark && len(noteHost) == 0 {
+		user, err := FetchUser(db, token.UserId)
+		if err != nil || user == nil {
+			fmt.Println(err)
+			sendError(rw, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		note, status, message := fetchVisibleNote(int64(noteId), UserPrincipal(user))
+		if note == nil {
+			sendError(rw, status, message)
+			return
+		}
+	}
+
+	if bookmark {
+		b := Bookmark{UserId: token.UserId, NoteId: int64(noteId), NoteHost: noteHost}
+		b.CreatedDate.Time = time.Now()
+		b.CreatedDate.Valid = true
+		_, err = db.NamedExec("INSERT IGNORE INTO `Bookmark` (`UserId`, `NoteId`, `NoteHost`, `CreatedDate`) " +
+			"VALUES (:UserId, :NoteId, :NoteHost, :CreatedDate)", &b)
+	} else {
+		_, err = db.Exec("DELETE FROM `Bookmark` WHERE UserId = ? AND NoteId = ? AND NoteHost = ?",
+			token.UserId, noteId, noteHost)
+	}
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if bookmark {
+		sendData(rw, http.StatusOK, "")
+	} else {
+		sendData(rw, http.StatusNoContent, "")
+	}
+}
+
+// bookmarks are only visible to their owner
+func ListBookmarksHandler(rw http.ResponseWriter, r *http.Request) {
+	user, ok := listOwnerFromRequest(rw, r)
+	if !ok {
+		return
+	}
+
+	bookmarks := []Bookmark{}
+	err := db.Select(&bookmarks, "SELECT * FROM Bookmark WHERE UserId = ? ORDER BY CreatedDate DESC", user.UserId)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	list := []interface{}{}
+	for _, b := range bookmarks {
+		m, err := savedNoteAsMap(b.NoteId, b.NoteHost, b.CreatedDate, UserPrincipal(user))
+		if err != nil {
+			fmt.Println(err)
+			sendError(rw, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if m != nil {
+			list = append(list, m)
+		}
+	}
+	sendData(rw, http.StatusOK, list)
+}
+
+// a favorite or bookmark, with the note itself if it's local and the viewer can see it
+// returns nil if the viewer isn't allowed to know about the note
+func savedNoteAsMap(noteId int64, noteHost string, date mysql.NullTime, viewer *Principal) (map[string]interface{}, error) {
+	m := map[string]interface{}{
+		"NoteId": noteId,
+		"Date": date.Time.Unix(),
+	}
+	if len(noteHost) > 0 {
+		// clients can fetch it from its host
+		m["Host"] = noteHost
+		return m, nil
+	}
+
+	note := new(Note)
+	err := db.Get(note, "SELECT * FROM Note WHERE NoteId = ?", noteId)
+	if err == sql.ErrNoRows {
+		// deleted, but the viewer may have seen it before
+		return m, nil
+	} else if err != nil {
+		return nil, err
+	}
+	visible, err := CanSeeNote(db, note, viewer)
+	if err != nil || !visible {
+		return nil, err
+	}
+	notes := []Note{*note}
+	err = PrepareNotes(db, notes, viewer)
+	if err != nil {
+		return nil, err
+	}
+	m["Note"] = notes[0].AsMap()
+	return m, nil
+}
+
+// returns nil and an HTTP status and message if there is no such note or the viewer can't see it
+func fetchVisibleNote(noteId int64, viewer *Principal) (*Note, int, string) {
+	note := new(Note)
+	err := db.Get(note, "SELECT * FROM Note WHERE NoteId = ?", noteId)
+	if err == sql.ErrNoRows {
+		return nil, http.StatusNotFound, "There is no note with that ID."
+	} else if err != nil {
+		fmt.Println(err)
+		return nil, http.StatusInternalServerError, err.Error()
+	}
+	visible, err := CanSeeNote(db, note, viewer)
+	if err != nil {
+		fmt.Println(err)
+		return nil, http.StatusInternalServerError, err.Error()
+	}
+	if !visible {
+		return nil, http.StatusNotFound, "There is no note with that ID."
+	}
+	return note, 0, ""
+}
+
+// fill in the FavoriteCount of each note
+func AttachFavorites(db *sqlx.DB, notes []Note) error {
+	if len(notes) == 0 {
+		return nil
+	}
+
+	ids := []int64{}
+	byId := map[int64]*Note{}
+	for i := range notes {
+		ids = append(ids, notes[i].NoteId)
+		byId[notes[i].NoteId] = &notes[i]
+	}
+
+	query, args, err := sqlx.In("SELECT NoteId, COUNT(*) AS FavoriteCount FROM Favorite " +
+		"WHERE NoteHost = '' AND NoteId IN (?) GROUP BY NoteId", ids)
+	if err != nil {
+		return err
+	}
+	counts := []struct {
+		NoteId int64
+		FavoriteCount int64
+	}{}
+	err = db.Select(&counts, query, args...)
+	if err != nil {
+		return err
+	}
+	for _, c := range counts {
+		byId[c.NoteId].FavoriteCount = c.FavoriteCount
+	}
+	return nil
+}
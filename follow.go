@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// give up on a foreign host that takes longer than this to answer
+const FederationTimeoutSeconds = 10
+
+var federationClient = &http.Client{Timeout: FederationTimeoutSeconds * time.Second}
+
+type Follow struct {
+	UserId int64
+	Handle string
+	Host string
+	CreatedDate mysql.NullTime
+}
+
+func ListFollowsHandler(rw http.ResponseWriter, r *http.Request) {
+	listAddressList(rw, r, "Follow")
+}
+
+func PutFollowHandler(rw http.ResponseWriter, r *http.Request) {
+	user, ok := listOwnerFromRequest(rw, r)
+	if !ok {
+		return
+	}
+
+	address, err := ParseAddress(mux.Vars(r)["address"])
+	if err != nil {
+		sendError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if address.IsLocal() {
+		if strings.EqualFold(address.Handle, user.Handle) {
+			sendError(rw, http.StatusBadRequest, "You can't follow yourself.")
+			return
+		}
+		target, err := FetchUserByHandle(db, address.Handle)
+		if err != nil {
+			fmt.Println(err)
+			sendError(rw, http.StatusInternalServerError, err.Error())
+			return
+		}
+		// to a blocked user, the target does not exist
+		blocked := false
+		if target != nil {
+			blocked, err = IsBlocking(db, target.UserId, LocalAddress(user.Handle))
+			if err != nil {
+				fmt.Println(err)
+				sendError(rw, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+		if target == nil || blocked {
+			sendError(rw, http.StatusNotFound, "There is no user with that handle.")
+			return
+		}
+		if len(target.MovedTo) > 0 {
+			sendMoved(rw, target)
+			return
+		}
+		// store the handle as the target chose to write it
+		address.Handle = target.Handle
+	} else {
+		// we'll need a guest token to read the notes of a remote user
+		err = EnsureGuestToken(db, user, address.Host)
+		if err != nil {
+			fmt.Println(err)
+			sendError(rw, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	follow := Follow{UserId: user.UserId, Handle: address.Handle, Host: address.Host}
+	follow.CreatedDate.Time = time.Now()
+	follow.CreatedDate.Valid = true
+	_, err = db.NamedExec("INSERT IGNORE INTO `Follow` (`UserId`, `Handle`, `Host`, `CreatedDate`) " +
+		"VALUES (:UserId, :Handle, :Host, :CreatedDate)", &follow)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sendData(rw, http.StatusOK, address.String())
+}
+
+func DeleteFollowHandler(rw http.ResponseWriter, r *http.Request) {
+	deleteAddressListEntry(rw, r, "Follow")
+}
+
+// notes from the user and everyone they follow, newest first
+// since_id and before_id only apply to notes on this host, since note ids on other hosts are unrelated
+func TimelineHandler(rw http.ResponseWriter, r *http.Request) {
+	user, ok := listOwnerFromRequest(rw, r)
+	if !ok {
+		return
+	}
+	viewer := LocalAddress(user.Handle)
+
+	r.ParseForm()
+	paging, count := notePagination(r)
+
+	// the user's own notes, plus visible notes of followed local users who haven't blocked them and who they haven't muted
+	args := []interface{}{user.UserId, user.UserId, cfg.Api.Host}
+	args = append(args, groupsOfArgs(viewer)...)
+	args = append(args, viewer.Handle, viewer.Host, user.UserId, cfg.Api.Host)
+	notes := []Note{}
+	err := db.Select(&notes, "SELECT Note.* FROM Note JOIN User ON Note.UserId = User.UserId " +
+		"WHERE (Note.UserId = ? OR (" +
+			"User.Handle IN (SELECT Handle FROM Follow WHERE UserId = ? AND Host = ?) " +
+			"AND Note.Pending = 0 " +
+			"AND (Note.GroupId = 0 OR Note.GroupId IN (" + groupsOfSQL + ")) " +
+			"AND NOT EXISTS (SELECT * FROM Block WHERE Block.UserId = Note.UserId AND (Block.Handle = ? OR Block.Handle = '*') AND Block.Host = ?) " +
+			"AND NOT EXISTS (SELECT * FROM Mute WHERE Mute.UserId = ? AND (Mute.Handle = User.Handle OR Mute.Handle = '*') AND Mute.Host = ?)))" +
+		paging + " ORDER BY Note.Date DESC LIMIT " + strconv.Itoa(count), args...)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	err = PrepareNotes(db, notes, UserPrincipal(user))
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	authors := map[int64]string{user.UserId: viewer.String()}
+	timeline := []map[string]interface{}{}
+	for _, note := range notes {
+		address, ok := authors[note.UserId]
+		if !ok {
+			author, err := FetchUser(db, note.UserId)
+			if err != nil || author == nil {
+				fmt.Println(err)
+				continue
+			}
+			address = LocalAddress(author.Handle).String()
+			authors[note.UserId] = address
+		}
+		m := *note.AsMap()
+		m["Address"] = address
+		timeline = append(timeline, m)
+	}
+
+	// add the notes of followed users on other hosts, as far as this host has them
+	remote, err := NewFederationClient(db, user).FollowedNotes(r.Form)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	timeline = append(timeline, remote...)
+
+	sort.Sort(ByDateDescending(timeline))
+	if len(timeline) > count {
+		timeline = timeline[:count]
+	}
+	sendData(rw, http.StatusOK, timeline)
+}
+
+// GET the path from the foreign host as a guest of that host, and decode the data from the response envelope into v
+func FederationGet(db *sqlx.DB, user *User, hostname string, path string, query url.Values, v interface{}) error {
+	return NewFederationClient(db, user).Get(hostname, path, query, v)
+}
+
+// interface for sorting note maps newest first
+type ByDateDescending []map[string]interface{}
+func (s ByDateDescending) Len() int {
+	return len(s)
+}
+func (s ByDateDescending) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+func (s ByDateDescending) Less(i, j int) bool {
+	return noteMapDate(s[i]) > noteMapDate(s[j])
+}
+
+// our own notes have int64 dates, notes decoded from JSON have float64
+func noteMapDate(m map[string]interface{}) float64 {
+	switch d := m["Date"].(type) {
+	case int64:
+		return float64(d)
+	case float64:
+		return d
+	}
+	return 0
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"net/http"
+	"strconv"
+)
+
+type Group struct {
+	GroupId int64
+	UserId int64
+	Name string
+}
+
+type GroupMember struct {
+	GroupId int64
+	Handle string
+	Host string
+}
+
+func ListGroupsHandler(rw http.ResponseWriter, r *http.Request) {
+	token, err := FetchToken(db, r)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if token == nil {
+		sendError(rw, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// users can only see the groups they own
+	groups := []Group{}
+	err = db.Select(&groups, "SELECT * FROM `Group` WHERE UserId = ?", token.UserId)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sendData(rw, http.StatusOK, groups)
+}
+
+func PostGroupHandler(rw http.ResponseWriter, r *http.Request) {
+	token, err := FetchToken(db, r)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if token == nil {
+		sendError(rw, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	r.ParseForm()
+	name := r.PostFormValue("name")
+	if len(name) == 0 || len(name) > 140 {
+		sendError(rw, http.StatusBadRequest, "Group name must be 1 to 140 characters.")
+		return
+	}
+
+	group := Group{UserId: token.UserId, Name: name}
+	result, err := db.NamedExec("INSERT INTO `Group` (`UserId`, `Name`) VALUES (:UserId, :Name)", &group)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	group.GroupId, err = result.LastInsertId()
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	sendData(rw, http.StatusCreated, &group)
+}
+
+func GetGroupHandler(rw http.ResponseWriter, r *http.Request) {
+	group, ok := ownedGroupFromRequest(rw, r)
+	if !ok {
+		return
+	}
+
+	members := []GroupMember{}
+	err := db.Select(&members, "SELECT * FROM GroupMember WHERE GroupId = ?", group.GroupId)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	addresses := []string{}
+	for _, m := range members {
+		addresses = append(addresses, m.Handle + "!" + m.Host)
+	}
+
+	sendData(rw, http.StatusOK, map[string]interface{}{
+			"GroupId": group.GroupId,
+			"Name": group.Name,
+			"Members": addresses,
+		})
+}
+
+func PutGroupHandler(rw http.ResponseWriter, r *http.Request) {
+	group, ok := ownedGroupFromRequest(rw, r)
+	if !ok {
+		return
+	}
+
+	r.ParseForm()
+	name := r.PostFormValue("name")
+	if len(name) == 0 || len(name) > 140 {
+		sendError(rw, http.StatusBadRequest, "Group name must be 1 to 140 characters.")
+		return
+	}
+	group.Name = name
+
+	_, err := db.NamedExec("UPDATE `Group` SET Name = :Name WHERE GroupId = :GroupId", group)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sendData(rw, http.StatusOK, group)
+}
+
+func DeleteGroupHandler(rw http.ResponseWriter, r *http.Request) {
+	group, ok := ownedGroupFromRequest(rw, r)
+	if !ok {
+		return
+	}
+
+	// notes posted to the group stay private to the author
+	_, err := db.Exec("DELETE FROM GroupMember WHERE GroupId = ?", group.GroupId)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	_, err = db.Exec("DELETE FROM `Group` WHERE GroupId = ?", group.GroupId)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sendData(rw, http.StatusNoContent, "")
+}
+
+func PutGroupMemberHandler(rw http.ResponseWriter, r *http.Request) {
+	group, ok := ownedGroupFromRequest(rw, r)
+	if !ok {
+		return
+	}
+
+	address, err := ParseAddress(mux.Vars(r)["address"])
+	if err != nil {
+		sendError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	_, err = db.Exec("INSERT IGNORE INTO GroupMember (`GroupId`, `Handle`, `Host`) VALUES (?, ?, ?)",
+		group.GroupId, address.Handle, address.Host)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sendData(rw, http.StatusOK, address.String())
+}
+
+func DeleteGroupMemberHandler(rw http.ResponseWriter, r *http.Request) {
+	group, ok := ownedGroupFromRequest(rw, r)
+	if !ok {
+		return
+	}
+
+	address, err := ParseAddress(mux.Vars(r)["address"])
+	if err != nil {
+		sendError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	_, err = db.Exec("DELETE FROM GroupMember WHERE GroupId = ? AND Handle = ? AND Host = ?",
+		group.GroupId, address.Handle, address.Host)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sendData(rw, http.StatusNoContent, "")
+}
+
+// authenticates the request and fetches the group in the URL, which must belong to the authenticated user
+// sends an error response and returns false on failure
+func ownedGroupFromRequest(rw http.ResponseWriter, r *http.Request) (*Group, bool) {
+	token, err := FetchToken(db, r)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return nil, false
+	}
+	if token == nil {
+		sendError(rw, http.StatusUnauthorized, "Unauthorized")
+		return nil, false
+	}
+
+	groupId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		sendError(rw, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+
+	group, err := FetchGroup(db, int64(groupId))
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return nil, false
+	}
+	// don't reveal the existence of other users' groups
+	if group == nil || group.UserId != token.UserId {
+		sendError(rw, http.StatusNotFound, "There is no group with that ID.")
+		return nil, false
+	}
+	return group, true
+}
+
+func FetchGroup(db *sqlx.DB, groupId int64) (*Group, error) {
+	group := new(Group)
+	err := db.Get(group, "SELECT * FROM `Group` WHERE GroupId = ?", groupId)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+// the owner of a group counts as a member, without a GroupMember row
+func IsGroupMember(db *sqlx.DB, groupId int64, address *Address) (bool, error) {
+	var count int64
+	err := db.Get(&count, "SELECT COUNT(*) FROM GroupMember WHERE GroupId = ? AND Handle = ? AND Host = ?",
+		groupId, address.Handle, address.Host)
+	if err != nil || count > 0 {
+		return count > 0, err
+	}
+	if !address.IsLocal() {
+		return false, nil
+	}
+	err = db.Get(&count, "SELECT COUNT(*) FROM `Group` JOIN User ON `Group`.UserId = User.UserId " +
+		"WHERE `Group`.GroupId = ? AND User.Handle = ?", groupId, address.Handle)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// SQL for the ids of the groups whose notes the address can see, the ones it's a member of or owns
+// takes the address's handle and host as arguments, see groupsOfArgs
+const groupsOfSQL = "SELECT GroupId FROM GroupMember WHERE Handle = ? AND Host = ? " +
+	"UNION SELECT `Group`.GroupId FROM `Group` JOIN User ON `Group`.UserId = User.UserId WHERE User.Handle = ?"
+
+func groupsOfArgs(address *Address) []interface{} {
+	// only users of this host own groups here, and no user has an empty handle
+	owner := ""
+	if address.IsLocal() {
+		owner = address.Handle
+	}
+	return []interface{}{address.Handle, address.Host, owner}
+}
@@ -2,13 +2,10 @@ package main
 
 import (
 	"database/sql"
-	"errors"
 	"fmt"
 	"github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
 	"github.com/jmoiron/sqlx"
-	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
 	"strings"
@@ -18,17 +15,30 @@ import (
 // allow at least this much time for the token exchange transaction to complete
 const GuestTokenTimeout = 30
 
+// when a request was delivered but no token came back, ask again after this long
+// the other host may still be retrying its answer until then
+const GuestTokenRetrySeconds = 3600
+
 type Host struct {
 	HostId int64
 	Name string
 	Location string
+	// the API version the host's location was given with, and when it was last looked for
+	Version string
+	LocationDate mysql.NullTime
+	// base64, for checking the host's signed requests
+	PublicKey string
+	PublicKeyDate mysql.NullTime
 }
 
 type Guest struct {
 	GuestId int64
 	Handle string
 	HostId int64
-	Token string
+	// only known when the token is made, never stored
+	Token string `db:"-"`
+	TokenPrefix string
+	TokenHash string
 	CreatedDate mysql.NullTime
 }
 
@@ -36,6 +46,7 @@ type UserHost struct {
 	UserId int64
 	HostId int64
 	Nonce string
+	// sealed, see OpenToken
 	Token string
 	CreatedDate mysql.NullTime
 }
@@ -58,16 +69,16 @@ func GetUserHostHandler(rw http.ResponseWriter, r *http.Request) {
 	handle := mux.Vars(r)["handle"]	
 	hostname := mux.Vars(r)["host"]
 
-	var user User
-	err = db.Get(&user, "SELECT UserId, Handle FROM User WHERE Handle LIKE ?", handle)
-	if err == sql.ErrNoRows {
-		sendError(rw, http.StatusNotFound, err.Error())
-		return
-	} else if err != nil {
+	user, err := FetchUserByHandle(db, handle)
+	if err != nil {
 		fmt.Println(err)
 		sendError(rw, http.StatusInternalServerError, err.Error())
 		return
 	}
+	if user == nil {
+		sendError(rw, http.StatusNotFound, "There is no user with that handle.")
+		return
+	}
 	if token.UserId != user.UserId {
 		fmt.Println(err)
 		sendError(rw, http.StatusUnauthorized, "Unauthorized")
@@ -85,9 +96,15 @@ func GetUserHostHandler(rw http.ResponseWriter, r *http.Request) {
 	err = db.Get(&userHost, "SELECT * FROM UserHost WHERE UserId = ? AND HostId = ?", user.UserId, host.HostId)
 	if err == nil && len(userHost.Token) > 0 {
 		// we found it
+		guestToken, err := OpenToken(userHost.Token)
+		if err != nil {
+			fmt.Println(err)
+			sendError(rw, http.StatusInternalServerError, err.Error())
+			return
+		}
 		sendData(rw, http.StatusOK, map[string]interface{}{
 				"host": hostname,
-				"token": userHost.Token,
+				"token": guestToken,
 			})
 		return
 	} else if err == nil && time.Now().Before(userHost.CreatedDate.Time.Add(time.Duration(GuestTokenTimeout) * time.Second)) {
@@ -100,6 +117,24 @@ func GetUserHostHandler(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	job, err := RequestGuestToken(db, user, host)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// at this point we don't know how the foreign host will respond, so send 202 Accepted
+	// the user can follow the request's progress with the job id
+	sendData(rw, http.StatusAccepted, map[string]interface{}{
+			"JobId": job.JobId,
+		})
+}
+
+// start the guest authentication process for the user with the foreign host
+// the token will arrive later at PostUserHostHandler
+func RequestGuestToken(db *sqlx.DB, user *User, host *Host) (*FederationJob, error) {
+	var userHost UserHost
 	userHost.UserId = user.UserId
 	userHost.HostId = host.HostId
 	userHost.Nonce = RandomString(50)
@@ -107,56 +142,85 @@ func GetUserHostHandler(rw http.ResponseWriter, r *http.Request) {
 	userHost.CreatedDate.Time = time.Now()
 	userHost.CreatedDate.Valid = true
 
-	_, err = db.NamedExec("INSERT INTO `UserHost` (`UserId`, `HostId`, `Nonce`, `Token`, `CreatedDate`) " +
+	_, err := db.NamedExec("INSERT INTO `UserHost` (`UserId`, `HostId`, `Nonce`, `Token`, `CreatedDate`) " +
 				"VALUES (:UserId, :HostId, :Nonce, :Token, :CreatedDate) " +
 				"ON DUPLICATE KEY UPDATE `Nonce` = :Nonce, `Token` = :Token, `CreatedDate` = :CreatedDate", &userHost)
 	if err != nil {
-		fmt.Println(err)
-		sendError(rw, http.StatusInternalServerError, err.Error())
-		return
+		return nil, err
 	}
 
-	// at this point we don't know how the foreign host will respond, so send 202 Accepted
-	sendData(rw, http.StatusAccepted, "")
+	job := &FederationJob{UserId: user.UserId, Kind: JobGuestRequest, Host: host.Name, Method: "POST", Path: "/guest"}
+	err = EnqueueFederationJob(db, job, url.Values{"host": {cfg.Api.Host}, "handle": {user.Handle}, "nonce": {userHost.Nonce}})
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
 
-	go func() {
-		if len(host.Location) == 0 {
-			err := DiscoverHost(db, host)
-			if err != nil {
-				log.Println(err)
-				return
-			}
-		}
+// the user's guest token for the host, or "" if they don't have one yet
+func FetchUserHostToken(db *sqlx.DB, userId int64, hostId int64) (string, error) {
+	var sealed string
+	err := db.Get(&sealed, "SELECT Token FROM UserHost WHERE UserId = ? AND HostId = ?", userId, hostId)
+	if err == sql.ErrNoRows {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return OpenToken(sealed)
+}
 
-		resp, err := http.PostForm("https://" + host.Location + "/guest",
-			url.Values{"host": {cfg.Api.Host}, "handle": {user.Handle}, "nonce": {userHost.Nonce}})
-		if err != nil {
-		    log.Println(err)
-		    return
+// start the guest authentication process with the host unless the user already has a token for it
+func EnsureGuestToken(db *sqlx.DB, user *User, hostname string) error {
+	host, err := FetchHost(db, hostname)
+	if err != nil {
+		return err
+	}
+	var userHost UserHost
+	err = db.Get(&userHost, "SELECT * FROM UserHost WHERE UserId = ? AND HostId = ?", user.UserId, host.HostId)
+	if err == nil {
+		if len(userHost.Token) > 0 {
+			return nil
 		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode != http.StatusAccepted {
-	        log.Println(resp.Status)
-			bodyBytes, _ := ioutil.ReadAll(resp.Body) 
-	        log.Println(string(bodyBytes))
+		if len(userHost.Nonce) > 0 && time.Now().Before(userHost.CreatedDate.Time.Add(GuestTokenRetrySeconds * time.Second)) {
+			return nil
 		}
-	}()
+	} else if err != sql.ErrNoRows {
+		return err
+	}
+
+	// the request may still be waiting in the queue
+	pending, err := HasUnfinishedJob(db, JobGuestRequest, user.UserId, host.Name)
+	if err != nil || pending {
+		return err
+	}
+	_, err = RequestGuestToken(db, user, host)
+	return err
 }
 
 // called by foreign host to place an access token for user of this host
 func PostUserHostHandler(rw http.ResponseWriter, r *http.Request) {
-	r.ParseForm()
+	signer, ok := signedHostFromRequest(rw, r)
+	if !ok {
+		return
+	}
 	hostname := r.PostFormValue("host")
 	if len(hostname) == 0 {
 		sendError(rw, http.StatusBadRequest, "Host is missing.")
 		return
 	}
+	if !strings.EqualFold(hostname, signer.Name) {
+		sendError(rw, http.StatusUnauthorized, "The request is not signed by " + hostname + ".")
+		return
+	}
 	token := r.PostFormValue("token")
 	if len(token) == 0 {
 		sendError(rw, http.StatusBadRequest, "Token is missing.")
 		return
 	}
+	if len(token) > MaximumForeignTokenLength {
+		sendError(rw, http.StatusBadRequest, "Token is too long.")
+		return
+	}
 	nonce := r.PostFormValue("nonce")
 	if len(nonce) == 0 {
 		sendError(rw, http.StatusBadRequest, "Nonce is missing.")
@@ -165,16 +229,16 @@ func PostUserHostHandler(rw http.ResponseWriter, r *http.Request) {
 
 	handle := mux.Vars(r)["handle"]	
 
-	var user User
-	err := db.Get(&user, "SELECT UserId, Handle FROM User WHERE Handle LIKE ?", handle)
-	if err == sql.ErrNoRows {
-		sendError(rw, http.StatusNotFound, "There is no user with that handle.")
-		return
-	} else if err != nil {
+	user, err := FetchUserByHandle(db, handle)
+	if err != nil {
 		fmt.Println(err)
 		sendError(rw, http.StatusInternalServerError, err.Error())
 		return
 	}
+	if user == nil {
+		sendError(rw, http.StatusNotFound, "There is no user with that handle.")
+		return
+	}
 
 	host, err := FetchHost(db, hostname)
 	if err != nil {
@@ -184,7 +248,7 @@ func PostUserHostHandler(rw http.ResponseWriter, r *http.Request) {
 	}
 
 	var userHost UserHost
-	err = db.Get(&userHost, "SELECT * FROM UserHost WHERE UserId = ? AND HostId = ? AND Nonce LIKE ?",
+	err = db.Get(&userHost, "SELECT * FROM UserHost WHERE UserId = ? AND HostId = ? AND Nonce = ?",
 		user.UserId, host.HostId, nonce)
 	if err == sql.ErrNoRows {
 		sendError(rw, http.StatusUnauthorized, "The user did not request a guest token.")
@@ -195,6 +259,12 @@ func PostUserHostHandler(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	userHost.Token, err = SealToken(token)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
 	_, err = db.NamedExec("UPDATE UserHost SET Nonce = '', Token = :Token WHERE UserId = :UserId AND HostId = :HostId", &userHost)
 	if err != nil {
 		fmt.Println(err)
@@ -206,42 +276,42 @@ func PostUserHostHandler(rw http.ResponseWriter, r *http.Request) {
 
 // called by foreign host to request access token for one of its users
 func PostGuestHandler(rw http.ResponseWriter, r *http.Request) {
-	r.ParseForm()
+	signer, ok := signedHostFromRequest(rw, r)
+	if !ok {
+		return
+	}
 	handle := r.PostFormValue("handle")
 	if len(handle) == 0 {
 		sendError(rw, http.StatusBadRequest, "Handle is missing.")
 		return
 	}
+	if !IsValidHandle(handle) {
+		sendError(rw, http.StatusBadRequest, "Invalid handle.")
+		return
+	}
 	hostname := r.PostFormValue("host")
 	if len(hostname) == 0 {
 		sendError(rw, http.StatusBadRequest, "Host is missing.")
 		return
 	}
+	if !strings.EqualFold(hostname, signer.Name) {
+		sendError(rw, http.StatusUnauthorized, "The request is not signed by " + hostname + ".")
+		return
+	}
 	nonce := r.PostFormValue("nonce")
 	if len(nonce) == 0 {
 		sendError(rw, http.StatusBadRequest, "Nonce is missing.")
 		return
 	}
 
-	host, err := FetchHost(db, hostname)
-	if err != nil {
-		fmt.Println(err)
-		sendError(rw, http.StatusInternalServerError, err.Error())
-		return
-	}
-
+	host := signer
 	var guest Guest
-	err = db.Get(&guest, "SELECT * FROM Guest WHERE Handle LIKE ? AND HostId = ?", handle, host.HostId)
-	if err == sql.ErrNoRows {
-		guest.Handle = handle
-		guest.HostId = host.HostId
-		guest.CreatedDate.Time = time.Now()
-		guest.CreatedDate.Valid = true
-	} else if err != nil {
+	err := db.Get(&guest, "SELECT * FROM Guest WHERE Handle = ? AND HostId = ?", handle, host.HostId)
+	if err != nil && err != sql.ErrNoRows {
 		fmt.Println(err)
 		sendError(rw, http.StatusInternalServerError, err.Error())
 		return
-	} else {
+	} else if err == nil {
 		// already exists, rate limit requests
 		if time.Now().Before(guest.CreatedDate.Time.Add(time.Duration(GuestTokenTimeout) * time.Second)) {
 			sendError(rw, 429, "Too many requests for this guest.")
@@ -249,49 +319,59 @@ func PostGuestHandler(rw http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	guest.Token = RandomString(50)
+	// the token is saved by SaveGuestToken once the user's host has taken it
+	job := &FederationJob{Kind: JobGuestToken, Host: host.Name, Method: "POST", Path: "/user/" + handle + "/host", Handle: handle}
+	err = EnqueueFederationJob(db, job, url.Values{"host": {cfg.Api.Host}, "token": {RandomString(50)}, "nonce": {nonce}})
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
 
 	// at this point we don't know how the user's host will respond, so send 202 Accepted
 	sendData(rw, http.StatusAccepted, "")
+}
 
-	go func() {
-		if len(host.Location) == 0 {
-			err := DiscoverHost(db, host)
-			if err != nil {
-				log.Println(err)
-				return
-			}
-		}
+// save the guest token the user's host has accepted
+// not before, otherwise an attacker could destroy guest tokens by posting to /guest with a bum nonce
+func SaveGuestToken(db *sqlx.DB, host *Host, handle string, token string) error {
+	guest := Guest{Handle: handle, HostId: host.HostId, TokenPrefix: TokenPrefix(token), TokenHash: TokenHash(token)}
+	guest.CreatedDate.Time = time.Now()
+	guest.CreatedDate.Valid = true
+	_, err := db.NamedExec("INSERT INTO `Guest` (`Handle`, `HostId`, `TokenPrefix`, `TokenHash`, `CreatedDate`) " +
+		"VALUES (:Handle, :HostId, :TokenPrefix, :TokenHash, :CreatedDate) " +
+		"ON DUPLICATE KEY UPDATE `TokenPrefix` = VALUES(`TokenPrefix`), `TokenHash` = VALUES(`TokenHash`)", &guest)
+	return err
+}
 
-		resp, err := http.PostForm("https://" + host.Location + "/user/" + guest.Handle + "/host",
-			url.Values{"host": {cfg.Api.Host}, "token": {guest.Token}, "nonce": {nonce}})
-		if err != nil {
-		    log.Println(err)
-		    return
-		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode == http.StatusOK {
-			// don't save until we get a successful response,
-			// otherwise an attacker could destroy guest tokens by posting this request with a bum nonce
-			_, err = db.NamedExec("INSERT INTO `Guest` (`Handle`, `HostId`, `Token`, `CreatedDate`) " +
-				"VALUES (:Handle, :HostId, :Token, :CreatedDate) " +
-				"ON DUPLICATE KEY UPDATE `Token` = VALUES(`Token`)", &guest)
-			if err != nil {
-			    log.Println(err)
-			    return
-			}
-		} else {
-	        log.Println(resp.Status)
-			bodyBytes, _ := ioutil.ReadAll(resp.Body) 
-	        log.Println(string(bodyBytes))
-		}
-	}()
+// check that the request was signed by another host, or send 401
+// parses the form, which can't be done before the signature is checked
+func signedHostFromRequest(rw http.ResponseWriter, r *http.Request) (*Host, bool) {
+	host, err := VerifyHostRequest(db, r)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusUnauthorized, err.Error())
+		return nil, false
+	}
+	r.ParseForm()
+	return host, true
+}
+
+// the host if we already know of it, or nil
+func FindHost(db *sqlx.DB, hostname string) (*Host, error) {
+	var host Host
+	err := db.Get(&host, "SELECT * FROM Host WHERE Name = ?", hostname)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &host, nil
 }
 
 func FetchHost(db *sqlx.DB, hostname string)  (*Host, error) {
 	var host Host
-	err := db.Get(&host, "SELECT * FROM Host WHERE Name LIKE ?", hostname)
+	err := db.Get(&host, "SELECT * FROM Host WHERE Name = ?", hostname)
 	host.Name = hostname
 
 	if err == sql.ErrNoRows {
@@ -308,50 +388,3 @@ func FetchHost(db *sqlx.DB, hostname string)  (*Host, error) {
 	}
 	return &host, nil
 }
-
-func DiscoverHost(db *sqlx.DB, host *Host) error {
-	urls := []string{
-		"https://" + host.Name,
-		"https://" + host.Name + ":" + IMPDefaultPort,
-		"http://" + host.Name,
-	}
-
-	for len(urls) > 0 {
-		lurl, urls := urls[0], urls[1:]
-
-		// this will follow redirects
-		resp, err := http.Get(lurl)
-		if err != nil || resp.StatusCode != http.StatusOK {
-			// that didn't work, try the next one
-			continue
-		}
-		defer resp.Body.Close()
-
-		location := resp.Header.Get(IMPLocationHeader)
-		if len(location) > 0 {
-			s := strings.Split(location, ";")
-			location = s[len(s) - 1]
-
-			if lurl == "https://" + location {
-				// we found it! the API location we got is the URL we're looking at
-				host.Location = location
-
-				_, err = db.Exec("UPDATE Host SET Location = ? WHERE HostId = ?", host.Location, host.HostId)
-				if err != nil {
-					log.Println(err)
-				}
-				return nil
-			}
-
-			// it's good that we found our header, but let's go there to verify
-			// put it in the front of the queue
-			// TODO: server misconfiguration could lead to infinite loop?
-			urls = append([]string{ "https://" + location }, urls...)
-			continue
-		}
-
-		// TODO: parse html with golang.org/x/net/html 
-		// TODO: and look for <meta http-equiv=...
-	}
-	return errors.New("Could not locate the IMP host.")
-}
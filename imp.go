@@ -1,12 +1,16 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 	
 	"github.com/gorilla/mux"
 	"github.com/unrolled/render"
@@ -17,33 +21,47 @@ import (
 const (
 	IMPLocationHeader = "IMP-API-Location"
 	IMPDefaultPort = "5039"		// 443 would actually be our first choice
+	// how long to wait for requests and deliveries to finish when shutting down
+	ShutdownTimeoutSeconds = 30
 )
 
 var cfg Config
 var db *sqlx.DB
 
 func sendError(rw http.ResponseWriter, status int, message string) {
-	rw.Header().Set(IMPLocationHeader, cfg.Api.Version + ";" + cfg.Api.Location)
+	sendErrors(rw, status, []string{message})
+}
+
+// for when there is more than one thing wrong with the request
+func sendErrors(rw http.ResponseWriter, status int, messages []string) {
+	rw.Header().Set(IMPLocationHeader, locationHeaderValue())
+	errors := []interface{}{}
+	for _, message := range messages {
+		errors = append(errors, map[string]interface{}{
+			"status": fmt.Sprintf("%d",status),
+			"title": message,
+			"detail": message,
+		})
+	}
 	envelope := map[string]interface{}{
-		"errors": [1]interface{}{
-			map[string]interface{}{
-				"status": fmt.Sprintf("%d",status),
-				"title": message,
-				"detail": message,
-			},
-		},
+		"errors": errors,
 	}
 	render.New().JSON(rw, status, envelope)
 }
 
 func sendData(rw http.ResponseWriter, status int, data interface{}) {
-	rw.Header().Set(IMPLocationHeader, cfg.Api.Version + ";" + cfg.Api.Location)
+	rw.Header().Set(IMPLocationHeader, locationHeaderValue())
 	envelope := map[string]interface{}{
 		"data": data,
 	}
 	render.New().JSON(rw, status, envelope)
 }
 
+// like 0.9;imp.example.com/api
+func locationHeaderValue() string {
+	return cfg.Api.Version + ";" + cfg.Api.Location
+}
+
 func getIP(r *http.Request) string {
     if ipProxy := r.Header.Get("X-Forwarded-For"); len(ipProxy) > 0 {
     	ips := strings.Split(ipProxy, ", ")
@@ -59,6 +77,14 @@ func main() {
 		log.Fatalln(err)
 	}
 	log.Println("Loaded config.")
+	if len(cfg.Server.TokenKey) < MinimumTokenKeyLength {
+		log.Fatalln("The tokenkey in the [server] config section must be at least", MinimumTokenKeyLength, "characters.")
+	}
+
+	err = LoadSigningKey(cfg.Server.SigningKey)
+	if err != nil {
+		log.Fatalln(err)
+	}
 
 	// set up database connection
 	db, err = sqlx.Open("mysql", cfg.Database.User + ":" + cfg.Database.Password + "@/" + cfg.Database.Database)
@@ -78,23 +104,56 @@ func main() {
 		return s
 	})
 
+	// offline commands, such as exporting an account, run instead of the server
+	ran, err := RunCommand(db, os.Args[1:])
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if ran {
+		return
+	}
+
 	// set up routes
 	r := mux.NewRouter()
-    r.HandleFunc("/",  func (rw http.ResponseWriter, r *http.Request) {
-    	sendData(rw, http.StatusOK, "")
-	})
+    r.HandleFunc("/", RootHandler).Methods("GET")
+    r.NotFoundHandler = http.HandlerFunc(NotFoundHandler)
+    r.MethodNotAllowedHandler = http.HandlerFunc(MethodNotAllowedHandler)
 
 	// authentication
     r.HandleFunc("/token", PostTokenHandler).Methods("POST")
     r.HandleFunc("/token/{token}", DeleteTokenHandler).Methods("DELETE")
+    r.HandleFunc("/password/reset", PostPasswordResetHandler).Methods("POST")
+    r.HandleFunc("/password/reset", PutPasswordResetHandler).Methods("PUT")
+    r.HandleFunc("/user/{handle}/session", ListSessionsHandler).Methods("GET")
+    r.HandleFunc("/user/{handle}/session", DeleteSessionsHandler).Methods("DELETE")
+    r.HandleFunc("/user/{handle}/session/{id}", DeleteSessionHandler).Methods("DELETE")
 
     // guest authentication
     r.HandleFunc("/user/{handle}/host/{host}", GetUserHostHandler).Methods("GET")
     r.HandleFunc("/user/{handle}/host", PostUserHostHandler).Methods("POST")
     r.HandleFunc("/guest", PostGuestHandler).Methods("POST")
+    r.HandleFunc(HostKeyPath, GetHostKeyHandler).Methods("GET")
 
     // users
 	r.HandleFunc("/user", PostUserHandler).Methods("POST")
+	r.HandleFunc("/user/{handle}", GetUserHandler).Methods("GET")
+	r.HandleFunc("/user/{handle}", PutUserHandler).Methods("PUT")
+	r.HandleFunc("/user/{handle}/password", PutPasswordHandler).Methods("PUT")
+	r.HandleFunc("/user/{handle}/email", VerifyEmailHandler).Methods("GET")
+	r.HandleFunc("/user/{handle}/email", ResendVerificationEmailHandler).Methods("POST")
+	r.HandleFunc("/user/{handle}/status", PutStatusHandler).Methods("PUT")
+	r.HandleFunc("/user/{handle}/essence", PutEssenceHandler).Methods("PUT")
+	r.HandleFunc("/user/{handle}/archive", ExportArchiveHandler).Methods("GET")
+	r.HandleFunc("/user/{handle}/archive", ImportArchiveHandler).Methods("POST")
+
+	// moving to another host
+	r.HandleFunc("/user/{handle}/move", PostMoveHandler).Methods("POST")
+	r.HandleFunc("/user/{handle}/moved", GetMovedHandler).Methods("GET")
+	r.HandleFunc("/moved", PostMovedHandler).Methods("POST")
+
+	// deliveries to other hosts
+	r.HandleFunc("/user/{handle}/federation", ListFederationJobsHandler).Methods("GET")
+	r.HandleFunc("/user/{handle}/federation/{id}", GetFederationJobHandler).Methods("GET")
 
 	// notes
 	r.HandleFunc("/note", ListNotesHandler).Methods("GET")
@@ -102,23 +161,53 @@ func main() {
 	r.HandleFunc("/note/{id}", GetNoteHandler).Methods("GET")
 	r.HandleFunc("/note/{id}", PutNoteHandler).Methods("PUT")
 	r.HandleFunc("/note/{id}", DeleteNoteHandler).Methods("DELETE")
+	r.HandleFunc("/note/{id}/thread", GetThreadHandler).Methods("GET")
+	r.HandleFunc("/note/{id}/repost", PostRepostHandler).Methods("POST")
+
+	// favorites and bookmarks
+	r.HandleFunc("/note/{id}/favorite", PutFavoriteHandler).Methods("PUT")
+	r.HandleFunc("/note/{id}/favorite", DeleteFavoriteHandler).Methods("DELETE")
+	r.HandleFunc("/note/{id}/bookmark", PutBookmarkHandler).Methods("PUT")
+	r.HandleFunc("/note/{id}/bookmark", DeleteBookmarkHandler).Methods("DELETE")
+	r.HandleFunc("/user/{handle}/favorite", ListFavoritesHandler).Methods("GET")
+	r.HandleFunc("/user/{handle}/bookmark", ListBookmarksHandler).Methods("GET")
+
+	// direct messages
+	r.HandleFunc("/message", PostMessageHandler).Methods("POST")
+	r.HandleFunc("/message/{id}", DeleteMessageHandler).Methods("DELETE")
+	r.HandleFunc("/conversation", ListConversationsHandler).Methods("GET")
+	r.HandleFunc("/conversation/{id}", GetConversationHandler).Methods("GET")
+
+	// end-to-end encrypted messages
+	r.HandleFunc("/user/{handle}/key", ListPublicKeysHandler).Methods("GET")
+	r.HandleFunc("/user/{handle}/key", PutPublicKeyHandler).Methods("PUT")
+	r.HandleFunc("/key/{address}", GetAddressKeysHandler).Methods("GET")
+	r.HandleFunc("/encrypted", PostEncryptedMessageHandler).Methods("POST")
+	r.HandleFunc("/encrypted", ListEncryptedMessagesHandler).Methods("GET")
+	r.HandleFunc("/encrypted/{id}", DeleteEncryptedMessageHandler).Methods("DELETE")
 
 	// groups
-	r.HandleFunc("/group", NotImplementedHandler).Methods("GET")
-	r.HandleFunc("/group", NotImplementedHandler).Methods("POST")
-	r.HandleFunc("/group/{id}", NotImplementedHandler).Methods("GET")
-	r.HandleFunc("/group/{id}", NotImplementedHandler).Methods("PUT")
-	r.HandleFunc("/group/{id}", NotImplementedHandler).Methods("DELETE")
-	r.HandleFunc("/group/{id}/{address}", NotImplementedHandler).Methods("PUT")
-	r.HandleFunc("/group/{id}/{address}", NotImplementedHandler).Methods("DELETE")
+	r.HandleFunc("/group", ListGroupsHandler).Methods("GET")
+	r.HandleFunc("/group", PostGroupHandler).Methods("POST")
+	r.HandleFunc("/group/{id}", GetGroupHandler).Methods("GET")
+	r.HandleFunc("/group/{id}", PutGroupHandler).Methods("PUT")
+	r.HandleFunc("/group/{id}", DeleteGroupHandler).Methods("DELETE")
+	r.HandleFunc("/group/{id}/{address}", PutGroupMemberHandler).Methods("PUT")
+	r.HandleFunc("/group/{id}/{address}", DeleteGroupMemberHandler).Methods("DELETE")
 
 	// mutes and blocks
-	r.HandleFunc("/user/{handle}/mute", NotImplementedHandler).Methods("GET")
-	r.HandleFunc("/user/{handle}/mute/{address}", NotImplementedHandler).Methods("PUT")
-	r.HandleFunc("/user/{handle}/mute/{address}", NotImplementedHandler).Methods("DELETE")
-	r.HandleFunc("/user/{handle}/block", NotImplementedHandler).Methods("GET")
-	r.HandleFunc("/user/{handle}/block/{address}", NotImplementedHandler).Methods("PUT")
-	r.HandleFunc("/user/{handle}/block/{address}", NotImplementedHandler).Methods("DELETE")
+	r.HandleFunc("/user/{handle}/mute", ListMutesHandler).Methods("GET")
+	r.HandleFunc("/user/{handle}/mute/{address}", PutMuteHandler).Methods("PUT")
+	r.HandleFunc("/user/{handle}/mute/{address}", DeleteMuteHandler).Methods("DELETE")
+	r.HandleFunc("/user/{handle}/block", ListBlocksHandler).Methods("GET")
+	r.HandleFunc("/user/{handle}/block/{address}", PutBlockHandler).Methods("PUT")
+	r.HandleFunc("/user/{handle}/block/{address}", DeleteBlockHandler).Methods("DELETE")
+
+	// follows
+	r.HandleFunc("/user/{handle}/follow", ListFollowsHandler).Methods("GET")
+	r.HandleFunc("/user/{handle}/follow/{address}", PutFollowHandler).Methods("PUT")
+	r.HandleFunc("/user/{handle}/follow/{address}", DeleteFollowHandler).Methods("DELETE")
+	r.HandleFunc("/user/{handle}/timeline", TimelineHandler).Methods("GET")
 
     // Heroku uses env var to specify port
     port := os.Getenv("PORT")
@@ -129,12 +218,90 @@ func main() {
 		port = IMPDefaultPort
 	}
 
+    go SweepTokens(db)
+	err = StartFederationQueue(db)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
     hostname := cfg.Server.Host + ":" + port
-    log.Println("Listening on " + hostname + ".")
-	http.ListenAndServeTLS(hostname, cfg.Server.Certificate, cfg.Server.Key, r)
+    server := &http.Server{Addr: hostname, Handler: withLocationHeader(r)}
+    go func() {
+	    log.Println("Listening on " + hostname + ".")
+		err := server.ListenAndServeTLS(cfg.Server.Certificate, cfg.Server.Key)
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalln(err)
+		}
+	}()
+
+	// plain HTTP only answers discovery, and sends everything else to HTTPS
+	var httpServer *http.Server
+	if len(cfg.Server.HTTPPort) > 0 {
+		httpHostname := cfg.Server.Host + ":" + cfg.Server.HTTPPort
+		httpServer = &http.Server{Addr: httpHostname, Handler: withLocationHeader(http.HandlerFunc(PlainHTTPHandler))}
+		go func() {
+			log.Println("Listening for plain HTTP on " + httpHostname + ".")
+			err := httpServer.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				log.Fatalln(err)
+			}
+		}()
+	}
+
+	// on interrupt, finish the requests and deliveries in progress before exiting
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	log.Println("Shutting down.")
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeoutSeconds * time.Second)
+	defer cancel()
+	err = server.Shutdown(ctx)
+	if err != nil {
+		log.Println(err)
+	}
+	if httpServer != nil {
+		err = httpServer.Shutdown(ctx)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	DrainFederationQueue(ctx)
 }
 
 func NotImplementedHandler(rw http.ResponseWriter, r *http.Request) {
 	sendError(rw, http.StatusNotImplemented, "Not Implemented")
 }
 
+// the root answers discovery: browsers get a page with the location in a meta tag, and API clients an empty envelope
+func RootHandler(rw http.ResponseWriter, r *http.Request) {
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		render.New().HTML(rw, http.StatusOK, "root", map[string]interface{}{
+				"Host": cfg.Api.Host,
+				"Location": locationHeaderValue(),
+			})
+		return
+	}
+	sendData(rw, http.StatusOK, "")
+}
+
+func NotFoundHandler(rw http.ResponseWriter, r *http.Request) {
+	sendError(rw, http.StatusNotFound, "Not Found")
+}
+
+func MethodNotAllowedHandler(rw http.ResponseWriter, r *http.Request) {
+	sendError(rw, http.StatusMethodNotAllowed, "Method Not Allowed")
+}
+
+// every response carries the location header, even ones that don't come from sendData or sendError
+func withLocationHeader(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set(IMPLocationHeader, locationHeaderValue())
+		h.ServeHTTP(rw, r)
+	})
+}
+
+// the location header answers discovery, but API calls are sent to the root of the domain
+// rather than the same URL over HTTPS, so clients don't get used to starting out with plain HTTP
+func PlainHTTPHandler(rw http.ResponseWriter, r *http.Request) {
+	http.Redirect(rw, r, "https://" + cfg.Api.Host + "/", http.StatusMovedPermanently)
+}
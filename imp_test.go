@@ -0,0 +1,97 @@
+package main
+
+import (
+	"github.com/jmoiron/sqlx"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Tests that need MySQL run against the database named by IMP_TEST_DATABASE, like
+//
+//     IMP_TEST_DATABASE='imp:secret@/imp_test' go test
+//
+// Every table in it is dropped and created again from create_imp_database.sql, so don't point it at real data.
+// Without it those tests are skipped.
+
+const (
+	testHost = "imp.test"
+	testTokenKey = "0123456789abcdef0123456789abcdef"
+)
+
+func openTestDB(t *testing.T) *sqlx.DB {
+	dsn := os.Getenv("IMP_TEST_DATABASE")
+	if len(dsn) == 0 {
+		t.Skip("IMP_TEST_DATABASE is not set")
+	}
+	if strings.Contains(dsn, "?") {
+		dsn += "&multiStatements=true"
+	} else {
+		dsn += "?multiStatements=true"
+	}
+	tdb, err := sqlx.Connect("mysql", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tables := []string{}
+	err = tdb.Select(&tables, "SHOW TABLES")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range tables {
+		tdb.MustExec("DROP TABLE `" + table + "`")
+	}
+	schema, err := ioutil.ReadFile("create_imp_database.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tdb.MustExec(string(schema))
+
+	// handlers use the globals
+	savedDB, savedHost, savedKey := db, cfg.Api.Host, cfg.Server.TokenKey
+	db, cfg.Api.Host, cfg.Server.TokenKey = tdb, testHost, testTokenKey
+	t.Cleanup(func() {
+		db, cfg.Api.Host, cfg.Server.TokenKey = savedDB, savedHost, savedKey
+		tdb.Close()
+	})
+	return tdb
+}
+
+func insertTestUser(t *testing.T, tdb *sqlx.DB, handle string) int64 {
+	result, err := tdb.Exec("INSERT INTO `User` (`Handle`, `Email`, `PasswordHash`) VALUES (?, ?, '')",
+		handle, handle + "@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// log the user in, and return the Authorization header for their requests
+func testAuthorization(t *testing.T, tdb *sqlx.DB, userId int64) string {
+	token, err := MakeToken(tdb, &User{UserId: userId}, httptest.NewRequest("POST", "/token", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return UserAuthPrefix + token.Token
+}
+
+// call the handler with the form, as whoever the Authorization header says
+func testFormRequest(handler http.HandlerFunc, method string, path string, form url.Values, authorization string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if len(authorization) > 0 {
+		r.Header.Set("Authorization", authorization)
+	}
+	rw := httptest.NewRecorder()
+	handler(rw, r)
+	return rw
+}
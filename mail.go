@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// a new verification email can be requested this often
+	SecondsBetweenVerificationEmails = 300
+	// and its link works for this long
+	VerificationEmailLifetimeHours = 48
+	DefaultSMTPPort = "25"
+)
+
+// send a plain text email with the [mail] config
+// if a sink file is configured, the message is appended to it instead, for testing without a mail server
+func SendMail(to string, subject string, body string) error {
+	from := mail.Address{Name: cfg.Mail.Name, Address: cfg.Mail.Address}
+	recipient := mail.Address{Address: to}
+	msg := "From: " + from.String() + "\r\n" +
+		"To: " + recipient.String() + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + strings.Replace(body, "\n", "\r\n", -1)
+
+	if len(cfg.Mail.Sink) > 0 {
+		f, err := os.OpenFile(cfg.Mail.Sink, os.O_APPEND | os.O_CREATE | os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = f.WriteString(msg + "\r\n.\r\n")
+		return err
+	}
+
+	port := cfg.Mail.Port
+	if len(port) == 0 {
+		port = DefaultSMTPPort
+	}
+	var auth smtp.Auth
+	if len(cfg.Mail.User) > 0 {
+		auth = smtp.PlainAuth("", cfg.Mail.User, cfg.Mail.Password, cfg.Mail.Host)
+	}
+	return smtp.SendMail(cfg.Mail.Host + ":" + port, auth, cfg.Mail.Address, []string{to}, []byte(msg))
+}
+
+// give the user a new verification token and email them a link to verify it
+// the token is saved before the email is sent in the background
+func StartEmailVerification(db *sqlx.DB, user *User) error {
+	user.EmailValidationToken.String = RandomString(50)
+	user.EmailValidationToken.Valid = true
+	user.EmailValidationDate.Time = time.Now()
+	user.EmailValidationDate.Valid = true
+	_, err := db.NamedExec("UPDATE User SET EmailValidationToken = :EmailValidationToken, " +
+		"EmailValidationDate = :EmailValidationDate WHERE UserId = :UserId", user)
+	if err != nil {
+		return err
+	}
+
+	link := "https://" + cfg.Api.Location + "/user/" + url.QueryEscape(user.Handle) + "/email?token=" +
+		url.QueryEscape(user.EmailValidationToken.String)
+	body := "Welcome to IMP, " + LocalAddress(user.Handle).String() + "!\n\n" +
+		"Please verify your email address by visiting this link within " +
+		fmt.Sprintf("%d", VerificationEmailLifetimeHours) + " hours:\n\n" + link + "\n\n" +
+		"If you didn't sign up for IMP, you can ignore this email.\n"
+	email := user.Email
+	go func() {
+		err := SendMail(email, "Verify your IMP email address", body)
+		if err != nil {
+			log.Println("Could not send verification email:", err)
+		}
+	}()
+	return nil
+}
+
+// the link in the verification email
+func VerifyEmailHandler(rw http.ResponseWriter, r *http.Request) {
+	user, err := FetchUserByHandle(db, mux.Vars(r)["handle"])
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if user == nil {
+		sendError(rw, http.StatusNotFound, "There is no user with that handle.")
+		return
+	}
+	if user.IsValidEmail {
+		sendData(rw, http.StatusOK, "")
+		return
+	}
+
+	token := r.FormValue("token")
+	expired := !user.EmailValidationDate.Valid ||
+		time.Now().After(user.EmailValidationDate.Time.Add(VerificationEmailLifetimeHours * time.Hour))
+	if !user.EmailValidationToken.Valid || len(token) == 0 || expired ||
+		subtle.ConstantTimeCompare([]byte(token), []byte(user.EmailValidationToken.String)) != 1 {
+		sendError(rw, http.StatusBadRequest, "The verification link is invalid or has expired.")
+		return
+	}
+
+	_, err = db.Exec("UPDATE User SET IsValidEmail = 1, EmailValidationToken = NULL WHERE UserId = ?", user.UserId)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sendData(rw, http.StatusOK, "")
+}
+
+// send the authenticated user a new verification email
+func ResendVerificationEmailHandler(rw http.ResponseWriter, r *http.Request) {
+	user, ok := listOwnerFromRequest(rw, r)
+	if !ok {
+		return
+	}
+	if user.IsValidEmail {
+		sendError(rw, http.StatusConflict, "Your email address is already verified.")
+		return
+	}
+	if user.EmailValidationDate.Valid &&
+		time.Now().Before(user.EmailValidationDate.Time.Add(SecondsBetweenVerificationEmails * time.Second)) {
+		sendError(rw, 429, "A verification email was sent recently.")
+		return
+	}
+
+	err := StartEmailVerification(db, user)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sendData(rw, http.StatusAccepted, "")
+}
+
+// the server can be configured to keep users from posting until they verify their email address
+func CanPost(user *User) bool {
+	return user.IsValidEmail || !cfg.Policy.RequireValidEmail
+}
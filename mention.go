@@ -0,0 +1,294 @@
+package main
+
+import (
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// an @-mention of handle!host, which appears in the note text as @<Position>
+type Mention struct {
+	NoteId int64
+	Position int64
+	Handle string
+	Host string
+	// true once we know the mentioned user exists and allows the author to mention them
+	Resolved bool
+}
+
+func (m *Mention) Address() *Address {
+	return &Address{Handle: m.Handle, Host: m.Host}
+}
+
+// the original text of the mention
+func (m *Mention) Text() string {
+	return "@" + m.Handle + "!" + m.Host
+}
+
+func (m *Mention) Placeholder() string {
+	return fmt.Sprintf("@%d", m.Position)
+}
+
+func (m *Mention) AsMap() map[string]interface{} {
+	return map[string]interface{}{
+		"Position": m.Position,
+		"Address": m.Address().String(),
+		"Resolved": m.Resolved,
+	}
+}
+
+var mentionrx = regexp.MustCompile("@([_0-9A-Za-z]{1,16})!((?:(?:(?:[a-zA-Z0-9][-a-zA-Z0-9]*)?[a-zA-Z0-9])[.])*(?:[a-zA-Z][-a-zA-Z0-9]*[a-zA-Z0-9]|[a-zA-Z]))")
+var mentionPlaceholderrx = regexp.MustCompile("@(\\d+)")
+
+// replace @mentions in the text with @<number>
+// the numbers start above the highest @<number> already in the text,
+// so clients can substitute mentions for the highest @<numbers> in reverse order
+func parseMentions(text string) (string, []Mention) {
+	mentions := []Mention{}
+	if !mentionrx.MatchString(text) {
+		return text, mentions
+	}
+
+	next := 0
+	for _, p := range mentionPlaceholderrx.FindAllStringSubmatch(text, -1) {
+		n, _ := strconv.Atoi(p[1])
+		if n >= next {
+			next = n + 1
+		}
+	}
+
+	text = mentionrx.ReplaceAllStringFunc(text, func(s string) string {
+		sub := mentionrx.FindStringSubmatch(s)
+		m := Mention{Position: int64(next), Handle: sub[1], Host: sub[2]}
+		next++
+		mentions = append(mentions, m)
+		return m.Placeholder()
+	})
+	return text, mentions
+}
+
+// the text with the mentions that spell is true for written out in full, which is what counts against the length limit
+func expandMentions(text string, mentions []Mention, spell func(m *Mention) bool) string {
+	byPosition := map[string]*Mention{}
+	for i := range mentions {
+		byPosition[strconv.FormatInt(mentions[i].Position, 10)] = &mentions[i]
+	}
+	return mentionPlaceholderrx.ReplaceAllStringFunc(text, func(s string) string {
+		m, ok := byPosition[s[1:]]
+		if !ok || !spell(m) {
+			return s
+		}
+		return m.Text()
+	})
+}
+
+func isUnresolved(m *Mention) bool {
+	return !m.Resolved
+}
+
+// resolve the mentions of users of this host right away, since that doesn't need another host,
+// and leave the note pending only if it mentions users of other hosts
+// returns false if the mentions that didn't resolve make the note too long
+// until ProcessMentions hears otherwise, mentions of users of other hosts count as resolved
+func ResolveLocalMentions(db *sqlx.DB, note *Note, author *Address) (bool, error) {
+	note.Pending = false
+	for i := range note.Mentions {
+		m := &note.Mentions[i]
+		if !m.Address().IsLocal() {
+			note.Pending = true
+			continue
+		}
+		allowed, err := CanMention(db, author, m.Address())
+		if err != nil {
+			return false, err
+		}
+		m.Resolved = allowed
+	}
+	text := expandMentions(note.Text, note.Mentions, func(m *Mention) bool {
+		return !m.Resolved && m.Address().IsLocal()
+	})
+	return len(text) <= 140, nil
+}
+
+// write out the mentions that didn't resolve and cut the text to 140 characters,
+// for when mentions of other hosts turn out not to resolve after the note was accepted
+// returns the new text and the mentions that are left in it
+func fitUnresolvedMentions(text string, mentions []Mention) (string, []Mention) {
+	text = expandMentions(text, mentions, isUnresolved)
+	if len(text) > 140 {
+		cut := 140
+		for cut > 0 && !utf8.RuneStart(text[cut]) {
+			cut--
+		}
+		// don't leave half a word or placeholder
+		if space := strings.LastIndex(text[:cut + 1], " "); space > 0 {
+			cut = space
+		}
+		text = strings.TrimRight(text[:cut], " ")
+	}
+
+	left := map[string]bool{}
+	for _, p := range mentionPlaceholderrx.FindAllStringSubmatch(text, -1) {
+		left[p[1]] = true
+	}
+	kept := []Mention{}
+	for _, m := range mentions {
+		if m.Resolved && left[strconv.FormatInt(m.Position, 10)] {
+			kept = append(kept, m)
+		}
+	}
+	return text, kept
+}
+
+// a mentioned user must exist, must not have moved away and must not have blocked the author
+// from a blocked author's point of view, the mentioned user does not exist
+func CanMention(db *sqlx.DB, author *Address, target *Address) (bool, error) {
+	if target.IsLocal() {
+		user, err := FetchUserByHandle(db, target.Handle)
+		if err != nil || user == nil || len(user.MovedTo) > 0 {
+			return false, err
+		}
+		blocked, err := IsBlocking(db, user.UserId, author)
+		if err != nil {
+			return false, err
+		}
+		return !blocked, nil
+	}
+
+	// for now all we can check about a remote user is that their host runs IMP
+	host, err := FetchHost(db, target.Host)
+	if err != nil {
+		return false, err
+	}
+	err = LocateHost(db, host)
+	if err != nil {
+		log.Println(err)
+		return false, nil
+	}
+	return true, nil
+}
+
+// check the via form value and fill in the note's via fields
+// returns an HTTP status and message if the author may not mention that user
+// first call r.ParseForm()
+func setVia(db *sqlx.DB, r *http.Request, note *Note, author *Address) (int, string) {
+	via := r.PostFormValue("via")
+	if len(via) == 0 {
+		return 0, ""
+	}
+	address, err := ParseAddress(strings.TrimPrefix(via, "@"))
+	if err != nil {
+		return http.StatusBadRequest, err.Error()
+	}
+
+	allowed, err := CanMention(db, author, address)
+	if err != nil {
+		fmt.Println(err)
+		return http.StatusInternalServerError, err.Error()
+	}
+	if !allowed {
+		// a user who blocked the author doesn't exist as far as the author knows
+		return http.StatusBadRequest, "There is no user with that address."
+	}
+
+	note.ViaHandle = address.Handle
+	note.ViaHost = address.Host
+	return 0, ""
+}
+
+func InsertMentions(db *sqlx.DB, note *Note) error {
+	for i := range note.Mentions {
+		note.Mentions[i].NoteId = note.NoteId
+		_, err := db.NamedExec("INSERT INTO `Mention` (`NoteId`, `Position`, `Handle`, `Host`, `Resolved`) " +
+			"VALUES (:NoteId, :Position, :Handle, :Host, :Resolved)", &note.Mentions[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func DeleteMentions(db *sqlx.DB, noteId int64) error {
+	_, err := db.Exec("DELETE FROM `Mention` WHERE NoteId = ?", noteId)
+	return err
+}
+
+// fill in the Mentions of each note
+func AttachMentions(db *sqlx.DB, notes []Note) error {
+	if len(notes) == 0 {
+		return nil
+	}
+
+	ids := []int64{}
+	byId := map[int64]*Note{}
+	for i := range notes {
+		notes[i].Mentions = []Mention{}
+		ids = append(ids, notes[i].NoteId)
+		byId[notes[i].NoteId] = &notes[i]
+	}
+
+	query, args, err := sqlx.In("SELECT * FROM `Mention` WHERE NoteId IN (?) ORDER BY Position", ids)
+	if err != nil {
+		return err
+	}
+	mentions := []Mention{}
+	err = db.Select(&mentions, query, args...)
+	if err != nil {
+		return err
+	}
+	for _, m := range mentions {
+		note := byId[m.NoteId]
+		note.Mentions = append(note.Mentions, m)
+	}
+	return nil
+}
+
+// resolve the note's mentions of users of other hosts, see ResolveLocalMentions
+// once done, the note is no longer pending
+// mentions that don't resolve are left for clients to show as written, unless that makes the note too long,
+// in which case they are written out and the note is cut to fit
+func ProcessMentions(db *sqlx.DB, note *Note, author *Address) {
+	for i := range note.Mentions {
+		m := &note.Mentions[i]
+		if m.Address().IsLocal() {
+			continue
+		}
+		allowed, err := CanMention(db, author, m.Address())
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		m.Resolved = allowed
+
+		_, err = db.NamedExec("UPDATE `Mention` SET Resolved = :Resolved WHERE NoteId = :NoteId AND Position = :Position", m)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	if len(expandMentions(note.Text, note.Mentions, isUnresolved)) > 140 {
+		log.Println("Note", note.NoteId, "is too long with its unresolved mentions, cutting it to fit.")
+		note.Text, note.Mentions = fitUnresolvedMentions(note.Text, note.Mentions)
+		_, err := db.Exec("UPDATE `Note` SET Text = ? WHERE NoteId = ?", note.Text, note.NoteId)
+		if err == nil {
+			err = DeleteMentions(db, note.NoteId)
+		}
+		if err == nil {
+			err = InsertMentions(db, note)
+		}
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	note.Pending = false
+	_, err := db.Exec("UPDATE `Note` SET Pending = 0 WHERE NoteId = ?", note.NoteId)
+	if err != nil {
+		log.Println(err)
+	}
+}
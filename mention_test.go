@@ -0,0 +1,209 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMentions(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+		mentions []Mention
+	}{
+		{"no mentions here", "no mentions here", []Mention{}},
+		{"email bob@example.com", "email bob@example.com", []Mention{}},
+		{"@bob without a host", "@bob without a host", []Mention{}},
+		{"hi @bob!example.com", "hi @0",
+			[]Mention{{Position: 0, Handle: "bob", Host: "example.com"}}},
+		{"@bob!a.com and @alice!b.com", "@0 and @1",
+			[]Mention{{Position: 0, Handle: "bob", Host: "a.com"}, {Position: 1, Handle: "alice", Host: "b.com"}}},
+		// numbering starts above placeholders already in the text
+		{"@3 says hi to @bob!example.com", "@3 says hi to @4",
+			[]Mention{{Position: 4, Handle: "bob", Host: "example.com"}}},
+		{"@bob!example.com @10 @2", "@11 @10 @2",
+			[]Mention{{Position: 11, Handle: "bob", Host: "example.com"}}},
+		// trailing punctuation isn't part of the host
+		{"thanks @bob!example.com.", "thanks @0.",
+			[]Mention{{Position: 0, Handle: "bob", Host: "example.com"}}},
+		{"(@bob!example.com)", "(@0)",
+			[]Mention{{Position: 0, Handle: "bob", Host: "example.com"}}},
+		// handles are at most 16 characters, so the rest isn't a mention
+		{"@abcdefghijklmnopq!example.com", "@abcdefghijklmnopq!example.com", []Mention{}},
+		{"@bob!example.com @bob!example.com", "@0 @1",
+			[]Mention{{Position: 0, Handle: "bob", Host: "example.com"}, {Position: 1, Handle: "bob", Host: "example.com"}}},
+	}
+	for _, test := range tests {
+		text, mentions := parseMentions(test.text)
+		if text != test.want {
+			t.Errorf("parseMentions(%q) text = %q, want %q", test.text, text, test.want)
+		}
+		if !reflect.DeepEqual(mentions, test.mentions) {
+			t.Errorf("parseMentions(%q) mentions = %+v, want %+v", test.text, mentions, test.mentions)
+		}
+	}
+}
+
+func TestProcessMentionsResolvesLocalMentions(t *testing.T) {
+	tdb := openTestDB(t)
+	author := insertTestUser(t, tdb, "author")
+	insertTestUser(t, tdb, "alice")
+	bob := insertTestUser(t, tdb, "bob")
+	tdb.MustExec("INSERT INTO `Block` (`UserId`, `Handle`, `Host`) VALUES (?, 'author', ?)", bob, testHost)
+
+	note := parseNote("hi @alice!imp.test, @ghost!imp.test and @bob!imp.test")
+	if note == nil {
+		t.Fatal("parseNote failed")
+	}
+	note.UserId = author
+	result := tdb.MustExec("INSERT INTO `Note` (`UserId`, `Text`, `GroupId`, `Pending`) VALUES (?, ?, 0, 1)", author, note.Text)
+	note.NoteId, _ = result.LastInsertId()
+	err := InsertMentions(tdb, note)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ProcessMentions(tdb, note, LocalAddress("author"))
+
+	mentions := []Mention{}
+	err = tdb.Select(&mentions, "SELECT * FROM `Mention` WHERE NoteId = ? ORDER BY Position", note.NoteId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// users who don't exist or who block the author can't be mentioned
+	want := map[string]bool{"alice": true, "ghost": false, "bob": false}
+	if len(mentions) != len(want) {
+		t.Fatalf("got %d mentions, want %d", len(mentions), len(want))
+	}
+	for _, m := range mentions {
+		if m.Resolved != want[m.Handle] {
+			t.Errorf("mention of %s resolved = %v, want %v", m.Handle, m.Resolved, want[m.Handle])
+		}
+	}
+
+	var pending bool
+	err = tdb.Get(&pending, "SELECT Pending FROM `Note` WHERE NoteId = ?", note.NoteId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending {
+		t.Error("the note is still pending after its mentions were processed")
+	}
+}
+
+func TestExpandMentions(t *testing.T) {
+	mentions := []Mention{
+		{Position: 1, Handle: "bob", Host: "a.example", Resolved: true},
+		{Position: 10, Handle: "carol", Host: "b.example"},
+	}
+	// @1 mustn't be mistaken for the start of @10, and @3 isn't a mention at all
+	got := expandMentions("@1 @10 @3", mentions, isUnresolved)
+	if want := "@1 @carol!b.example @3"; got != want {
+		t.Errorf("expandMentions = %q, want %q", got, want)
+	}
+}
+
+func TestFitUnresolvedMentions(t *testing.T) {
+	mentions := []Mention{
+		{Position: 0, Handle: "bob", Host: "a.example", Resolved: true},
+		{Position: 1, Handle: "nobody_number_01", Host: "b.example"},
+		{Position: 2, Handle: "alice", Host: "a.example", Resolved: true},
+	}
+	text := "@0 " + strings.Repeat("word ", 22) + "@1 and @2"
+	if len(text) > 140 || len(expandMentions(text, mentions, isUnresolved)) <= 140 {
+		t.Fatal("the test text should only be too long with the mention written out")
+	}
+
+	fitted, kept := fitUnresolvedMentions(text, mentions)
+	if len(fitted) > 140 {
+		t.Errorf("fitted text is %d characters", len(fitted))
+	}
+	if !strings.HasPrefix(fitted, "@0 word") || !strings.Contains(fitted, "@nobody_number_01!b.example") {
+		t.Errorf("fitted text = %q, want the start kept and the unresolved mention written out", fitted)
+	}
+	if strings.HasSuffix(fitted, " ") || strings.Contains(fitted, "@2") {
+		t.Errorf("fitted text = %q, want it cut between words before @2", fitted)
+	}
+	// the unresolved mention is text now, and @2 was cut off
+	if len(kept) != 1 || kept[0].Position != 0 {
+		t.Errorf("kept mentions %+v, want only @0", kept)
+	}
+
+	short := "hi @1"
+	fitted, kept = fitUnresolvedMentions(short, mentions)
+	if fitted != "hi @nobody_number_01!b.example" || len(kept) != 0 {
+		t.Errorf("fitUnresolvedMentions(%q) = %q, %+v", short, fitted, kept)
+	}
+}
+
+func TestUnresolvedLocalMentionsCountInFull(t *testing.T) {
+	tdb := openTestDB(t)
+	author := insertTestUser(t, tdb, "author")
+	insertTestUser(t, tdb, "alice")
+	authorization := testAuthorization(t, tdb, author)
+
+	// short as placeholders, but made-up users can't be mentioned, so they count in full
+	madeUp := strings.Repeat("@nobody_number_01!imp.test ", 6)
+	rw := testFormRequest(PostNoteHandler, "POST", "/note", url.Values{"note": {madeUp}}, authorization)
+	if rw.Code != 400 {
+		t.Errorf("posting %q: status %d, want 400", madeUp, rw.Code)
+	}
+	var count int
+	tdb.Get(&count, "SELECT COUNT(*) FROM `Note`")
+	if count != 0 {
+		t.Errorf("%d notes were saved, want none", count)
+	}
+
+	// mentions of users of this host are resolved right away, so the note isn't pending
+	real := strings.Repeat("@alice!imp.test ", 9)
+	rw = testFormRequest(PostNoteHandler, "POST", "/note", url.Values{"note": {real}}, authorization)
+	if rw.Code != 201 {
+		t.Errorf("posting %q: status %d, want 201", real, rw.Code)
+	}
+	var unresolved int
+	tdb.Get(&unresolved, "SELECT COUNT(*) FROM `Mention` WHERE Resolved = 0")
+	tdb.Get(&count, "SELECT COUNT(*) FROM `Mention`")
+	if count != 9 || unresolved != 0 {
+		t.Errorf("saved %d mentions, %d unresolved, want 9 resolved", count, unresolved)
+	}
+}
+
+func TestProcessMentionsCutsNotesThatDontFit(t *testing.T) {
+	tdb := openTestDB(t)
+	author := insertTestUser(t, tdb, "author")
+
+	// a host that couldn't be found a moment ago isn't looked for again, so its users can't be mentioned
+	tdb.MustExec("INSERT INTO `Host` (`Name`, `LocationDate`) VALUES ('gone.example', ?)", time.Now())
+
+	note := parseNote(strings.Repeat("@nobody_number_01!gone.example ", 6))
+	note.UserId = author
+	ok, err := ResolveLocalMentions(tdb, note, LocalAddress("author"))
+	if err != nil || !ok || !note.Pending {
+		t.Fatalf("ResolveLocalMentions = %v, %v with pending %v, want the note accepted while pending", ok, err, note.Pending)
+	}
+	result := tdb.MustExec("INSERT INTO `Note` (`UserId`, `Text`, `GroupId`, `Pending`) VALUES (?, ?, 0, 1)", author, note.Text)
+	note.NoteId, _ = result.LastInsertId()
+	err = InsertMentions(tdb, note)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ProcessMentions(tdb, note, LocalAddress("author"))
+
+	saved := Note{}
+	err = tdb.Get(&saved, "SELECT * FROM `Note` WHERE NoteId = ?", note.NoteId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Pending || len(saved.Text) > 140 || !strings.HasPrefix(saved.Text, "@nobody_number_01!gone.example") {
+		t.Errorf("saved note %q, pending %v, want it written out, cut to fit and no longer pending", saved.Text, saved.Pending)
+	}
+	var count int
+	tdb.Get(&count, "SELECT COUNT(*) FROM `Mention` WHERE NoteId = ?", note.NoteId)
+	if count != 0 {
+		t.Errorf("%d mentions left, want none", count)
+	}
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const MaximumConversationMembers = 50
+
+// A conversation is between a fixed set of addresses, which may be on any host.
+// Each host keeps its own copy of the conversation for its users, and MemberKey identifies it across hosts.
+type Conversation struct {
+	ConversationId int64
+	MemberKey string
+	CreatedDate mysql.NullTime
+}
+
+type ConversationMember struct {
+	ConversationId int64
+	Handle string
+	Host string
+}
+
+type Message struct {
+	MessageId int64
+	ConversationId int64
+	// the sender
+	Handle string
+	Host string
+	Text string
+	Link sql.NullString
+	Date mysql.NullTime
+}
+
+func (m *Message) AsMap() map[string]interface{} {
+	mm := map[string]interface{}{
+		"MessageId": m.MessageId,
+		"ConversationId": m.ConversationId,
+		"From": m.Handle + "!" + m.Host,
+		"Text": m.Text,
+		"Date": m.Date.Time.Unix(),
+	}
+	if m.Link.Valid {
+		mm["Link"] = m.Link.String
+	}
+	return mm
+}
+
+// messages follow the same length and link rules as notes, but have no mentions
+func parseMessage(text string) *Message {
+	m := new(Message)
+	m.Text, m.Link = shortenLink(text)
+	if len(m.Text) > 140 || len(m.Text) == 0 {
+		return nil
+	}
+	return m
+}
+
+// the same for every host, no matter what order or case the addresses are in
+func conversationMemberKey(members []*Address) string {
+	addresses := []string{}
+	for _, a := range members {
+		addresses = append(addresses, strings.ToLower(a.String()))
+	}
+	sort.Strings(addresses)
+	sum := sha256.Sum256([]byte(strings.Join(addresses, " ")))
+	return hex.EncodeToString(sum[:])
+}
+
+// send a message from a local user, or accept one from a guest whose host is delivering it
+func PostMessageHandler(rw http.ResponseWriter, r *http.Request) {
+	sender, err := FetchPrincipal(db, r)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if sender == nil {
+		sendError(rw, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	r.ParseForm()
+	messageText := r.PostFormValue("message")
+	message := parseMessage(messageText)
+	if message == nil {
+		sendError(rw, http.StatusBadRequest, "Messages must be 1 to 140 characters.")
+		return
+	}
+
+	// the sender is always a member, "to" lists everyone else
+	members := []*Address{sender.Address}
+	seen := map[string]bool{strings.ToLower(sender.Address.String()): true}
+	for _, to := range strings.Split(r.PostFormValue("to"), ",") {
+		address, err := ParseAddress(strings.TrimSpace(to))
+		if err != nil {
+			sendError(rw, http.StatusBadRequest, err.Error())
+			return
+		}
+		key := strings.ToLower(address.String())
+		if !seen[key] {
+			seen[key] = true
+			members = append(members, address)
+		}
+	}
+	if len(members) < 2 {
+		sendError(rw, http.StatusBadRequest, "Missing recipient.")
+		return
+	}
+	if len(members) > MaximumConversationMembers {
+		sendError(rw, http.StatusBadRequest, "Too many recipients.")
+		return
+	}
+
+	// local recipients who blocked the sender don't exist as far as the sender knows
+	// but a guest's host delivers to all of our users in the conversation at once, so one of them
+	// blocking the sender mustn't keep the message from the others, it's just hidden from them, see GetConversationHandler
+	localRecipients := 0
+	for _, member := range members[1:] {
+		if !member.IsLocal() {
+			continue
+		}
+		recipient, err := FetchUserByHandle(db, member.Handle)
+		if err != nil {
+			fmt.Println(err)
+			sendError(rw, http.StatusInternalServerError, err.Error())
+			return
+		}
+		blocked := false
+		if recipient != nil {
+			blocked, err = IsBlocking(db, recipient.UserId, sender.Address)
+			if err != nil {
+				fmt.Println(err)
+				sendError(rw, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+		if recipient == nil || len(recipient.MovedTo) > 0 || (blocked && !sender.IsGuest()) {
+			sendError(rw, http.StatusNotFound, "There is no user with the address " + member.String() + ".")
+			return
+		}
+		localRecipients++
+	}
+	// a guest's host only delivers to us if some of our users are in the conversation
+	if sender.IsGuest() && localRecipients == 0 {
+		sendError(rw, http.StatusBadRequest, "None of the recipients are on this host.")
+		return
+	}
+
+	conversation, err := FetchConversation(db, members)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	message.ConversationId = conversation.ConversationId
+	message.Handle = sender.Address.Handle
+	message.Host = sender.Address.Host
+	result, err := db.NamedExec("INSERT INTO `Message` (`ConversationId`, `Handle`, `Host`, `Text`, `Link`) " +
+		"VALUES (:ConversationId, :Handle, :Host, :Text, :Link)", message)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	message.MessageId, err = result.LastInsertId()
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	sendData(rw, http.StatusCreated, message.AsMap())
+
+	if !sender.IsGuest() {
+		user, err := FetchUser(db, sender.UserId())
+		if err != nil || user == nil {
+			log.Println(err)
+			return
+		}
+		DeliverMessage(db, user, members, messageText)
+	}
+}
+
+// pass a local user's message on to the other hosts in the conversation, as the user's guest
+// each host gets one delivery for all of its users, and leaves out the ones who blocked the sender
+func DeliverMessage(db *sqlx.DB, sender *User, members []*Address, text string) {
+	to := []string{}
+	hosts := map[string]bool{}
+	for _, member := range members[1:] {
+		to = append(to, member.String())
+		if !member.IsLocal() {
+			hosts[strings.ToLower(member.Host)] = true
+		}
+	}
+
+	for hostname := range hosts {
+		job := &FederationJob{UserId: sender.UserId, Kind: JobMessage, Host: hostname, Method: "POST", Path: "/message", AsGuest: true}
+		err := EnqueueFederationJob(db, job, url.Values{"to": {strings.Join(to, ",")}, "message": {text}})
+		if err != nil {
+			log.Println("Could not deliver message to", hostname, err)
+		}
+	}
+}
+
+// find the conversation among the members, or start it
+func FetchConversation(db *sqlx.DB, members []*Address) (*Conversation, error) {
+	conversation := new(Conversation)
+	conversation.MemberKey = conversationMemberKey(members)
+
+	err := db.Get(conversation, "SELECT * FROM Conversation WHERE MemberKey = ?", conversation.MemberKey)
+	if err == nil {
+		return conversation, nil
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	result, err := db.NamedExec("INSERT INTO `Conversation` (`MemberKey`) VALUES (:MemberKey)", conversation)
+	if err != nil {
+		return nil, err
+	}
+	conversation.ConversationId, err = result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	for _, member := range members {
+		_, err = db.Exec("INSERT INTO `ConversationMember` (`ConversationId`, `Handle`, `Host`) VALUES (?, ?, ?)",
+			conversation.ConversationId, member.Handle, member.Host)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return conversation, nil
+}
+
+// the authenticated user's conversations and who is in them
+func ListConversationsHandler(rw http.ResponseWriter, r *http.Request) {
+	user, ok := messageUserFromRequest(rw, r)
+	if !ok {
+		return
+	}
+
+	members := []ConversationMember{}
+	err := db.Select(&members, "SELECT Others.* FROM ConversationMember AS Me " +
+		"JOIN ConversationMember AS Others ON Me.ConversationId = Others.ConversationId " +
+		"WHERE Me.Handle = ? AND Me.Host = ? ORDER BY Others.ConversationId DESC", user.Handle, cfg.Api.Host)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	conversations := []interface{}{}
+	var current map[string]interface{}
+	for _, m := range members {
+		if current == nil || current["ConversationId"] != m.ConversationId {
+			current = map[string]interface{}{
+				"ConversationId": m.ConversationId,
+				"Members": []string{},
+			}
+			conversations = append(conversations, current)
+		}
+		current["Members"] = append(current["Members"].([]string), m.Handle + "!" + m.Host)
+	}
+	sendData(rw, http.StatusOK, conversations)
+}
+
+// messages in the conversation, newest first, except those from senders the user has muted or blocked
+func GetConversationHandler(rw http.ResponseWriter, r *http.Request) {
+	user, ok := messageUserFromRequest(rw, r)
+	if !ok {
+		return
+	}
+
+	conversationId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		sendError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+	member, err := isConversationMember(int64(conversationId), user)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !member {
+		sendError(rw, http.StatusNotFound, "There is no conversation with that ID.")
+		return
+	}
+
+	r.ParseForm()
+	where := " WHERE ConversationId = ?" +
+		" AND NOT EXISTS (SELECT * FROM Mute WHERE Mute.UserId = ? AND (Mute.Handle = Message.Handle OR Mute.Handle = '*') AND Mute.Host = Message.Host)" +
+		" AND NOT EXISTS (SELECT * FROM Block WHERE Block.UserId = ? AND (Block.Handle = Message.Handle OR Block.Handle = '*') AND Block.Host = Message.Host)"
+	sinceId := validIntFormValue(r, "since_id", 0)
+	if sinceId > 0 {
+		where += " AND MessageId > " + strconv.Itoa(sinceId)
+	}
+	beforeId := validIntFormValue(r, "before_id", 0)
+	if beforeId > 0 {
+		where += " AND MessageId < " + strconv.Itoa(beforeId)
+	}
+	count := validIntFormValue(r, "count", MaximumNotesReturned)
+	if count > MaximumNotesReturned || count <= 0 {
+		count = MaximumNotesReturned
+	}
+
+	messages := []Message{}
+	err = db.Select(&messages, "SELECT * FROM Message" + where + " ORDER BY MessageId DESC LIMIT " + strconv.Itoa(count),
+		conversationId, user.UserId, user.UserId)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	list := []interface{}{}
+	for _, m := range messages {
+		list = append(list, m.AsMap())
+	}
+	sendData(rw, http.StatusOK, list)
+}
+
+// senders can delete their messages from this host
+// only this host's copy is deleted, since each host keeps its own copy of the conversation,
+// and there's no way to tell another host which of its messages this one was
+func DeleteMessageHandler(rw http.ResponseWriter, r *http.Request) {
+	user, ok := messageUserFromRequest(rw, r)
+	if !ok {
+		return
+	}
+
+	messageId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		sendError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	message := new(Message)
+	err = db.Get(message, "SELECT * FROM Message WHERE MessageId = ?", messageId)
+	if err == sql.ErrNoRows {
+		sendError(rw, http.StatusNotFound, "There is no message with that ID.")
+		return
+	} else if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !strings.EqualFold(message.Handle, user.Handle) || !strings.EqualFold(message.Host, cfg.Api.Host) {
+		member, err := isConversationMember(message.ConversationId, user)
+		if err != nil {
+			fmt.Println(err)
+			sendError(rw, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !member {
+			sendError(rw, http.StatusNotFound, "There is no message with that ID.")
+			return
+		}
+		sendError(rw, http.StatusUnauthorized, "Only the message's sender may delete it.")
+		return
+	}
+
+	_, err = db.Exec("DELETE FROM `Message` WHERE MessageId = ?", messageId)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sendData(rw, http.StatusNoContent, "")
+}
+
+// only local users read and manage their conversations here, guests read theirs on their own host
+func messageUserFromRequest(rw http.ResponseWriter, r *http.Request) (*User, bool) {
+	token, err := FetchToken(db, r)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return nil, false
+	}
+	if token == nil {
+		sendError(rw, http.StatusUnauthorized, "Unauthorized")
+		return nil, false
+	}
+	user, err := FetchUser(db, token.UserId)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return nil, false
+	}
+	if user == nil {
+		sendError(rw, http.StatusUnauthorized, "Unauthorized")
+		return nil, false
+	}
+	return user, true
+}
+
+func isConversationMember(conversationId int64, user *User) (bool, error) {
+	var count int64
+	err := db.Get(&count, "SELECT COUNT(*) FROM ConversationMember WHERE ConversationId = ? AND Handle = ? AND Host = ?",
+		conversationId, user.Handle, cfg.Api.Host)
+	return count > 0, err
+}
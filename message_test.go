@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// the messages in the conversation as the user sees them
+func conversationMessages(t *testing.T, authorization string, conversationId int64) []map[string]interface{} {
+	r := httptest.NewRequest("GET", "/conversation/" + strconv.FormatInt(conversationId, 10), nil)
+	r.Header.Set("Authorization", authorization)
+	r = mux.SetURLVars(r, map[string]string{"id": strconv.FormatInt(conversationId, 10)})
+	rw := httptest.NewRecorder()
+	GetConversationHandler(rw, r)
+	if rw.Code != 200 {
+		t.Fatalf("status %d reading conversation %d", rw.Code, conversationId)
+	}
+	envelope := struct {
+		Data []map[string]interface{} `json:"data"`
+	}{}
+	err := json.Unmarshal(rw.Body.Bytes(), &envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return envelope.Data
+}
+
+func TestBlockingRecipientsDontStopDelivery(t *testing.T) {
+	tdb := openTestDB(t)
+	alice := insertTestUser(t, tdb, "alice")
+	carol := insertTestUser(t, tdb, "carol")
+	bob := insertTestUser(t, tdb, "bob")
+	tdb.MustExec("INSERT INTO `Block` (`UserId`, `Handle`, `Host`) VALUES (?, 'dave', 'b.example'), (?, 'bob', ?)", alice, alice, testHost)
+
+	// dave!b.example is a guest here
+	result := tdb.MustExec("INSERT INTO `Host` (`Name`) VALUES ('b.example')")
+	hostId, _ := result.LastInsertId()
+	guestToken := RandomString(50)
+	tdb.MustExec("INSERT INTO `Guest` (`Handle`, `HostId`, `TokenPrefix`, `TokenHash`, `CreatedDate`) VALUES ('dave', ?, ?, ?, ?)",
+		hostId, TokenPrefix(guestToken), TokenHash(guestToken), time.Now())
+
+	to := url.Values{"to": {"alice!" + testHost + ",carol!" + testHost}, "message": {"hello"}}
+	rw := testFormRequest(PostMessageHandler, "POST", "/message", to, GuestAuthPrefix + guestToken)
+	if rw.Code != 201 {
+		t.Fatalf("status %d delivering dave's message, want 201", rw.Code)
+	}
+	var conversationId int64
+	err := tdb.Get(&conversationId, "SELECT ConversationId FROM Message WHERE Handle = 'dave'")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if messages := conversationMessages(t, testAuthorization(t, tdb, carol), conversationId); len(messages) != 1 {
+		t.Errorf("carol sees %d messages, want dave's", len(messages))
+	}
+	if messages := conversationMessages(t, testAuthorization(t, tdb, alice), conversationId); len(messages) != 0 {
+		t.Errorf("alice sees %d messages, but she blocked dave", len(messages))
+	}
+
+	// a local sender learns no more than that alice doesn't exist
+	to = url.Values{"to": {"alice!" + testHost + ",carol!" + testHost}, "message": {"hello"}}
+	rw = testFormRequest(PostMessageHandler, "POST", "/message", to, testAuthorization(t, tdb, bob))
+	if rw.Code != 404 {
+		t.Errorf("status %d sending bob's message, want 404", rw.Code)
+	}
+
+	// nor does a guest, if there's no such user
+	to = url.Values{"to": {"nobody!" + testHost + ",carol!" + testHost}, "message": {"hello"}}
+	rw = testFormRequest(PostMessageHandler, "POST", "/message", to, GuestAuthPrefix + guestToken)
+	if rw.Code != 404 {
+		t.Errorf("status %d delivering to a user who doesn't exist, want 404", rw.Code)
+	}
+}
@@ -0,0 +1,14 @@
+--
+-- Upgrade a database that was migrated to hashed tokens before token prefixes and guest nonces
+-- were compared case-sensitively.
+--
+-- Under the default latin1_swedish_ci collation, a nonce or token prefix matches others that differ
+-- only in case, which makes them easier to guess. The server can keep running while this runs.
+--
+
+ALTER TABLE `UserToken`
+ MODIFY `TokenPrefix` char(8) COLLATE latin1_bin NOT NULL;
+ALTER TABLE `Guest`
+ MODIFY `TokenPrefix` char(8) COLLATE latin1_bin NOT NULL;
+ALTER TABLE `UserHost`
+ MODIFY `Nonce` varchar(50) COLLATE latin1_bin NOT NULL;
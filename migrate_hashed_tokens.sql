@@ -0,0 +1,38 @@
+--
+-- Upgrade a database with plaintext auth tokens to hashed tokens.
+--
+-- Stop the server, and set tokenkey in the [server] section of config.gcfg first.
+-- If UserToken has no TokenId column yet, run migrate_sessions.sql before this.
+-- Then run step 1, run the new server binary with the rehash-tokens command:
+--
+--     imp rehash-tokens
+--
+-- and run step 2 before starting the server again.
+--
+-- To log everyone out instead of keeping their tokens, skip rehash-tokens and run
+-- DELETE FROM `UserToken`; DELETE FROM `Guest`; UPDATE `UserHost` SET `Token` = '';
+-- between the two steps. Users of other hosts will get new guest tokens the next time they are needed.
+--
+
+--
+-- Step 1: add the hashed token columns next to the plaintext ones
+--
+ALTER TABLE `UserToken`
+ ADD `TokenPrefix` char(8) COLLATE latin1_bin NOT NULL DEFAULT '' AFTER `Token`,
+ ADD `TokenHash` char(64) NOT NULL DEFAULT '' AFTER `TokenPrefix`;
+ALTER TABLE `Guest`
+ ADD `TokenPrefix` char(8) COLLATE latin1_bin NOT NULL DEFAULT '' AFTER `Token`,
+ ADD `TokenHash` char(64) NOT NULL DEFAULT '' AFTER `TokenPrefix`;
+ALTER TABLE `UserHost`
+ MODIFY `Token` varchar(512) NOT NULL,
+ MODIFY `Nonce` varchar(50) COLLATE latin1_bin NOT NULL;
+
+--
+-- Step 2: drop the plaintext tokens
+--
+ALTER TABLE `UserToken`
+ DROP INDEX `Token`, DROP `Token`,
+ ADD UNIQUE KEY `TokenHash` (`TokenHash`), ADD KEY `TokenPrefix` (`TokenPrefix`);
+ALTER TABLE `Guest`
+ DROP INDEX `Token`, DROP `Token`,
+ ADD UNIQUE KEY `TokenHash` (`TokenHash`), ADD KEY `TokenPrefix` (`TokenPrefix`);
@@ -0,0 +1,16 @@
+--
+-- Upgrade a database whose UserToken table is keyed by the token, to the session schema.
+--
+-- Stop the server, run this, and start the new server binary. Existing logins are kept.
+-- Their times only had dates, so they become midnight of those dates.
+-- Run this before migrate_hashed_tokens.sql, which expects the table as it is left here.
+--
+
+ALTER TABLE `UserToken`
+ DROP PRIMARY KEY,
+ ADD `TokenId` int(11) NOT NULL AUTO_INCREMENT PRIMARY KEY FIRST,
+ MODIFY `LoginTime` datetime NOT NULL,
+ MODIFY `LastSeenTime` datetime NOT NULL,
+ ADD `IP` varchar(45) NOT NULL DEFAULT '' AFTER `LastSeenTime`,
+ ADD `UserAgent` varchar(255) NOT NULL DEFAULT '' AFTER `IP`,
+ ADD UNIQUE KEY `Token` (`Token`), ADD KEY `UserId` (`UserId`);
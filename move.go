@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/crypto/bcrypt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// A user who moves to another host leaves a pointer to their new address behind.
+// Hosts whose users may follow them are told about the move, check it with this host,
+// and switch their users' follows to the new address.
+
+const IMPMovedToHeader = "IMP-Moved-To"
+
+// answer a request about a user who has moved with a pointer to their new address
+func sendMoved(rw http.ResponseWriter, user *User) {
+	rw.Header().Set(IMPMovedToHeader, user.MovedTo)
+	sendError(rw, http.StatusMovedPermanently, "This user has moved to " + user.MovedTo + ".")
+}
+
+// mark the authenticated user as moved to the address in to, which must be on another host
+// takes the user's password as confirmation
+func PostMoveHandler(rw http.ResponseWriter, r *http.Request) {
+	user, ok := listOwnerFromRequest(rw, r)
+	if !ok {
+		return
+	}
+
+	r.ParseForm()
+	err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(r.PostFormValue("password")))
+	if err != nil {
+		sendError(rw, http.StatusUnauthorized, "The password is incorrect.")
+		return
+	}
+
+	to, err := ParseAddress(r.PostFormValue("to"))
+	if err != nil {
+		sendError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+	if to.IsLocal() {
+		sendError(rw, http.StatusBadRequest, "You can only move to another host.")
+		return
+	}
+	allowed, err := CanMention(db, LocalAddress(user.Handle), to)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !allowed {
+		sendError(rw, http.StatusBadRequest, "There is no IMP host at " + to.Host + ".")
+		return
+	}
+
+	user.MovedTo = to.String()
+	_, err = db.NamedExec("UPDATE User SET MovedTo = :MovedTo WHERE UserId = :UserId", user)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// local followers don't need to be told
+	err = TransferFollows(db, LocalAddress(user.Handle), to)
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	sendData(rw, http.StatusOK, map[string]interface{}{
+			"MovedTo": user.MovedTo,
+		})
+
+	NotifyMove(db, user)
+}
+
+// public, so other hosts can check a move they've been told about
+func GetMovedHandler(rw http.ResponseWriter, r *http.Request) {
+	user, err := FetchUserByHandle(db, mux.Vars(r)["handle"])
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if user == nil || len(user.MovedTo) == 0 {
+		sendError(rw, http.StatusNotFound, "That user has not moved.")
+		return
+	}
+	sendData(rw, http.StatusOK, map[string]interface{}{
+			"MovedTo": user.MovedTo,
+		})
+}
+
+// called by foreign host to tell us one of its users has moved
+// we don't take its word for it, but ask the user's host at its discovered location
+func PostMovedHandler(rw http.ResponseWriter, r *http.Request) {
+	signer, ok := signedHostFromRequest(rw, r)
+	if !ok {
+		return
+	}
+	address, err := ParseAddress(r.PostFormValue("address"))
+	if err != nil {
+		sendError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+	if address.IsLocal() {
+		sendError(rw, http.StatusBadRequest, "That user is on this host.")
+		return
+	}
+	if !strings.EqualFold(address.Host, signer.Name) {
+		sendError(rw, http.StatusUnauthorized, "The request is not signed by " + address.Host + ".")
+		return
+	}
+
+	// at this point we don't know how the user's host will respond, so send 202 Accepted
+	sendData(rw, http.StatusAccepted, "")
+
+	go func() {
+		to, err := FetchMovedTo(db, address)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		err = TransferFollows(db, address, to)
+		if err != nil {
+			log.Println(err)
+		}
+	}()
+}
+
+// ask the user's host where they've moved to
+func FetchMovedTo(db *sqlx.DB, address *Address) (*Address, error) {
+	host, err := FetchHost(db, address.Host)
+	if err != nil {
+		return nil, err
+	}
+	err = LocateHost(db, host)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := GetSigned(host, "/user/" + address.Handle + "/moved")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(address.String() + " has not moved: " + resp.Status)
+	}
+
+	envelope := struct {
+		Data struct {
+			MovedTo string
+		} `json:"data"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&envelope)
+	if err != nil {
+		return nil, err
+	}
+	return ParseAddress(envelope.Data.MovedTo)
+}
+
+// switch every local follow of one address to another
+func TransferFollows(db *sqlx.DB, from *Address, to *Address) error {
+	userIds := []int64{}
+	err := db.Select(&userIds, "SELECT UserId FROM Follow WHERE Handle = ? AND Host = ?", from.Handle, from.Host)
+	if err != nil {
+		return err
+	}
+
+	for _, userId := range userIds {
+		// someone who moved to this host can't follow themselves
+		user, err := FetchUser(db, userId)
+		if err != nil {
+			return err
+		}
+		if user != nil && !(to.IsLocal() && strings.EqualFold(user.Handle, to.Handle)) {
+			_, err = db.Exec("INSERT IGNORE INTO `Follow` (`UserId`, `Handle`, `Host`, `CreatedDate`) VALUES (?, ?, ?, ?)",
+				userId, to.Handle, to.Host, time.Now())
+			if err != nil {
+				return err
+			}
+			if !to.IsLocal() {
+				err = EnsureGuestToken(db, user, to.Host)
+				if err != nil {
+					log.Println(err)
+				}
+			}
+		}
+		_, err = db.Exec("DELETE FROM `Follow` WHERE UserId = ? AND Handle = ? AND Host = ?", userId, from.Handle, from.Host)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tell the hosts that may have followers of the user that they've moved:
+// those with guests here, and those where the user is a guest
+func NotifyMove(db *sqlx.DB, user *User) {
+	hosts := []Host{}
+	err := db.Select(&hosts, "SELECT * FROM Host WHERE HostId IN (SELECT HostId FROM Guest) " +
+		"OR HostId IN (SELECT HostId FROM UserHost WHERE UserId = ?)", user.UserId)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	address := LocalAddress(user.Handle).String()
+	for _, host := range hosts {
+		job := &FederationJob{UserId: user.UserId, Kind: JobMoved, Host: host.Name, Method: "POST", Path: "/moved"}
+		err := EnqueueFederationJob(db, job, url.Values{"address": {address}})
+		if err != nil {
+			log.Println("Could not notify", host.Name, "of move:", err)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"net/http"
+	"strings"
+)
+
+// Mute and Block rows have the same shape, and Follow rows start with it
+// Handle may be * to match everyone at Host, except in Follow
+type AddressListEntry struct {
+	UserId int64
+	Handle string
+	Host string
+}
+
+func ListMutesHandler(rw http.ResponseWriter, r *http.Request) {
+	listAddressList(rw, r, "Mute")
+}
+
+func PutMuteHandler(rw http.ResponseWriter, r *http.Request) {
+	putAddressListEntry(rw, r, "Mute")
+}
+
+func DeleteMuteHandler(rw http.ResponseWriter, r *http.Request) {
+	deleteAddressListEntry(rw, r, "Mute")
+}
+
+func ListBlocksHandler(rw http.ResponseWriter, r *http.Request) {
+	listAddressList(rw, r, "Block")
+}
+
+func PutBlockHandler(rw http.ResponseWriter, r *http.Request) {
+	putAddressListEntry(rw, r, "Block")
+}
+
+func DeleteBlockHandler(rw http.ResponseWriter, r *http.Request) {
+	deleteAddressListEntry(rw, r, "Block")
+}
+
+// table is a constant from the handlers above, never user input
+func listAddressList(rw http.ResponseWriter, r *http.Request, table string) {
+	user, ok := listOwnerFromRequest(rw, r)
+	if !ok {
+		return
+	}
+
+	entries := []AddressListEntry{}
+	err := db.Select(&entries, "SELECT UserId, Handle, Host FROM `" + table + "` WHERE UserId = ?", user.UserId)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	addresses := []string{}
+	for _, e := range entries {
+		addresses = append(addresses, e.Handle + "!" + e.Host)
+	}
+	sendData(rw, http.StatusOK, addresses)
+}
+
+func putAddressListEntry(rw http.ResponseWriter, r *http.Request, table string) {
+	user, ok := listOwnerFromRequest(rw, r)
+	if !ok {
+		return
+	}
+
+	address, err := ParseAddressPattern(mux.Vars(r)["address"])
+	if err != nil {
+		sendError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+	if address.IsLocal() && (address.Handle == "*" || strings.EqualFold(address.Handle, user.Handle)) {
+		sendError(rw, http.StatusBadRequest, "You can't " + strings.ToLower(table) + " yourself.")
+		return
+	}
+
+	_, err = db.Exec("INSERT IGNORE INTO `" + table + "` (`UserId`, `Handle`, `Host`) VALUES (?, ?, ?)",
+		user.UserId, address.Handle, address.Host)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if table == "Block" {
+		// a blocked user doesn't get to keep reposting our notes
+		err = DeleteRepostsOf(db, user.UserId, address)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+	sendData(rw, http.StatusOK, address.String())
+}
+
+func deleteAddressListEntry(rw http.ResponseWriter, r *http.Request, table string) {
+	user, ok := listOwnerFromRequest(rw, r)
+	if !ok {
+		return
+	}
+
+	address, err := ParseAddressPattern(mux.Vars(r)["address"])
+	if err != nil {
+		sendError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	_, err = db.Exec("DELETE FROM `" + table + "` WHERE UserId = ? AND Handle = ? AND Host = ?",
+		user.UserId, address.Handle, address.Host)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sendData(rw, http.StatusNoContent, "")
+}
+
+// mute, block and follow lists are only visible to the authenticated user who owns them
+func listOwnerFromRequest(rw http.ResponseWriter, r *http.Request) (*User, bool) {
+	token, err := FetchToken(db, r)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return nil, false
+	}
+	if token == nil {
+		sendError(rw, http.StatusUnauthorized, "Unauthorized")
+		return nil, false
+	}
+
+	user, err := FetchUserByHandle(db, mux.Vars(r)["handle"])
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return nil, false
+	}
+	if user == nil || user.UserId != token.UserId {
+		sendError(rw, http.StatusUnauthorized, "Unauthorized")
+		return nil, false
+	}
+	return user, true
+}
+
+// true if the user has muted the address, either directly or by muting its whole host
+func IsMuting(db *sqlx.DB, userId int64, address *Address) (bool, error) {
+	return addressListMatches(db, "Mute", userId, address)
+}
+
+// true if the user has blocked the address, either directly or by blocking its whole host
+func IsBlocking(db *sqlx.DB, userId int64, address *Address) (bool, error) {
+	return addressListMatches(db, "Block", userId, address)
+}
+
+func addressListMatches(db *sqlx.DB, table string, userId int64, address *Address) (bool, error) {
+	var count int64
+	err := db.Get(&count, "SELECT COUNT(*) FROM `" + table + "` WHERE UserId = ? AND (Handle = ? OR Handle = '*') AND Host = ?",
+		userId, address.Handle, address.Host)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
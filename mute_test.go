@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+)
+
+// see whether the viewer, a local user if viewerId isn't 0 or else a guest, can see the note
+func canSee(t *testing.T, note *Note, viewerId int64, viewer *Address) bool {
+	principal := &Principal{Token: &UserToken{UserId: viewerId}, Address: viewer}
+	if viewerId == 0 {
+		principal = &Principal{Guest: &Guest{}, Address: viewer}
+	}
+	ok, err := CanSeeNote(db, note, principal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ok
+}
+
+func TestBlocksAndMutesHideNotes(t *testing.T) {
+	tdb := openTestDB(t)
+	alice := insertTestUser(t, tdb, "alice")
+	bob := insertTestUser(t, tdb, "bob")
+	carol := insertTestUser(t, tdb, "carol")
+	dave := insertTestUser(t, tdb, "dave")
+
+	tdb.MustExec("INSERT INTO `Block` (`UserId`, `Handle`, `Host`) VALUES (?, 'bob', ?)", alice, testHost)
+	tdb.MustExec("INSERT INTO `Block` (`UserId`, `Handle`, `Host`) VALUES (?, '*', 'spam.example')", alice)
+	tdb.MustExec("INSERT INTO `Mute` (`UserId`, `Handle`, `Host`) VALUES (?, 'alice', ?)", carol, testHost)
+
+	note := &Note{UserId: alice}
+	tests := []struct {
+		name string
+		viewerId int64
+		viewer *Address
+		want bool
+	}{
+		{"the author", alice, LocalAddress("alice"), true},
+		{"a blocked user", bob, LocalAddress("bob"), false},
+		{"a user who muted the author", carol, LocalAddress("carol"), false},
+		{"anyone else", dave, LocalAddress("dave"), true},
+		{"a user of a blocked host", 0, &Address{Handle: "eve", Host: "spam.example"}, false},
+		{"a user of another host", 0, &Address{Handle: "frank", Host: "other.example"}, true},
+	}
+	for _, test := range tests {
+		if got := canSee(t, note, test.viewerId, test.viewer); got != test.want {
+			t.Errorf("%s: CanSeeNote = %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	// muting only hides the author from the user who muted them, and blocking is one way
+	muted, err := IsMuting(tdb, dave, LocalAddress("alice"))
+	if err != nil || muted {
+		t.Errorf("IsMuting(dave, alice) = %v, %v, want false", muted, err)
+	}
+	blocked, err := IsBlocking(tdb, bob, LocalAddress("alice"))
+	if err != nil || blocked {
+		t.Errorf("IsBlocking(bob, alice) = %v, %v, want false", blocked, err)
+	}
+	blocked, err = IsBlocking(tdb, alice, &Address{Handle: "anyone", Host: "spam.example"})
+	if err != nil || !blocked {
+		t.Errorf("IsBlocking(alice, anyone!spam.example) = %v, %v, want true", blocked, err)
+	}
+}
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
 	"net/http"
+	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
@@ -24,6 +26,27 @@ type Note struct {
 	Edited bool
 	Deleted bool
 	GroupId int64
+	// true until the note's mentions have been processed
+	Pending bool
+	// the note this one replies to, on ReplyToHost if that isn't empty
+	ReplyToId int64
+	ReplyToHost string
+	// the first local note of the conversation, or 0 if this note is the first
+	ThreadId int64
+	// the note this one reposts, on RepostOfHost if that isn't empty, in which case RepostCopy is its JSON
+	RepostOfId int64
+	RepostOfHost string
+	RepostCopy sql.NullString
+	// the "hat tip", which doesn't count toward the length of the note
+	ViaHandle string
+	ViaHost string
+	// the address the note was posted from, if it came from an archive, in which case its date is the archive's word
+	ImportedFrom string
+	Mentions []Mention `db:"-"`
+	RepostCount int64 `db:"-"`
+	FavoriteCount int64 `db:"-"`
+	// the reposted note, if the viewer can see it
+	Original map[string]interface{} `db:"-"`
 }
 
 // TODO: use Marshaler interface
@@ -35,6 +58,40 @@ func (n *Note) AsMap() *map[string]interface{} {
 		"Date": n.Date.Time.Unix(),
 		"Edited": n.Edited,
 		"GroupId": n.GroupId,
+		"Pending": n.Pending,
+		"RepostCount": n.RepostCount,
+		"FavoriteCount": n.FavoriteCount,
+	}
+	mentions := []interface{}{}
+	for i := range n.Mentions {
+		mentions = append(mentions, n.Mentions[i].AsMap())
+	}
+	m["Mentions"] = mentions
+	if n.ReplyToId > 0 {
+		m["ReplyToId"] = n.ReplyToId
+		if len(n.ReplyToHost) > 0 {
+			m["ReplyToHost"] = n.ReplyToHost
+		}
+	}
+	if len(n.ViaHandle) > 0 {
+		m["Via"] = n.ViaHandle + "!" + n.ViaHost
+	}
+	if len(n.ImportedFrom) > 0 {
+		m["ImportedFrom"] = n.ImportedFrom
+	}
+	if n.RepostOfId > 0 {
+		repost := map[string]interface{}{
+			"NoteId": n.RepostOfId,
+			"Copy": n.RepostCopy.Valid,
+		}
+		if len(n.RepostOfHost) > 0 {
+			repost["Host"] = n.RepostOfHost
+		}
+		// missing if the original was deleted or the viewer can't see it
+		if n.Original != nil {
+			repost["Note"] = n.Original
+		}
+		m["Repost"] = repost
 	}
 	if n.Link.Valid {
 		m["Link"] = n.Link.String
@@ -45,47 +102,26 @@ func (n *Note) AsMap() *map[string]interface{} {
 	return &m
 }
 
-// interface for sorting strings by length
-type ByLength []string
-func (s ByLength) Len() int {
-    return len(s)
-}
-func (s ByLength) Swap(i, j int) {
-    s[i], s[j] = s[j], s[i]
-}
-func (s ByLength) Less(i, j int) bool {
-    return len(s[i]) < len(s[j])
-}
-
-func parseNote(text string) (note *Note) {
-	note = new(Note)
-	note.Text = text
-
-	// TODO: find @mentions
-	// atrx := MustCompile("@([[:alnum:]]{1,16})@((?:(?:(?:[a-zA-Z0-9][-a-zA-Z0-9]*)?[a-zA-Z0-9])[.])*(?:[a-zA-Z][-a-zA-Z0-9]*[a-zA-Z0-9]|[a-zA-Z]))")
-	// TODO: to be shortened, @mentions must be users that exist and are not blocking this user
-	// TODO: defer that process so we can return to the user right away and return 202 Accepted
-
-	// TODO: we will replace @mentions with @<number>
-	// TODO: find the highest @<number> that doesn't collide with existing text
-	// clients will substitute mentions for highest @<numbers> in reverse order
+// replace the longest link in the text with ‡<number>, which counts as 2 characters, and return it separately
+func shortenLink(text string) (string, sql.NullString) {
+	var link sql.NullString
 
 	// find all things that look like links
 	linkrx := regexp.MustCompile("\\b(?i:https?|ftp)://\\S+")
-	matches := linkrx.FindAllString(note.Text, -1)
+	matches := linkrx.FindAllString(text, -1)
 	//fmt.Println(matches)
 
 	if matches != nil {
 		// find the longest link
 		sort.Sort(ByLength(matches))
-		note.Link.String = matches[len(matches) - 1]
-		note.Link.Valid = true
+		link.String = matches[len(matches) - 1]
+		link.Valid = true
 
 		// ‡<number> indicates location to insert link
 		dagIdx := 0
 		// if for some strange reason someone actually typed that, we search for the highest non-colliding index
 		dagrx := regexp.MustCompile("‡(\\d+)")
-		daggers := dagrx.FindAllStringSubmatch(note.Text, -1)
+		daggers := dagrx.FindAllStringSubmatch(text, -1)
 		if daggers != nil {
 			for _, dagger := range daggers {
 				d2, _ := strconv.Atoi(dagger[1])
@@ -98,8 +134,32 @@ func parseNote(text string) (note *Note) {
 		// replace the link with our symbol
 		// clients can later replace ‡<highest number> with the link
 		dagger := fmt.Sprintf("‡%d", dagIdx)
-		note.Text = strings.Replace(note.Text, note.Link.String, dagger, 1)
+		text = strings.Replace(text, link.String, dagger, 1)
 	}
+	return text, link
+}
+
+// interface for sorting strings by length
+type ByLength []string
+func (s ByLength) Len() int {
+    return len(s)
+}
+func (s ByLength) Swap(i, j int) {
+    s[i], s[j] = s[j], s[i]
+}
+func (s ByLength) Less(i, j int) bool {
+    return len(s[i]) < len(s[j])
+}
+
+func parseNote(text string) (note *Note) {
+	note = new(Note)
+	note.Text, note.Link = shortenLink(text)
+
+	// replace @mentions with @<number>, which counts as 2 characters
+	// to stay shortened, @mentions must be users that exist and are not blocking this user,
+	// which ResolveLocalMentions checks right away for users of this host, and ProcessMentions later for the rest
+	note.Text, note.Mentions = parseMentions(note.Text)
+	note.Pending = len(note.Mentions) > 0
 
 	if len(note.Text) > 140 || len(note.Text) == 0 {
 		// TODO: return error?
@@ -108,9 +168,46 @@ func parseNote(text string) (note *Note) {
 	return note
 }
 
+// a note is hidden from users blocked by its author
+// a note in a group is visible only to its author and the members of the group
+// a note by a muted author is hidden from the user who muted them
+func CanSeeNote(db *sqlx.DB, note *Note, viewer *Principal) (bool, error) {
+	viewerId := viewer.UserId()
+	if viewerId > 0 && note.UserId == viewerId {
+		return true, nil
+	}
+	if note.Pending {
+		return false, nil
+	}
+
+	blocked, err := IsBlocking(db, note.UserId, viewer.Address)
+	if err != nil || blocked {
+		return false, err
+	}
+
+	if viewerId > 0 {
+		author, err := FetchUser(db, note.UserId)
+		if err != nil || author == nil {
+			return false, err
+		}
+		muted, err := IsMuting(db, viewerId, LocalAddress(author.Handle))
+		if err != nil || muted {
+			return false, err
+		}
+	}
+
+	if note.GroupId == 0 {
+		return true, nil
+	}
+	return IsGroupMember(db, note.GroupId, viewer.Address)
+}
+
 // first call r.ParseForm()
 func validIntFormValue(r *http.Request, fieldName string, defaultValue int) int {
-	stringVal := r.PostFormValue(fieldName)
+	return validIntValue(r.FormValue(fieldName), defaultValue)
+}
+
+func validIntValue(stringVal string, defaultValue int) int {
 	if len(stringVal) == 0 {
 		return defaultValue
 	}
@@ -122,48 +219,135 @@ func validIntFormValue(r *http.Request, fieldName string, defaultValue int) int
 	return intVal
 }
 
+// conditions for the since_id, since_date, before_id and before_date parameters, to be ANDed to a where clause,
+// and the number of notes to return
+// first call r.ParseForm()
+func notePagination(r *http.Request) (where string, count int) {
+	return notePaginationValues(r.Form)
+}
+
+func notePaginationValues(form url.Values) (where string, count int) {
+	sinceId := validIntValue(form.Get("since_id"), 0)
+	if sinceId > 0 {
+		where += " AND Note.NoteId > " + strconv.Itoa(sinceId)
+	}
+	sinceDate := validIntValue(form.Get("since_date"), 0)
+	if sinceDate > 0 {
+		where += " AND Note.Date > FROM_UNIXTIME(" + strconv.Itoa(sinceDate) + ")"
+	}
+	beforeId := validIntValue(form.Get("before_id"), 0)
+	if beforeId > 0 {
+		where += " AND Note.NoteId < " + strconv.Itoa(beforeId)
+	}
+	beforeDate := validIntValue(form.Get("before_date"), 0)
+	if beforeDate > 0 {
+		where += " AND Note.Date < FROM_UNIXTIME(" + strconv.Itoa(beforeDate) + ")"
+	}
+
+	count = validIntValue(form.Get("count"), MaximumNotesReturned)
+	if count > MaximumNotesReturned || count <= 0 {
+		count = MaximumNotesReturned
+	}
+	return
+}
+
 func ListNotesHandler(rw http.ResponseWriter, r *http.Request) {
-	token, err := FetchToken(db, r)
+	viewer, err := FetchPrincipal(db, r)
 	if err != nil {
 		fmt.Println(err)
 		sendError(rw, http.StatusInternalServerError, err.Error())
 		return
 	}
-	if token == nil {
-		fmt.Println(err)
+	if viewer == nil {
 		sendError(rw, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
 
-	// TODO: guest authorization and user id parm
-
 	r.ParseForm()
-	where := " WHERE UserId = ?"
-	sinceId := validIntFormValue(r, "since_id", 0)
-	if sinceId > 0 {
-		where += " AND NoteId > " + strconv.Itoa(sinceId)
+
+	// list the notes of the given user, or by default the authenticated user
+	handle := r.FormValue("handle")
+	if len(handle) == 0 {
+		if viewer.IsGuest() {
+			sendError(rw, http.StatusBadRequest, "Missing handle.")
+			return
+		}
+		handle = viewer.Address.Handle
 	}
-	sinceDate := validIntFormValue(r, "since_date", 0)
-	if sinceDate > 0 {
-		where += " AND Date > FROM_UNIXTIME(" + strconv.Itoa(sinceDate) + ")"
+	if strings.Contains(handle, "!") {
+		address, err := ParseAddress(handle)
+		if err != nil {
+			sendError(rw, http.StatusBadRequest, err.Error())
+			return
+		}
+		if !address.IsLocal() {
+			listRemoteNotes(rw, r, viewer, address)
+			return
+		}
+		handle = address.Handle
 	}
-	beforeId := validIntFormValue(r, "before_id", 0)
-	if beforeId > 0 {
-		where += " AND NoteId < " + strconv.Itoa(beforeId)
+	author, err := FetchUserByHandle(db, handle)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
 	}
-	beforeDate := validIntFormValue(r, "before_date", 0)
-	if beforeDate > 0 {
-		where += " AND Date < FROM_UNIXTIME(" + strconv.Itoa(beforeDate) + ")"
+	if author == nil {
+		sendError(rw, http.StatusNotFound, "There is no user with that handle.")
+		return
 	}
 
-	count := validIntFormValue(r, "count", MaximumNotesReturned)
-	if count > MaximumNotesReturned {
-		count = MaximumNotesReturned
+	isAuthor := author.UserId == viewer.UserId()
+	if !isAuthor && len(author.MovedTo) > 0 {
+		sendMoved(rw, author)
+		return
+	}
+	if !isAuthor {
+		// to a blocked user, the author does not exist
+		blocked, err := IsBlocking(db, author.UserId, viewer.Address)
+		if err != nil {
+			fmt.Println(err)
+			sendError(rw, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if blocked {
+			sendError(rw, http.StatusNotFound, "There is no user with that handle.")
+			return
+		}
+
+		// a muted author's notes disappear from the viewer's view
+		muted, err := IsMuting(db, viewer.UserId(), LocalAddress(author.Handle))
+		if err != nil {
+			fmt.Println(err)
+			sendError(rw, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if muted {
+			sendData(rw, http.StatusOK, []interface{}{})
+			return
+		}
 	}
-	limit := " LIMIT " + strconv.Itoa(count)
+
+	where := " WHERE UserId = ?"
+	// group notes are only visible to the author and members of the group
+	args := []interface{}{author.UserId}
+	if !isAuthor {
+		where += " AND Pending = 0 AND (GroupId = 0 OR GroupId IN (" + groupsOfSQL + "))"
+		args = append(args, groupsOfArgs(viewer.Address)...)
+	}
+
+	paging, count := notePagination(r)
+	where += paging
+	limit := " ORDER BY NoteId DESC LIMIT " + strconv.Itoa(count)
 
 	notes := []Note{}
-	err = db.Select(&notes, "SELECT * FROM Note" + where + limit, token.UserId)
+	err = db.Select(&notes, "SELECT * FROM Note" + where + limit, args...)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	err = PrepareNotes(db, notes, viewer)
 	if err != nil {
 		fmt.Println(err)
 		sendError(rw, http.StatusInternalServerError, err.Error())
@@ -178,6 +362,49 @@ func ListNotesHandler(rw http.ResponseWriter, r *http.Request) {
 	sendData(rw, http.StatusOK, notes2)
 }
 
+// a local user reads a remote user's notes through this host, which fetches them as the user's guest
+func listRemoteNotes(rw http.ResponseWriter, r *http.Request, viewer *Principal, address *Address) {
+	// guests ask the author's host themselves
+	if viewer.IsGuest() {
+		sendError(rw, http.StatusNotFound, "There is no user with that handle.")
+		return
+	}
+	user, err := FetchUser(db, viewer.UserId())
+	if err != nil || user == nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	muted, err := IsMuting(db, user.UserId, address)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if muted {
+		sendData(rw, http.StatusOK, []interface{}{})
+		return
+	}
+
+	query := url.Values{}
+	for k, v := range r.Form {
+		query[k] = v
+	}
+	query.Del("handle")
+	notes, err := NewFederationClient(db, user).Notes(address, query)
+	if err == ErrGuestTokenPending {
+		// at this point we don't know how the author's host will respond, so send 202 Accepted
+		sendData(rw, http.StatusAccepted, []interface{}{})
+		return
+	} else if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusBadGateway, "Could not get notes from " + address.Host + ".")
+		return
+	}
+	sendData(rw, http.StatusOK, notes)
+}
+
 func PostNoteHandler(rw http.ResponseWriter, r *http.Request) {
 	// TODO: we should make an auth middleware, once I can wrap my head around that
 	token, err := FetchToken(db, r)
@@ -202,18 +429,56 @@ func PostNoteHandler(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// TODO: groups
-	group := r.PostFormValue("group")
-	if len(group) > 0 {
-		groupId, _ := strconv.Atoi(group)
-		note.GroupId = int64(groupId)
+	// notes may only be posted to groups owned by the author
+	groupId := validIntFormValue(r, "group", 0)
+	if groupId > 0 {
+		group, err := FetchGroup(db, int64(groupId))
+		if err != nil {
+			fmt.Println(err)
+			sendError(rw, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if group == nil || group.UserId != token.UserId {
+			sendError(rw, http.StatusBadRequest, "There is no group with that ID.")
+			return
+		}
+		note.GroupId = group.GroupId
+	}
+
+	author, err := FetchUser(db, token.UserId)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !CanPost(author) {
+		sendError(rw, http.StatusForbidden, "Verify your email address before posting.")
+		return
+	}
+	ok, err := ResolveLocalMentions(db, note, LocalAddress(author.Handle))
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !ok {
+		sendError(rw, http.StatusBadRequest, "Notes must be no longer than 140 characters, counting mentions that can't be shortened.")
+		return
 	}
 
-	// TODO: defer processing mentions
+	status, message := setReplyTo(db, r, note, author, &Principal{Token: token, Address: LocalAddress(author.Handle)})
+	if status == 0 {
+		status, message = setVia(db, r, note, LocalAddress(author.Handle))
+	}
+	if status != 0 {
+		sendError(rw, status, message)
+		return
+	}
 
 	note.UserId = token.UserId
-	result, err := db.NamedExec("INSERT INTO `Note` (`UserId`, `Text`, `Link`, `LinkType`, `GroupId`) " +
-			"VALUES (:UserId, :Text, :Link, :LinkType, :GroupId)", note)
+	result, err := db.NamedExec("INSERT INTO `Note` (`UserId`, `Text`, `Link`, `LinkType`, `GroupId`, `Pending`, " +
+			"`ReplyToId`, `ReplyToHost`, `ThreadId`, `ViaHandle`, `ViaHost`) " +
+			"VALUES (:UserId, :Text, :Link, :LinkType, :GroupId, :Pending, :ReplyToId, :ReplyToHost, :ThreadId, :ViaHandle, :ViaHost)", note)
 	if err != nil {
 		fmt.Println(err)
 		sendError(rw, http.StatusInternalServerError, err.Error())
@@ -224,18 +489,32 @@ func PostNoteHandler(rw http.ResponseWriter, r *http.Request) {
 		fmt.Println(err)
 	}
 
-	sendData(rw, http.StatusCreated, note.AsMap())
+	err = InsertMentions(db, note)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if !note.Pending {
+		sendData(rw, http.StatusCreated, note.AsMap())
+		return
+	}
+
+	// at this point we don't know whether the mentions of other hosts will resolve, so send 202 Accepted
+	sendData(rw, http.StatusAccepted, note.AsMap())
+
+	go ProcessMentions(db, note, LocalAddress(author.Handle))
 }
 
 func GetNoteHandler(rw http.ResponseWriter, r *http.Request) {
-	token, err := FetchToken(db, r)
+	viewer, err := FetchPrincipal(db, r)
 	if err != nil {
 		fmt.Println(err)
 		sendError(rw, http.StatusInternalServerError, err.Error())
 		return
 	}
-	if token == nil {
-		fmt.Println(err)
+	if viewer == nil {
 		sendError(rw, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
@@ -247,8 +526,6 @@ func GetNoteHandler(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// TODO: guest authorization
-
 	note := new(Note)
 	err = db.Get(note, "SELECT * FROM Note WHERE NoteId = ?", noteId)
 	if err == sql.ErrNoRows {
@@ -260,7 +537,49 @@ func GetNoteHandler(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sendData(rw, http.StatusOK, note.AsMap())
+	visible, err := CanSeeNote(db, note, viewer)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !visible {
+		// don't reveal that the note exists
+		sendError(rw, http.StatusNotFound, "There is no note with that ID.")
+		return
+	}
+	if note.UserId != viewer.UserId() {
+		author, err := FetchUser(db, note.UserId)
+		if err != nil {
+			fmt.Println(err)
+			sendError(rw, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if author != nil && len(author.MovedTo) > 0 {
+			sendMoved(rw, author)
+			return
+		}
+	}
+
+	notes := []Note{*note}
+	err = PrepareNotes(db, notes, viewer)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// tell the viewer whether they may reply, which other hosts need to know before posting a reply
+	canReply, err := CanReply(db, note, viewer)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	m := notes[0].AsMap()
+	(*m)["CanReply"] = canReply
+
+	sendData(rw, http.StatusOK, m)
 }
 
 func PutNoteHandler(rw http.ResponseWriter, r *http.Request) {
@@ -307,16 +626,64 @@ func PutNoteHandler(rw http.ResponseWriter, r *http.Request) {
 	note.Text = note2.Text
 	note.Link = note2.Link
 	note.Edited = true
+	note.Pending = note2.Pending
+	note.Mentions = note2.Mentions
+
+	author, err := FetchUser(db, token.UserId)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	ok, err := ResolveLocalMentions(db, note, LocalAddress(author.Handle))
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !ok {
+		sendError(rw, http.StatusBadRequest, "Notes must be no longer than 140 characters, counting mentions that can't be shortened.")
+		return
+	}
 
-	_, err = db.NamedExec("UPDATE Note SET Text = :Text, Link = :Link, Edited = 1 "+
-		"WHERE NoteId = :NoteId", note)
+	// leave the via alone unless it was given, an empty via removes it
+	if _, ok := r.PostForm["via"]; ok {
+		note.ViaHandle = ""
+		note.ViaHost = ""
+		status, message := setVia(db, r, note, LocalAddress(author.Handle))
+		if status != 0 {
+			sendError(rw, status, message)
+			return
+		}
+	}
+
+	_, err = db.NamedExec("UPDATE Note SET Text = :Text, Link = :Link, Edited = 1, Pending = :Pending, "+
+		"ViaHandle = :ViaHandle, ViaHost = :ViaHost WHERE NoteId = :NoteId", note)
 	if err != nil {
 		fmt.Println(err)
 		sendError(rw, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	sendData(rw, http.StatusOK, note.AsMap())
+	err = DeleteMentions(db, note.NoteId)
+	if err == nil {
+		err = InsertMentions(db, note)
+	}
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if !note.Pending {
+		sendData(rw, http.StatusOK, note.AsMap())
+		return
+	}
+
+	sendData(rw, http.StatusAccepted, note.AsMap())
+
+	go ProcessMentions(db, note, LocalAddress(author.Handle))
 }
 
 func DeleteNoteHandler(rw http.ResponseWriter, r *http.Request) {
@@ -356,12 +723,16 @@ func DeleteNoteHandler(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = db.Exec("DELETE FROM `Note` WHERE NoteId = ?", noteId)
+	err = DeleteNotes(db, []int64{int64(noteId)})
 	if err != nil {
 		fmt.Println(err)
 		sendError(rw, http.StatusInternalServerError, err.Error())
 		return
 	}
+	err = DeleteRepostsOfNote(db, int64(noteId))
+	if err != nil {
+		fmt.Println(err)
+	}
 	sendData(rw, http.StatusNoContent, "")
 }
 
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// a password reset token works once, for this long
+const PasswordResetLifetimeMinutes = 60
+
+// email a reset token to the user with the handle or email address
+// always responds the same way, and is rate limited like logging in, so it can't be used to find out who has an account
+func PostPasswordResetHandler(rw http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	handleOrEmail := r.PostFormValue("handleOrEmail")
+	if len(handleOrEmail) == 0 {
+		sendError(rw, http.StatusBadRequest, "Missing handle or email.")
+		return
+	}
+
+	ipLimit, limit, ok := checkLoginLimits(rw, r, handleOrEmail)
+	if !ok {
+		return
+	}
+	err := limit.Bump(db)
+	if err != nil {
+		fmt.Println(err)
+	}
+	err = ipLimit.LogAttempt(db)
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	var u User
+	err = db.Get(&u, "SELECT * FROM `User` WHERE Handle = ? OR Email = ? LIMIT 1", handleOrEmail, handleOrEmail)
+	if err != nil && err != sql.ErrNoRows {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if err == nil {
+		token := RandomString(50)
+		_, err = db.Exec("UPDATE User SET PasswordResetHash = ?, PasswordResetDate = ? WHERE UserId = ?",
+			TokenHash(token), time.Now(), u.UserId)
+		if err != nil {
+			fmt.Println(err)
+			sendError(rw, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		body := "Someone asked to reset the password of " + LocalAddress(u.Handle).String() + ".\n\n" +
+			"To choose a new password, use this reset token within " +
+			fmt.Sprintf("%d", PasswordResetLifetimeMinutes) + " minutes:\n\n" + token + "\n\n" +
+			"If you didn't ask for this, you can ignore this email, and your password will not change.\n"
+		go func() {
+			err := SendMail(u.Email, "Reset your IMP password", body)
+			if err != nil {
+				log.Println("Could not send password reset email:", err)
+			}
+		}()
+	}
+
+	sendData(rw, http.StatusAccepted, "")
+}
+
+// set a new password with a reset token, which logs the user out everywhere
+func PutPasswordResetHandler(rw http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	handle := r.PostFormValue("handle")
+	if len(handle) == 0 {
+		sendError(rw, http.StatusBadRequest, "Missing handle.")
+		return
+	}
+	token := r.PostFormValue("token")
+	if len(token) == 0 {
+		sendError(rw, http.StatusBadRequest, "Missing token.")
+		return
+	}
+	password := r.PostFormValue("password")
+
+	ipLimit, limit, ok := checkLoginLimits(rw, r, handle)
+	if !ok {
+		return
+	}
+
+	user, err := FetchUserByHandle(db, handle)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	valid := user != nil && user.PasswordResetHash.Valid && user.PasswordResetDate.Valid &&
+		time.Now().Before(user.PasswordResetDate.Time.Add(PasswordResetLifetimeMinutes * time.Minute)) &&
+		TokenMatches(token, user.PasswordResetHash.String)
+	if !valid {
+		err = limit.Bump(db)
+		if err != nil {
+			fmt.Println(err)
+		}
+		err = ipLimit.LogAttempt(db)
+		if err != nil {
+			fmt.Println(err)
+		}
+		sendError(rw, http.StatusBadRequest, "The reset token is invalid or has expired.")
+		return
+	}
+
+	failed := CheckPassword(password, user.Handle, user.Email)
+	if len(failed) > 0 {
+		sendErrors(rw, http.StatusBadRequest, failed)
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// the token is used up, and whoever had the old password is logged out
+	_, err = db.Exec("UPDATE User SET PasswordHash = ?, PasswordResetHash = NULL, PasswordResetDate = NULL WHERE UserId = ?",
+		string(hash), user.UserId)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	err = DeleteUserTokens(db, user.UserId)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	limit.Clear(db)
+
+	sendData(rw, http.StatusOK, "")
+}
+
+// send 429 and return false if there have been too many attempts from the request's IP address or for the handle,
+// which need not belong to a real user
+func checkLoginLimits(rw http.ResponseWriter, r *http.Request, handleOrEmail string) (*IPLimit, *HandleLimit, bool) {
+	ipLimit, err := FetchIPLimit(db, getIP(r))
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return nil, nil, false
+	}
+	if ipLimit.LastLoginAttemptDate.Valid && time.Now().Before(ipLimit.LastLoginAttemptDate.Time.Add(time.Duration(SecondsBetweenLoginAttemptsPerIP) * time.Second)) {
+		sendError(rw, 429, "Too many attempts from this address.")
+		return nil, nil, false
+	}
+
+	limit, err := FetchHandleLimit(db, handleOrEmail)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return nil, nil, false
+	}
+	if limit.LoginAttemptCount > 0 && time.Now().Before(limit.LastAttemptDate.Time.Add(time.Duration(limit.NextLoginDelay) * time.Second)) {
+		sendError(rw, 429, "Too many attempts.")
+		return nil, nil, false
+	}
+	return ipLimit, limit, true
+}
+
+// used when the [policy] config section doesn't say otherwise
+const (
+	DefaultMinimumPasswordLength = 8
+	DefaultMinimumPasswordEntropy = 36
+	MinimumContainedLength = 3
+)
+
+// the rules a password breaks, or none if it's acceptable
+func CheckPassword(password string, handle string, email string) []string {
+	failed := []string{}
+
+	minLength := cfg.Policy.MinimumPasswordLength
+	if minLength <= 0 {
+		minLength = DefaultMinimumPasswordLength
+	}
+	if utf8.RuneCountInString(password) < minLength {
+		failed = append(failed, fmt.Sprintf("The password must be at least %d characters long.", minLength))
+	}
+
+	minEntropy := cfg.Policy.MinimumPasswordEntropy
+	if minEntropy <= 0 {
+		minEntropy = DefaultMinimumPasswordEntropy
+	}
+	if passwordEntropy(password) < float64(minEntropy) {
+		failed = append(failed, "The password is too easy to guess. Use a longer password with a mix of letters, digits and symbols.")
+	}
+
+	// very short handles and email names would rule out too many passwords
+	lower := strings.ToLower(password)
+	if len(handle) >= MinimumContainedLength && strings.Contains(lower, strings.ToLower(handle)) {
+		failed = append(failed, "The password must not contain your handle.")
+	}
+	local := strings.ToLower(email)
+	if i := strings.LastIndex(local, "@"); i > 0 {
+		local = local[:i]
+	}
+	if len(local) >= MinimumContainedLength {
+		if strings.Contains(lower, local) {
+			failed = append(failed, "The password must not contain your email address.")
+		}
+	}
+
+	breached, err := IsBreachedPassword(password)
+	if err != nil {
+		log.Println(err)
+	}
+	if breached {
+		failed = append(failed, "The password is on a list of passwords exposed in data breaches.")
+	}
+	return failed
+}
+
+// a rough estimate in bits, based on the kinds of characters used
+// repeated characters and runs like "abc" or "321" don't count
+func passwordEntropy(password string) float64 {
+	var hasLower, hasUpper, hasDigit, hasSymbol, hasOther bool
+	count := 0
+	var prev rune
+	for i, c := range password {
+		switch {
+		case c >= 'a' && c <= 'z':
+			hasLower = true
+		case c >= 'A' && c <= 'Z':
+			hasUpper = true
+		case c >= '0' && c <= '9':
+			hasDigit = true
+		case c < 128:
+			hasSymbol = true
+		default:
+			hasOther = true
+		}
+		if i == 0 || (c != prev && c != prev + 1 && c != prev - 1) {
+			count++
+		}
+		prev = c
+	}
+
+	pool := 0
+	if hasLower {
+		pool += 26
+	}
+	if hasUpper {
+		pool += 26
+	}
+	if hasDigit {
+		pool += 10
+	}
+	if hasSymbol {
+		pool += 33
+	}
+	if hasOther {
+		pool += 100
+	}
+	if pool == 0 {
+		return 0
+	}
+	return float64(count) * math.Log2(float64(pool))
+}
+
+var breachedPasswords map[string]bool
+var breachedPasswordsOnce sync.Once
+var breachedPasswordsErr error
+
+// check the built-in list of common passwords, and the breached password file from the [policy] config section, if there is one
+// each line of the file is either a password or the hex SHA-1 of one
+func IsBreachedPassword(password string) (bool, error) {
+	if commonPasswords[strings.ToLower(password)] {
+		return true, nil
+	}
+	if len(cfg.Policy.BreachedPasswordFile) == 0 {
+		return false, nil
+	}
+
+	breachedPasswordsOnce.Do(func() {
+		f, err := os.Open(cfg.Policy.BreachedPasswordFile)
+		if err != nil {
+			breachedPasswordsErr = err
+			return
+		}
+		defer f.Close()
+
+		breachedPasswords = map[string]bool{}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if len(line) > 0 {
+				breachedPasswords[line] = true
+			}
+		}
+		breachedPasswordsErr = scanner.Err()
+	})
+	if breachedPasswordsErr != nil {
+		return false, breachedPasswordsErr
+	}
+
+	sum := sha1.Sum([]byte(password))
+	hash := hex.EncodeToString(sum[:])
+	return breachedPasswords[password] || breachedPasswords[hash] || breachedPasswords[strings.ToUpper(hash)], nil
+}
+
+// change the authenticated user's password, logging out their other sessions
+func PutPasswordHandler(rw http.ResponseWriter, r *http.Request) {
+	user, ok := listOwnerFromRequest(rw, r)
+	if !ok {
+		return
+	}
+
+	r.ParseForm()
+	err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(r.PostFormValue("password")))
+	if err != nil {
+		sendError(rw, http.StatusUnauthorized, "The current password is incorrect.")
+		return
+	}
+
+	newPassword := r.PostFormValue("new_password")
+	failed := CheckPassword(newPassword, user.Handle, user.Email)
+	if len(failed) > 0 {
+		sendErrors(rw, http.StatusBadRequest, failed)
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// a reset link sent before the change shouldn't still work after it
+	_, err = db.Exec("UPDATE User SET PasswordHash = ?, PasswordResetHash = NULL, PasswordResetDate = NULL WHERE UserId = ?",
+		string(hash), user.UserId)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	token, err := FetchToken(db, r)
+	if err != nil || token == nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, "Could not log out other sessions.")
+		return
+	}
+	_, err = db.Exec("DELETE FROM `UserToken` WHERE UserId = ? AND TokenId != ?", user.UserId, token.TokenId)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sendData(rw, http.StatusOK, "")
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestPasswordEntropy(t *testing.T) {
+	tests := []struct {
+		password string
+		want float64
+	}{
+		{"", 0},
+		{"a", math.Log2(26)},
+		{"aaaaaaaa", math.Log2(26)},
+		{"abcdefgh", math.Log2(26)},
+		{"87654321", math.Log2(10)},
+		{"qwerty", 6 * math.Log2(26)},
+		{"Qwerty", 6 * math.Log2(52)},
+		{"Qwerty12", 7 * math.Log2(62)},
+		{"Qwerty1!", 8 * math.Log2(95)},
+		{"xxxyyyzzz", math.Log2(26)},
+		{"a c e", 5 * math.Log2(59)},
+		{"héllo", 4 * math.Log2(126)},
+	}
+	for _, test := range tests {
+		got := passwordEntropy(test.password)
+		if math.Abs(got - test.want) > 1e-9 {
+			t.Errorf("passwordEntropy(%q) = %v, want %v", test.password, got, test.want)
+		}
+	}
+}
+
+func TestPasswordEntropyOrdering(t *testing.T) {
+	weak, strong := passwordEntropy("password"), passwordEntropy("c0rrect-H0rse-battery")
+	if weak >= strong {
+		t.Errorf("passwordEntropy(\"password\") = %v, not less than %v", weak, strong)
+	}
+}
+
+func TestCommonPasswordsAreRejectedByDefault(t *testing.T) {
+	saved := cfg.Policy
+	defer func() { cfg.Policy = saved }()
+	cfg.Policy.MinimumPasswordLength = 0
+	cfg.Policy.MinimumPasswordEntropy = 0
+	cfg.Policy.BreachedPasswordFile = ""
+
+	for _, password := range []string{"iloveyou", "ILoveYou", "Passw0rd", "qwertyuiop"} {
+		if failed := CheckPassword(password, "alice", "alice@example.com"); len(failed) == 0 {
+			t.Errorf("CheckPassword(%q) passed", password)
+		}
+	}
+	if failed := CheckPassword("c0rrect-H0rse-battery", "alice", "alice@example.com"); len(failed) > 0 {
+		t.Errorf("CheckPassword(\"c0rrect-H0rse-battery\") = %v", failed)
+	}
+}
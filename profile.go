@@ -0,0 +1,277 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"log"
+	"net/http"
+	"time"
+)
+
+// The status and essence (stored as Biography) work like notes, with a shortened link and mentions,
+// but a user only has one of each, and setting a new one replaces the old one for good.
+
+// the profile fields, which are also the names of their columns in User
+const (
+	ProfileStatus = "Status"
+	ProfileEssence = "Biography"
+)
+
+// an @-mention in a profile field, like a Mention in a note
+type ProfileMention struct {
+	UserId int64
+	Field string
+	Position int64
+	Handle string
+	Host string
+	Resolved bool
+}
+
+func (m *ProfileMention) Mention() Mention {
+	return Mention{Position: m.Position, Handle: m.Handle, Host: m.Host, Resolved: m.Resolved}
+}
+
+// a local user's public profile, seen by anyone the user hasn't blocked, whether or not they're authenticated
+// fields that are only for the owner need the owner's token
+func GetUserHandler(rw http.ResponseWriter, r *http.Request) {
+	viewer, err := FetchPrincipal(db, r)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	user, err := FetchUserByHandle(db, mux.Vars(r)["handle"])
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	blocked := false
+	if user != nil && viewer != nil {
+		blocked, err = IsBlocking(db, user.UserId, viewer.Address)
+		if err != nil {
+			fmt.Println(err)
+			sendError(rw, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	if user == nil || blocked {
+		sendError(rw, http.StatusNotFound, "There is no user with that handle.")
+		return
+	}
+	isOwner := viewer != nil && user.UserId == viewer.UserId()
+	if !isOwner && len(user.MovedTo) > 0 {
+		sendMoved(rw, user)
+		return
+	}
+
+	profile, err := ProfileAsMap(db, user, isOwner)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sendData(rw, http.StatusOK, profile)
+}
+
+func PutStatusHandler(rw http.ResponseWriter, r *http.Request) {
+	setProfileField(rw, r, ProfileStatus, "status")
+}
+
+func PutEssenceHandler(rw http.ResponseWriter, r *http.Request) {
+	setProfileField(rw, r, ProfileEssence, "essence")
+}
+
+// replace the profile field with the form value, or clear it if the value is empty
+func setProfileField(rw http.ResponseWriter, r *http.Request, field string, formKey string) {
+	user, ok := listOwnerFromRequest(rw, r)
+	if !ok {
+		return
+	}
+
+	r.ParseForm()
+	text := r.PostFormValue(formKey)
+	note := new(Note)
+	if len(text) > 0 {
+		note = parseNote(text)
+		if note == nil {
+			sendError(rw, http.StatusBadRequest, "The " + formKey + " must be no longer than 140 characters.")
+			return
+		}
+	}
+	ok, err := ResolveLocalMentions(db, note, LocalAddress(user.Handle))
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !ok {
+		sendError(rw, http.StatusBadRequest, "The " + formKey + " must be no longer than 140 characters, counting mentions that can't be shortened.")
+		return
+	}
+
+	_, err = db.Exec("DELETE FROM `ProfileMention` WHERE UserId = ? AND Field = ?", user.UserId, field)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	query := "UPDATE User SET " + field + " = ?, " + field + "Link = ?, " + field + "Pending = ?"
+	args := []interface{}{note.Text, note.Link, note.Pending}
+	if field == ProfileStatus {
+		query += ", StatusDate = ?"
+		args = append(args, time.Now())
+	}
+	_, err = db.Exec(query + " WHERE UserId = ?", append(args, user.UserId)...)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	for _, m := range note.Mentions {
+		_, err = db.Exec("INSERT INTO `ProfileMention` (`UserId`, `Field`, `Position`, `Handle`, `Host`, `Resolved`) " +
+			"VALUES (?, ?, ?, ?, ?, ?)", user.UserId, field, m.Position, m.Handle, m.Host, m.Resolved)
+		if err != nil {
+			fmt.Println(err)
+			sendError(rw, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	value := profileFieldAsMap(note.Text, note.Link, note.Mentions, note.Pending)
+	if field == ProfileStatus && len(note.Text) > 0 {
+		value["Date"] = time.Now().Unix()
+	}
+
+	if !note.Pending {
+		sendData(rw, http.StatusOK, value)
+		return
+	}
+	sendData(rw, http.StatusAccepted, value)
+
+	go ProcessProfileMentions(db, user, field, note)
+}
+
+// resolve the mentions in a profile field like ProcessMentions does for a note
+func ProcessProfileMentions(db *sqlx.DB, user *User, field string, note *Note) {
+	author := LocalAddress(user.Handle)
+	for i := range note.Mentions {
+		m := &note.Mentions[i]
+		if m.Address().IsLocal() {
+			continue
+		}
+		allowed, err := CanMention(db, author, m.Address())
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		m.Resolved = allowed
+
+		_, err = db.Exec("UPDATE `ProfileMention` SET Resolved = ? WHERE UserId = ? AND Field = ? AND Position = ?",
+			m.Resolved, user.UserId, field, m.Position)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	// only touch the field if the user hasn't replaced it in the meantime
+	where := " WHERE UserId = ? AND " + field + " = ? AND " + field + "Pending = 1"
+	if len(expandMentions(note.Text, note.Mentions, isUnresolved)) <= 140 {
+		_, err := db.Exec("UPDATE User SET " + field + "Pending = 0" + where, user.UserId, note.Text)
+		if err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	log.Println("The", field, "of", author, "is too long with its unresolved mentions, cutting it to fit.")
+	text, kept := fitUnresolvedMentions(note.Text, note.Mentions)
+	result, err := db.Exec("UPDATE User SET " + field + " = ?, " + field + "Pending = 0" + where, text, user.UserId, note.Text)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return
+	}
+	_, err = db.Exec("DELETE FROM `ProfileMention` WHERE UserId = ? AND Field = ?", user.UserId, field)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, m := range kept {
+		_, err = db.Exec("INSERT INTO `ProfileMention` (`UserId`, `Field`, `Position`, `Handle`, `Host`, `Resolved`) " +
+			"VALUES (?, ?, ?, ?, ?, ?)", user.UserId, field, m.Position, m.Handle, m.Host, m.Resolved)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// the user's public profile
+// fields with pending mentions are only shown to the owner
+func ProfileAsMap(db *sqlx.DB, user *User, isOwner bool) (map[string]interface{}, error) {
+	mentions, err := FetchProfileMentions(db, user.UserId)
+	if err != nil {
+		return nil, err
+	}
+
+	status := map[string]interface{}{}
+	if isOwner || !user.StatusPending {
+		status = profileFieldAsMap(user.Status, user.StatusLink, mentions[ProfileStatus], user.StatusPending)
+		if len(user.Status) > 0 && user.StatusDate.Valid {
+			status["Date"] = user.StatusDate.Time.Unix()
+		}
+	}
+	essence := map[string]interface{}{}
+	if isOwner || !user.BiographyPending {
+		essence = profileFieldAsMap(user.Biography, user.BiographyLink, mentions[ProfileEssence], user.BiographyPending)
+	}
+
+	return map[string]interface{}{
+		"Handle": user.Handle,
+		"Address": LocalAddress(user.Handle).String(),
+		"JoinedDate": user.JoinedDate.Time.Unix(),
+		"ReplyPolicy": user.ReplyPolicy,
+		"Status": status,
+		"Essence": essence,
+	}, nil
+}
+
+func profileFieldAsMap(text string, link sql.NullString, mentions []Mention, pending bool) map[string]interface{} {
+	m := map[string]interface{}{
+		"Text": text,
+		"Pending": pending,
+	}
+	list := []interface{}{}
+	for i := range mentions {
+		list = append(list, mentions[i].AsMap())
+	}
+	m["Mentions"] = list
+	if link.Valid {
+		m["Link"] = link.String
+	}
+	return m
+}
+
+// the user's profile mentions, by field
+func FetchProfileMentions(db *sqlx.DB, userId int64) (map[string][]Mention, error) {
+	rows := []ProfileMention{}
+	err := db.Select(&rows, "SELECT * FROM `ProfileMention` WHERE UserId = ? ORDER BY Position", userId)
+	if err != nil {
+		return nil, err
+	}
+	mentions := map[string][]Mention{
+		ProfileStatus: []Mention{},
+		ProfileEssence: []Mention{},
+	}
+	for i := range rows {
+		mentions[rows[i].Field] = append(mentions[rows[i].Field], rows[i].Mention())
+	}
+	return mentions, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http/httptest"
+	"testing"
+)
+
+// alice's profile as whoever the Authorization header says, or anyone if it's empty
+func fetchTestProfile(t *testing.T, authorization string) (int, map[string]interface{}) {
+	r := httptest.NewRequest("GET", "/user/alice", nil)
+	if len(authorization) > 0 {
+		r.Header.Set("Authorization", authorization)
+	}
+	r = mux.SetURLVars(r, map[string]string{"handle": "alice"})
+	rw := httptest.NewRecorder()
+	GetUserHandler(rw, r)
+	envelope := struct {
+		Data map[string]interface{} `json:"data"`
+	}{}
+	json.Unmarshal(rw.Body.Bytes(), &envelope)
+	return rw.Code, envelope.Data
+}
+
+func TestProfileVisibility(t *testing.T) {
+	tdb := openTestDB(t)
+	alice := insertTestUser(t, tdb, "alice")
+	bob := insertTestUser(t, tdb, "bob")
+	tdb.MustExec("UPDATE User SET Status = 'draft @0', StatusPending = 1, Biography = 'hi' WHERE UserId = ?", alice)
+	tdb.MustExec("INSERT INTO `Block` (`UserId`, `Handle`, `Host`) VALUES (?, 'bob', ?)", alice, testHost)
+
+	status, profile := fetchTestProfile(t, "")
+	if status != 200 {
+		t.Fatalf("status %d without authenticating, want 200", status)
+	}
+	if profile["Handle"] != "alice" || profile["Essence"].(map[string]interface{})["Text"] != "hi" {
+		t.Errorf("the public profile is %v", profile)
+	}
+	if len(profile["Status"].(map[string]interface{})) > 0 {
+		t.Errorf("the pending status was shown to someone other than its owner: %v", profile["Status"])
+	}
+
+	status, profile = fetchTestProfile(t, testAuthorization(t, tdb, alice))
+	if status != 200 || profile["Status"].(map[string]interface{})["Text"] != "draft @0" {
+		t.Errorf("status %d and %v for the owner, want the pending status", status, profile["Status"])
+	}
+
+	status, _ = fetchTestProfile(t, testAuthorization(t, tdb, bob))
+	if status != 404 {
+		t.Errorf("status %d for a blocked user, want 404", status)
+	}
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Deliveries to other hosts go through a queue in the database, so a host that is down for a while
+// doesn't lose them. Failed jobs are retried with exponential backoff, and given up on after
+// MaximumJobAttempts, or straight away if the other host says the request is bad. Jobs that are
+// given up on are kept as dead letters, and users can check on their jobs.
+
+const (
+	JobPending = "pending"
+	JobRunning = "running"
+	JobDone = "done"
+	JobDead = "dead"
+)
+
+// what a job delivers
+const (
+	JobGuestRequest = "guest-request"
+	JobGuestToken = "guest-token"
+	JobMoved = "moved"
+	JobMessage = "message"
+	JobEncryptedMessage = "encrypted"
+	JobFavorite = "favorite"
+	// fetch the original of an imported repost, see ImportArchive
+	JobRepostCopy = "repost-copy"
+)
+
+const (
+	MaximumConcurrentJobs = 16
+	MaximumConcurrentJobsPerHost = 2
+	MaximumJobAttempts = 12
+	// the first retry is after this long, and each one after waits twice as long as the last
+	JobRetryBaseSeconds = 30
+	JobRetryMaximumSeconds = 6 * 3600
+	// look for jobs that are due at least this often, even if none have been queued
+	SecondsBetweenJobPolls = 15
+	// finished jobs are kept this long so users can see them, dead ones are kept
+	FinishedJobRetentionDays = 7
+	MaximumJobErrorLength = 255
+)
+
+type FederationJob struct {
+	JobId int64
+	// the local user the job is for, or 0 if it's for this host
+	UserId int64
+	Kind string
+	Host string
+	Method string
+	Path string
+	// the form to send, sealed like a guest token because it may hold one, see SealToken
+	Body string
+	// send with the user's guest token for the host
+	AsGuest bool
+	// the other host's user, for guest tokens
+	Handle string
+	Status string
+	Attempts int
+	NextAttemptDate mysql.NullTime
+	LastError string
+	CreatedDate mysql.NullTime
+	CompletedDate mysql.NullTime
+}
+
+// the body is left out, it's none of the user's business if it holds a token
+func (job *FederationJob) AsMap() map[string]interface{} {
+	m := map[string]interface{}{
+		"JobId": job.JobId,
+		"Kind": job.Kind,
+		"Host": job.Host,
+		"Method": job.Method,
+		"Path": job.Path,
+		"Status": job.Status,
+		"Attempts": job.Attempts,
+		"LastError": job.LastError,
+		"CreatedDate": job.CreatedDate.Time.Unix(),
+	}
+	if job.Status == JobPending {
+		m["NextAttemptDate"] = job.NextAttemptDate.Time.Unix()
+	}
+	if job.CompletedDate.Valid {
+		m["CompletedDate"] = job.CompletedDate.Time.Unix()
+	}
+	return m
+}
+
+// add a delivery to the queue, filling in the job's id and status
+func EnqueueFederationJob(db *sqlx.DB, job *FederationJob, form url.Values) error {
+	var err error
+	job.Body, err = SealToken(form.Encode())
+	if err != nil {
+		return err
+	}
+	job.Status = JobPending
+	job.Attempts = 0
+	job.CreatedDate.Time = time.Now()
+	job.CreatedDate.Valid = true
+	job.NextAttemptDate = job.CreatedDate
+
+	result, err := db.NamedExec("INSERT INTO `FederationJob` (`UserId`, `Kind`, `Host`, `Method`, `Path`, `Body`, `AsGuest`, `Handle`, " +
+		"`Status`, `Attempts`, `NextAttemptDate`, `CreatedDate`) VALUES (:UserId, :Kind, :Host, :Method, :Path, :Body, :AsGuest, :Handle, " +
+		":Status, :Attempts, :NextAttemptDate, :CreatedDate)", job)
+	if err != nil {
+		return err
+	}
+	job.JobId, err = result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	federationQueue.Wake()
+	return nil
+}
+
+// true if there is a job of the kind for the user and host that isn't finished
+func HasUnfinishedJob(db *sqlx.DB, kind string, userId int64, hostname string) (bool, error) {
+	var count int64
+	err := db.Get(&count, "SELECT COUNT(*) FROM `FederationJob` WHERE Kind = ? AND UserId = ? AND Host = ? AND Status IN (?, ?)",
+		kind, userId, hostname, JobPending, JobRunning)
+	return count > 0, err
+}
+
+// the authenticated user's recent jobs, newest first
+func ListFederationJobsHandler(rw http.ResponseWriter, r *http.Request) {
+	user, ok := listOwnerFromRequest(rw, r)
+	if !ok {
+		return
+	}
+
+	jobs := []FederationJob{}
+	err := db.Select(&jobs, "SELECT * FROM `FederationJob` WHERE UserId = ? ORDER BY JobId DESC LIMIT 100", user.UserId)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	maps := make([]map[string]interface{}, len(jobs))
+	for i := range jobs {
+		maps[i] = jobs[i].AsMap()
+	}
+	sendData(rw, http.StatusOK, maps)
+}
+
+func GetFederationJobHandler(rw http.ResponseWriter, r *http.Request) {
+	user, ok := listOwnerFromRequest(rw, r)
+	if !ok {
+		return
+	}
+
+	jobId, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		sendError(rw, http.StatusBadRequest, "Invalid job id.")
+		return
+	}
+	jobs := []FederationJob{}
+	err = db.Select(&jobs, "SELECT * FROM `FederationJob` WHERE JobId = ? AND UserId = ?", jobId, user.UserId)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(jobs) == 0 {
+		sendError(rw, http.StatusNotFound, "There is no such job.")
+		return
+	}
+	sendData(rw, http.StatusOK, jobs[0].AsMap())
+}
+
+type FederationQueue struct {
+	wake chan bool
+	stop chan bool
+	running sync.WaitGroup
+
+	mutex sync.Mutex
+	stopping bool
+	active int
+	activePerHost map[string]int
+	lastCleanup time.Time
+}
+
+var federationQueue = &FederationQueue{
+	wake: make(chan bool, 1),
+	stop: make(chan bool),
+	activePerHost: map[string]int{},
+}
+
+// look for due jobs now instead of at the next poll
+func (q *FederationQueue) Wake() {
+	select {
+	case q.wake <- true:
+	default:
+	}
+}
+
+// run the queue in the background until it's drained
+func StartFederationQueue(db *sqlx.DB) error {
+	// jobs that were running when the server last stopped never finished
+	_, err := db.Exec("UPDATE `FederationJob` SET Status = ? WHERE Status = ?", JobPending, JobRunning)
+	if err != nil {
+		return err
+	}
+	go federationQueue.run(db)
+	return nil
+}
+
+// stop starting jobs, and wait for the ones that are running until the context is done
+// jobs that are still running then are picked up again the next time the server starts
+func DrainFederationQueue(ctx context.Context) {
+	q := federationQueue
+	q.mutex.Lock()
+	if !q.stopping {
+		q.stopping = true
+		close(q.stop)
+	}
+	q.mutex.Unlock()
+
+	done := make(chan bool)
+	go func() {
+		q.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		log.Println("Federation queue drained.")
+	case <-ctx.Done():
+		log.Println("Gave up waiting for federation jobs to finish.")
+	}
+}
+
+func (q *FederationQueue) run(db *sqlx.DB) {
+	ticker := time.NewTicker(SecondsBetweenJobPolls * time.Second)
+	defer ticker.Stop()
+	for {
+		q.dispatch(db)
+		select {
+		case <-q.stop:
+			return
+		case <-q.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// start as many due jobs as the limits allow
+func (q *FederationQueue) dispatch(db *sqlx.DB) {
+	if time.Since(q.lastCleanup) > time.Hour {
+		q.lastCleanup = time.Now()
+		_, err := db.Exec("DELETE FROM `FederationJob` WHERE Status = ? AND CompletedDate < ?",
+			JobDone, time.Now().AddDate(0, 0, -FinishedJobRetentionDays))
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	jobs := []FederationJob{}
+	err := db.Select(&jobs, "SELECT * FROM `FederationJob` WHERE Status = ? AND NextAttemptDate <= ? ORDER BY NextAttemptDate LIMIT ?",
+		JobPending, time.Now(), MaximumConcurrentJobs * 4)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for i := range jobs {
+		job := &jobs[i]
+		hostname := strings.ToLower(job.Host)
+
+		q.mutex.Lock()
+		if q.stopping || q.active >= MaximumConcurrentJobs || q.activePerHost[hostname] >= MaximumConcurrentJobsPerHost {
+			q.mutex.Unlock()
+			continue
+		}
+		// claim the job, in case another server shares the database
+		result, err := db.Exec("UPDATE `FederationJob` SET Status = ? WHERE JobId = ? AND Status = ?", JobRunning, job.JobId, JobPending)
+		if err != nil {
+			q.mutex.Unlock()
+			log.Println(err)
+			continue
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			q.mutex.Unlock()
+			continue
+		}
+		q.active++
+		q.activePerHost[hostname]++
+		q.running.Add(1)
+		q.mutex.Unlock()
+
+		go func() {
+			defer func() {
+				q.mutex.Lock()
+				q.active--
+				q.activePerHost[hostname]--
+				if q.activePerHost[hostname] == 0 {
+					delete(q.activePerHost, hostname)
+				}
+				q.mutex.Unlock()
+				q.running.Done()
+				// a job may have been waiting for this one's slot
+				q.Wake()
+			}()
+			runFederationJob(db, job)
+		}()
+	}
+}
+
+func runFederationJob(db *sqlx.DB, job *FederationJob) {
+	permanent, err := job.deliver(db)
+	if err == nil {
+		_, err = db.Exec("UPDATE `FederationJob` SET Status = ?, CompletedDate = ?, LastError = '' WHERE JobId = ?",
+			JobDone, time.Now(), job.JobId)
+		if err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	job.Attempts++
+	job.LastError = truncate(err.Error(), MaximumJobErrorLength)
+	job.NextAttemptDate.Time = time.Now().Add(jobRetryDelay(job.Attempts))
+	job.Status = JobPending
+	if permanent || job.Attempts >= MaximumJobAttempts {
+		job.Status = JobDead
+		job.CompletedDate.Time = time.Now()
+		job.CompletedDate.Valid = true
+		log.Println("Giving up on", job.Kind, "job", job.JobId, "for", job.Host + ":", job.LastError)
+	}
+	_, err = db.NamedExec("UPDATE `FederationJob` SET Status = :Status, Attempts = :Attempts, NextAttemptDate = :NextAttemptDate, " +
+		"LastError = :LastError, CompletedDate = :CompletedDate WHERE JobId = :JobId", job)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func jobRetryDelay(attempts int) time.Duration {
+	delay := time.Duration(JobRetryBaseSeconds) * time.Second
+	for i := 1; i < attempts && delay < JobRetryMaximumSeconds * time.Second; i++ {
+		delay *= 2
+	}
+	if delay > JobRetryMaximumSeconds * time.Second {
+		delay = JobRetryMaximumSeconds * time.Second
+	}
+	return delay
+}
+
+// send the job's request, and do whatever has to happen once it has been accepted
+// permanent is true if there's no point trying again
+func (job *FederationJob) deliver(db *sqlx.DB) (permanent bool, err error) {
+	host, err := FetchHost(db, job.Host)
+	if err != nil {
+		return false, err
+	}
+	err = LocateHost(db, host)
+	if err != nil {
+		return false, err
+	}
+	body, err := OpenToken(job.Body)
+	if err != nil {
+		return true, err
+	}
+
+	req, err := NewSignedRequest(job.Method, host, job.Path, []byte(body))
+	if err != nil {
+		return true, err
+	}
+	if job.AsGuest {
+		token, err := FetchUserHostToken(db, job.UserId, host.HostId)
+		if err != nil {
+			return false, err
+		}
+		if len(token) == 0 {
+			user, err := FetchUser(db, job.UserId)
+			if err != nil || user == nil {
+				return true, errors.New("The user is gone.")
+			}
+			err = EnsureGuestToken(db, user, host.Name)
+			if err != nil {
+				log.Println(err)
+			}
+			return false, errors.New("No guest token for " + host.Name + " yet.")
+		}
+		req.Header.Set("Authorization", GuestAuthPrefix + token)
+	}
+
+	resp, err := federationClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		// a bad request won't get better, but the other host may be busy, or not have our key yet
+		permanent = resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusUnauthorized &&
+			resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != 429
+		return permanent, errors.New(resp.Status)
+	}
+
+	if job.Kind == JobGuestToken {
+		form, err := url.ParseQuery(body)
+		if err != nil {
+			return true, err
+		}
+		err = SaveGuestToken(db, host, job.Handle, form.Get("token"))
+		if err != nil {
+			return false, err
+		}
+	}
+	if job.Kind == JobRepostCopy {
+		envelope := struct {
+			Data map[string]interface{} `json:"data"`
+		}{}
+		err = json.NewDecoder(resp.Body).Decode(&envelope)
+		if err != nil || envelope.Data == nil {
+			return true, errors.New("The note from " + host.Name + " could not be read.")
+		}
+		noteId, err := strconv.ParseInt(strings.TrimPrefix(job.Path, "/note/"), 10, 64)
+		if err != nil {
+			return true, err
+		}
+		err = SaveRepostCopy(db, job.UserId, job.Host, noteId, envelope.Data)
+		if err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"github.com/jmoiron/sqlx"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJobRetryDelay(t *testing.T) {
+	want := []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute}
+	for i, delay := range want {
+		if got := jobRetryDelay(i + 1); got != delay {
+			t.Errorf("retry %d waits %v, want %v", i + 1, got, delay)
+		}
+	}
+
+	last := time.Duration(0)
+	for attempts := 1; attempts <= MaximumJobAttempts + 50; attempts++ {
+		delay := jobRetryDelay(attempts)
+		if delay < last {
+			t.Errorf("retry %d waits %v, less than the one before", attempts, delay)
+		}
+		if delay > JobRetryMaximumSeconds * time.Second {
+			t.Errorf("retry %d waits %v, more than the maximum", attempts, delay)
+		}
+		last = delay
+	}
+	if last != JobRetryMaximumSeconds * time.Second {
+		t.Errorf("the longest wait is %v, want the maximum", last)
+	}
+}
+
+// a host that answers every request with the status, and a job for it
+func queueTestJob(t *testing.T, tdb *sqlx.DB, status int) *FederationJob {
+	useSigningKey(t)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	saved := federationClient
+	federationClient = server.Client()
+	t.Cleanup(func() { federationClient = saved })
+	tdb.MustExec("INSERT INTO `Host` (`Name`, `Location`, `LocationDate`) VALUES ('b.example', ?, ?)",
+		strings.TrimPrefix(server.URL, "https://"), time.Now())
+
+	job := &FederationJob{Kind: JobMoved, Host: "b.example", Method: "POST", Path: "/moved"}
+	err := EnqueueFederationJob(tdb, job, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+func fetchTestJob(t *testing.T, tdb *sqlx.DB, jobId int64) *FederationJob {
+	job := new(FederationJob)
+	err := tdb.Get(job, "SELECT * FROM `FederationJob` WHERE JobId = ?", jobId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+func TestFailedJobsAreRetried(t *testing.T) {
+	tdb := openTestDB(t)
+	job := queueTestJob(t, tdb, http.StatusServiceUnavailable)
+
+	runFederationJob(tdb, job)
+	job = fetchTestJob(t, tdb, job.JobId)
+	if job.Status != JobPending || job.Attempts != 1 || !strings.Contains(job.LastError, "503") {
+		t.Errorf("the job is %s after %d attempts with %q, want pending after 1 with the error", job.Status, job.Attempts, job.LastError)
+	}
+	wait := time.Until(job.NextAttemptDate.Time)
+	if wait < JobRetryBaseSeconds * time.Second - 2 * time.Second || wait > JobRetryBaseSeconds * time.Second + 2 * time.Second {
+		t.Errorf("the next attempt is in %v, want %d seconds", wait, JobRetryBaseSeconds)
+	}
+
+	// the last attempt
+	job.Attempts = MaximumJobAttempts - 1
+	runFederationJob(tdb, job)
+	job = fetchTestJob(t, tdb, job.JobId)
+	if job.Status != JobDead || job.Attempts != MaximumJobAttempts || !job.CompletedDate.Valid {
+		t.Errorf("the job is %s after %d attempts, want dead after %d", job.Status, job.Attempts, MaximumJobAttempts)
+	}
+}
+
+func TestBadRequestsAreDeadLettered(t *testing.T) {
+	tdb := openTestDB(t)
+	job := queueTestJob(t, tdb, http.StatusBadRequest)
+
+	runFederationJob(tdb, job)
+	job = fetchTestJob(t, tdb, job.JobId)
+	if job.Status != JobDead || job.Attempts != 1 || !job.CompletedDate.Valid {
+		t.Errorf("the job is %s after %d attempts, want dead after the first", job.Status, job.Attempts)
+	}
+}
+
+func TestUnauthorizedRequestsAreRetried(t *testing.T) {
+	tdb := openTestDB(t)
+	// the other host may not have our key yet
+	job := queueTestJob(t, tdb, http.StatusUnauthorized)
+
+	runFederationJob(tdb, job)
+	job = fetchTestJob(t, tdb, job.JobId)
+	if job.Status != JobPending || job.Attempts != 1 {
+		t.Errorf("the job is %s after %d attempts, want pending", job.Status, job.Attempts)
+	}
+}
+
+func TestDeliveredJobsAreDone(t *testing.T) {
+	tdb := openTestDB(t)
+	job := queueTestJob(t, tdb, http.StatusOK)
+
+	runFederationJob(tdb, job)
+	job = fetchTestJob(t, tdb, job.JobId)
+	if job.Status != JobDone || job.Attempts != 0 || !job.CompletedDate.Valid {
+		t.Errorf("the job is %s after %d attempts, want done", job.Status, job.Attempts)
+	}
+}
+
+func TestFederationJobAsMap(t *testing.T) {
+	created := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	job := &FederationJob{JobId: 3, Kind: JobMessage, Status: JobPending, Body: "sealed"}
+	job.CreatedDate.Time, job.CreatedDate.Valid = created, true
+	job.NextAttemptDate.Time, job.NextAttemptDate.Valid = created.Add(time.Minute), true
+
+	// dates are Unix seconds, like everywhere else in the API
+	m := job.AsMap()
+	if m["CreatedDate"] != created.Unix() || m["NextAttemptDate"] != created.Add(time.Minute).Unix() {
+		t.Errorf("the job's dates are %v and %v", m["CreatedDate"], m["NextAttemptDate"])
+	}
+	if _, ok := m["Body"]; ok {
+		t.Errorf("the job's body was shown")
+	}
+	if _, ok := m["CompletedDate"]; ok {
+		t.Errorf("an unfinished job has a CompletedDate")
+	}
+
+	job.Status = JobDone
+	job.CompletedDate.Time, job.CompletedDate.Valid = created.Add(time.Hour), true
+	m = job.AsMap()
+	if _, ok := m["NextAttemptDate"]; ok || m["CompletedDate"] != created.Add(time.Hour).Unix() {
+		t.Errorf("the finished job's dates are %v and %v", m["NextAttemptDate"], m["CompletedDate"])
+	}
+}
@@ -31,7 +31,7 @@ func FetchHandleLimit(db *sqlx.DB, handle string) (h *HandleLimit, err error) {
 	h = new(HandleLimit)
     h.Handle = handle
 
-	err = db.Get(h, "SELECT `LoginAttemptCount`, `LastAttemptDate`, `NextLoginDelay` FROM `HandleLimit` WHERE `Handle` LIKE ?", handle)
+	err = db.Get(h, "SELECT `LoginAttemptCount`, `LastAttemptDate`, `NextLoginDelay` FROM `HandleLimit` WHERE `Handle` = ?", handle)
 	if err == sql.ErrNoRows {
 		h.NextLoginDelay = 1
 		return h, nil
@@ -60,7 +60,7 @@ func (h *HandleLimit) Bump(db *sqlx.DB) (err error) {
 }
 
 func (h *HandleLimit) Clear(db *sqlx.DB) (err error) {
-	_, err = db.Exec("DELETE FROM `HandleLimit` WHERE Handle LIKE ?", h.Handle)
+	_, err = db.Exec("DELETE FROM `HandleLimit` WHERE Handle = ?", h.Handle)
 	if err != nil {
 	    log.Println(err)
 	    return err
@@ -72,7 +72,7 @@ func FetchIPLimit(db *sqlx.DB, ip string) (h *IPLimit, err error) {
 	h = new(IPLimit)
     h.IP = ip
 
-	err = db.Get(h, "SELECT `LastLoginAttemptDate`, `UsersAllowedCount`, `CountResetDate` FROM `IPLimit` WHERE `IP` LIKE ?", ip)
+	err = db.Get(h, "SELECT `LastLoginAttemptDate`, `UsersAllowedCount`, `CountResetDate` FROM `IPLimit` WHERE `IP` = ?", ip)
 	if err == sql.ErrNoRows {
 	    h.UsersAllowedCount = NewUsersPerIPPerDay
 		return h, nil
@@ -118,7 +118,7 @@ func (h *IPLimit) LogNewUser(db *sqlx.DB) (err error) {
 }
 
 func (h *IPLimit) Clear(db *sqlx.DB) (err error) {
-	_, err = db.Exec("DELETE FROM `IPLimit` WHERE IP LIKE ?", h.IP)
+	_, err = db.Exec("DELETE FROM `IPLimit` WHERE IP = ?", h.IP)
 	if err != nil {
 	    log.Println(err)
 	    return err
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Local users read the notes of users on other hosts through their own host, which fetches them
+// as the user's guest and keeps them in the RemoteNote table. Notes are kept per local user,
+// because what a host shows depends on who is asking.
+
+const (
+	// a remote user's notes are fetched again once they're this old
+	RemoteNoteFreshSeconds = 300
+	// the most pages fetched at once to catch up with a remote user
+	MaximumRemoteNotePages = 10
+)
+
+var ErrGuestTokenPending = errors.New("A guest token for that host has been requested, try again shortly.")
+
+// the refreshes running in the background, so reloading a timeline doesn't start the same one again
+var backgroundRefreshes sync.Map
+
+type RemoteNote struct {
+	// the local user the note was fetched for
+	UserId int64
+	Handle string
+	Host string
+	NoteId int64
+	Date mysql.NullTime
+	// the note as its host sent it
+	Data string
+	// true if there are no older notes by the author
+	First bool
+	FetchedDate mysql.NullTime
+}
+
+// when a local user last fetched a remote user's notes, which may be none
+type RemoteFetch struct {
+	UserId int64
+	Handle string
+	Host string
+	FetchedDate mysql.NullTime
+}
+
+// talks to other hosts on behalf of a local user
+type FederationClient struct {
+	db *sqlx.DB
+	user *User
+}
+
+func NewFederationClient(db *sqlx.DB, user *User) *FederationClient {
+	return &FederationClient{db: db, user: user}
+}
+
+// GET the path from the host as the user's guest, and decode the data from the response envelope into v
+func (c *FederationClient) Get(hostname string, path string, query url.Values, v interface{}) error {
+	return c.Request(hostname, "GET", path, query, v)
+}
+
+// make a request of the host as the user's guest
+// the query goes in the body for methods other than GET
+// if v isn't nil, decode the data from the response envelope into it
+// if the user doesn't have a guest token for the host yet, one is requested and ErrGuestTokenPending returned
+func (c *FederationClient) Request(hostname string, method string, path string, query url.Values, v interface{}) error {
+	host, err := FetchHost(c.db, hostname)
+	if err != nil {
+		return err
+	}
+	token, err := FetchUserHostToken(c.db, c.user.UserId, host.HostId)
+	if err != nil {
+		return err
+	}
+	if len(token) == 0 {
+		err = EnsureGuestToken(c.db, c.user, host.Name)
+		if err != nil {
+			return err
+		}
+		return ErrGuestTokenPending
+	}
+	err = LocateHost(c.db, host)
+	if err != nil {
+		return err
+	}
+
+	var body []byte
+	if method == "GET" {
+		if len(query) > 0 {
+			path += "?" + query.Encode()
+		}
+	} else {
+		body = []byte(query.Encode())
+	}
+	req, err := NewSignedRequest(method, host, path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", GuestAuthPrefix + token)
+	resp, err := federationClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New(resp.Status)
+	}
+	if v == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+
+	envelope := struct {
+		Data interface{} `json:"data"`
+	}{Data: v}
+	return json.NewDecoder(resp.Body).Decode(&envelope)
+}
+
+// one page of the remote user's notes as their host serves them, newest first
+// each note gets the author's Address
+func (c *FederationClient) NotesPage(address *Address, query url.Values) ([]map[string]interface{}, error) {
+	q := url.Values{}
+	for k, v := range query {
+		q[k] = v
+	}
+	q.Set("handle", address.Handle)
+
+	notes := []map[string]interface{}{}
+	err := c.Get(address.Host, "/note", q, &notes)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range notes {
+		m["Address"] = address.String()
+	}
+	sort.Slice(notes, func(i, j int) bool {
+		return remoteNoteId(notes[i]) > remoteNoteId(notes[j])
+	})
+	return notes, nil
+}
+
+// the remote user's notes, like ListNotesHandler gives for a local user, from the cache where it can
+func (c *FederationClient) Notes(address *Address, query url.Values) ([]map[string]interface{}, error) {
+	fresh, err := c.isFresh(address)
+	if err != nil {
+		return nil, err
+	}
+	refreshed, complete := false, false
+	if !fresh {
+		complete, err = c.Refresh(address)
+		if err == ErrGuestTokenPending {
+			return nil, err
+		} else if err != nil {
+			// the host may be down for a moment, what we have will have to do
+			log.Println(address, err)
+		} else {
+			refreshed = true
+		}
+	}
+
+	paging, count := notePaginationValues(query)
+	rows := []RemoteNote{}
+	err = c.db.Select(&rows, "SELECT * FROM RemoteNote AS Note WHERE UserId = ? AND Handle = ? AND Host = ?" + paging +
+		" ORDER BY NoteId DESC LIMIT " + strconv.Itoa(count), c.user.UserId, address.Handle, address.Host)
+	if err != nil {
+		return nil, err
+	}
+	notes := []map[string]interface{}{}
+	hasFirst := false
+	for i := range rows {
+		m := map[string]interface{}{}
+		err = json.Unmarshal([]byte(rows[i].Data), &m)
+		if err != nil {
+			return nil, err
+		}
+		notes = append(notes, m)
+		hasFirst = hasFirst || rows[i].First
+	}
+	if len(notes) == count || hasFirst || (refreshed && complete) {
+		return notes, nil
+	}
+
+	// the cache doesn't reach back far enough, so ask for the rest
+	q := url.Values{}
+	for k, v := range query {
+		q[k] = v
+	}
+	q.Set("count", strconv.Itoa(count - len(notes)))
+	if len(rows) > 0 {
+		q.Set("before_id", strconv.FormatInt(rows[len(rows) - 1].NoteId, 10))
+	}
+	older, err := c.NotesPage(address, q)
+	if err != nil {
+		log.Println(address, err)
+		return notes, nil
+	}
+	fetched := time.Now()
+	for _, m := range older {
+		_, err = c.saveNote(address, m, fetched)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// a short page means we've reached the author's first note, unless it was cut short by a since parameter
+	if len(older) > 0 && len(older) < count - len(notes) && len(q.Get("since_id")) == 0 && len(q.Get("since_date")) == 0 {
+		err = c.markFirst(address, remoteNoteId(older[len(older) - 1]))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return append(notes, older...), nil
+}
+
+// fetch the remote user's notes newer than the ones we have, and drop the ones that are gone
+// the newest page is always fetched again, to catch edits and deletions
+// complete is true if all of the author's notes were fetched
+func (c *FederationClient) Refresh(address *Address) (complete bool, err error) {
+	start := time.Now()
+	var newest int64
+	err = c.db.Get(&newest, "SELECT COALESCE(MAX(NoteId), 0) FROM RemoteNote WHERE UserId = ? AND Handle = ? AND Host = ?",
+		c.user.UserId, address.Handle, address.Host)
+	if err != nil {
+		return false, err
+	}
+
+	query := url.Values{"count": {strconv.Itoa(MaximumNotesReturned)}}
+	var oldest int64
+	for page := 0; page < MaximumRemoteNotePages; page++ {
+		notes, err := c.NotesPage(address, query)
+		if err != nil {
+			return false, err
+		}
+		for _, m := range notes {
+			id, err := c.saveNote(address, m, start)
+			if err != nil {
+				return false, err
+			}
+			if oldest == 0 || id < oldest {
+				oldest = id
+			}
+		}
+		if len(notes) < MaximumNotesReturned {
+			complete = true
+			break
+		}
+		if oldest <= newest {
+			break
+		}
+		query.Set("before_id", strconv.FormatInt(oldest, 10))
+	}
+
+	// notes in the range just fetched that the host didn't send again were deleted, or are hidden from the user now
+	from := oldest
+	if complete {
+		from = 0
+	}
+	_, err = c.db.Exec("DELETE FROM RemoteNote WHERE UserId = ? AND Handle = ? AND Host = ? AND NoteId >= ? AND FetchedDate < ?",
+		c.user.UserId, address.Handle, address.Host, from, start)
+	if err != nil {
+		return false, err
+	}
+	// if the pages ran out before reaching the cache, there's a gap between the two,
+	// and Notes would serve the older cached notes as if they came right after the new ones,
+	// so drop them, and they'll be fetched again if they're asked for
+	if !complete && oldest > newest {
+		_, err = c.db.Exec("DELETE FROM RemoteNote WHERE UserId = ? AND Handle = ? AND Host = ? AND NoteId < ?",
+			c.user.UserId, address.Handle, address.Host, oldest)
+		if err != nil {
+			return false, err
+		}
+	}
+	if complete && oldest > 0 {
+		err = c.markFirst(address, oldest)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	fetch := RemoteFetch{UserId: c.user.UserId, Handle: address.Handle, Host: address.Host}
+	fetch.FetchedDate.Time = start
+	fetch.FetchedDate.Valid = true
+	_, err = c.db.NamedExec("INSERT INTO `RemoteFetch` (`UserId`, `Handle`, `Host`, `FetchedDate`) " +
+		"VALUES (:UserId, :Handle, :Host, :FetchedDate) ON DUPLICATE KEY UPDATE `FetchedDate` = VALUES(`FetchedDate`)", &fetch)
+	return complete, err
+}
+
+// the cached notes of the remote users the user follows and hasn't muted, newest first, each with its author's Address
+// authors whose notes are stale are refreshed in the background, so a slow host can't hold up the answer
+// only the date paging parameters apply, since note ids from different hosts can't be compared
+func (c *FederationClient) FollowedNotes(query url.Values) ([]map[string]interface{}, error) {
+	follows := []Follow{}
+	err := c.db.Select(&follows, "SELECT * FROM Follow WHERE UserId = ? AND Host != ?", c.user.UserId, cfg.Api.Host)
+	if err != nil {
+		return nil, err
+	}
+	for _, follow := range follows {
+		address := &Address{Handle: follow.Handle, Host: follow.Host}
+		muted, err := IsMuting(c.db, c.user.UserId, address)
+		if err != nil {
+			return nil, err
+		}
+		fresh, err := c.isFresh(address)
+		if err != nil {
+			return nil, err
+		}
+		if !muted && !fresh {
+			c.refreshInBackground(address)
+		}
+	}
+
+	dates := url.Values{"count": query["count"], "since_date": query["since_date"], "before_date": query["before_date"]}
+	paging, count := notePaginationValues(dates)
+	rows := []RemoteNote{}
+	err = c.db.Select(&rows, "SELECT Note.* FROM RemoteNote AS Note JOIN Follow " +
+		"ON Follow.UserId = Note.UserId AND Follow.Handle = Note.Handle AND Follow.Host = Note.Host " +
+		"WHERE Note.UserId = ? " +
+		"AND NOT EXISTS (SELECT * FROM Mute WHERE Mute.UserId = Note.UserId AND (Mute.Handle = Note.Handle OR Mute.Handle = '*') AND Mute.Host = Note.Host)" +
+		paging + " ORDER BY Note.Date DESC LIMIT " + strconv.Itoa(count), c.user.UserId)
+	if err != nil {
+		return nil, err
+	}
+	notes := []map[string]interface{}{}
+	for i := range rows {
+		m := map[string]interface{}{}
+		err = json.Unmarshal([]byte(rows[i].Data), &m)
+		if err != nil {
+			return nil, err
+		}
+		notes = append(notes, m)
+	}
+	return notes, nil
+}
+
+// start refreshing the remote user's notes, unless that's already happening
+func (c *FederationClient) refreshInBackground(address *Address) {
+	key := strconv.FormatInt(c.user.UserId, 10) + " " + strings.ToLower(address.String())
+	if _, running := backgroundRefreshes.LoadOrStore(key, true); running {
+		return
+	}
+	go func() {
+		defer backgroundRefreshes.Delete(key)
+		_, err := c.Refresh(address)
+		if err != nil && err != ErrGuestTokenPending {
+			log.Println(address, err)
+		}
+	}()
+}
+
+func (c *FederationClient) isFresh(address *Address) (bool, error) {
+	var fetched mysql.NullTime
+	err := c.db.Get(&fetched, "SELECT FetchedDate FROM RemoteFetch WHERE UserId = ? AND Handle = ? AND Host = ?",
+		c.user.UserId, address.Handle, address.Host)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return fetched.Valid && time.Since(fetched.Time) < RemoteNoteFreshSeconds * time.Second, nil
+}
+
+// save a note as its host sent it, and return its id
+func (c *FederationClient) saveNote(address *Address, m map[string]interface{}, fetched time.Time) (int64, error) {
+	note := RemoteNote{UserId: c.user.UserId, Handle: address.Handle, Host: address.Host, NoteId: remoteNoteId(m)}
+	if note.NoteId <= 0 {
+		return 0, errors.New("A note from " + address.Host + " has no id.")
+	}
+	date, _ := m["Date"].(float64)
+	note.Date.Time = time.Unix(int64(date), 0)
+	note.Date.Valid = true
+	note.FetchedDate.Time = fetched
+	note.FetchedDate.Valid = true
+	data, err := json.Marshal(m)
+	if err != nil {
+		return 0, err
+	}
+	note.Data = string(data)
+
+	_, err = c.db.NamedExec("INSERT INTO `RemoteNote` (`UserId`, `Handle`, `Host`, `NoteId`, `Date`, `Data`, `FetchedDate`) " +
+		"VALUES (:UserId, :Handle, :Host, :NoteId, :Date, :Data, :FetchedDate) " +
+		"ON DUPLICATE KEY UPDATE `Date` = VALUES(`Date`), `Data` = VALUES(`Data`), `FetchedDate` = VALUES(`FetchedDate`)", &note)
+	return note.NoteId, err
+}
+
+func (c *FederationClient) markFirst(address *Address, noteId int64) error {
+	_, err := c.db.Exec("UPDATE RemoteNote SET First = (NoteId = ?) WHERE UserId = ? AND Handle = ? AND Host = ?",
+		noteId, c.user.UserId, address.Handle, address.Host)
+	return err
+}
+
+// JSON numbers decode as float64
+func remoteNoteId(m map[string]interface{}) int64 {
+	id, _ := m["NoteId"].(float64)
+	return int64(id)
+}
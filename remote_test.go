@@ -0,0 +1,101 @@
+package main
+
+import (
+	"github.com/jmoiron/sqlx"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// b.example, whose bob has posted notes 1 to posted, and where the user has a guest token
+func remoteNotesHost(t *testing.T, tdb *sqlx.DB, userId int64, posted int64) *Address {
+	useSigningKey(t)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		before := posted + 1
+		if id, err := strconv.ParseInt(r.Form.Get("before_id"), 10, 64); err == nil {
+			before = id
+		}
+		limit, _ := strconv.ParseInt(r.Form.Get("count"), 10, 64)
+		notes := []map[string]interface{}{}
+		for id := before - 1; id > 0 && int64(len(notes)) < limit; id-- {
+			notes = append(notes, map[string]interface{}{"NoteId": id, "Text": "note", "Date": time.Now().Unix()})
+		}
+		sendData(rw, http.StatusOK, notes)
+	}))
+	t.Cleanup(server.Close)
+	saved := federationClient
+	federationClient = server.Client()
+	t.Cleanup(func() { federationClient = saved })
+
+	result := tdb.MustExec("INSERT INTO `Host` (`Name`, `Location`, `LocationDate`) VALUES ('b.example', ?, ?)",
+		strings.TrimPrefix(server.URL, "https://"), time.Now())
+	hostId, _ := result.LastInsertId()
+	token, err := SealToken("guest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tdb.MustExec("INSERT INTO `UserHost` (`UserId`, `HostId`, `Nonce`, `Token`, `CreatedDate`) VALUES (?, ?, '', ?, ?)",
+		userId, hostId, token, time.Now())
+	return &Address{Handle: "bob", Host: "b.example"}
+}
+
+func cacheRemoteNotes(t *testing.T, c *FederationClient, address *Address, from int64, to int64) {
+	fetched := time.Now().Add(-time.Hour)
+	for id := from; id <= to; id++ {
+		_, err := c.saveNote(address, map[string]interface{}{"NoteId": float64(id)}, fetched)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func cachedRemoteNoteIds(t *testing.T, tdb *sqlx.DB) (count int64, oldest int64) {
+	err := tdb.QueryRow("SELECT COUNT(*), COALESCE(MIN(NoteId), 0) FROM RemoteNote").Scan(&count, &oldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestRefreshKeepsTheCacheWhenItReachesIt(t *testing.T) {
+	tdb := openTestDB(t)
+	userId := insertTestUser(t, tdb, "alice")
+	posted := int64(150)
+	address := remoteNotesHost(t, tdb, userId, posted)
+	c := NewFederationClient(tdb, &User{UserId: userId})
+	cacheRemoteNotes(t, c, address, 1, 120)
+
+	complete, err := c.Refresh(address)
+	if err != nil || complete {
+		t.Fatalf("Refresh = %v, %v, want an incomplete refresh", complete, err)
+	}
+	if count, oldest := cachedRemoteNoteIds(t, tdb); count != 150 || oldest != 1 {
+		t.Errorf("%d notes are cached from %d, want 150 from 1", count, oldest)
+	}
+	if fresh, _ := c.isFresh(address); !fresh {
+		t.Errorf("the refreshed cache isn't fresh")
+	}
+}
+
+func TestRefreshDropsTheCacheBeyondAGap(t *testing.T) {
+	tdb := openTestDB(t)
+	userId := insertTestUser(t, tdb, "alice")
+	posted := int64(MaximumRemoteNotePages * MaximumNotesReturned + 200)
+	address := remoteNotesHost(t, tdb, userId, posted)
+	c := NewFederationClient(tdb, &User{UserId: userId})
+	cacheRemoteNotes(t, c, address, 1, 10)
+
+	// the pages run out before reaching note 10
+	complete, err := c.Refresh(address)
+	if err != nil || complete {
+		t.Fatalf("Refresh = %v, %v, want an incomplete refresh", complete, err)
+	}
+	count, oldest := cachedRemoteNoteIds(t, tdb)
+	if count != MaximumRemoteNotePages * MaximumNotesReturned || oldest != 201 {
+		t.Errorf("%d notes are cached from %d, want only the ones just fetched", count, oldest)
+	}
+}
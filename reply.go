@@ -0,0 +1,203 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// who may reply to a user's notes
+const (
+	ReplyPolicyEveryone = "everyone"
+	// users who follow the author, as far as this host knows
+	ReplyPolicyFollowers = "followers"
+	// users the author follows
+	ReplyPolicyFollowing = "following"
+	ReplyPolicyNobody = "nobody"
+)
+
+func IsValidReplyPolicy(policy string) bool {
+	switch policy {
+	case ReplyPolicyEveryone, ReplyPolicyFollowers, ReplyPolicyFollowing, ReplyPolicyNobody:
+		return true
+	}
+	return false
+}
+
+// the viewer must be able to see the note, and the author's reply policy must allow them
+// blocked users can't see the note, so they can never reply
+func CanReply(db *sqlx.DB, note *Note, viewer *Principal) (bool, error) {
+	visible, err := CanSeeNote(db, note, viewer)
+	if err != nil || !visible {
+		return false, err
+	}
+	if note.UserId == viewer.UserId() {
+		return true, nil
+	}
+
+	author, err := FetchUser(db, note.UserId)
+	if err != nil || author == nil {
+		return false, err
+	}
+
+	switch author.ReplyPolicy {
+	case ReplyPolicyEveryone:
+		return true, nil
+	case ReplyPolicyFollowers:
+		// we only know who follows the author from this host
+		if viewer.IsGuest() {
+			return false, nil
+		}
+		var count int64
+		err = db.Get(&count, "SELECT COUNT(*) FROM Follow WHERE UserId = ? AND Handle = ? AND Host = ?",
+			viewer.UserId(), author.Handle, cfg.Api.Host)
+		return count > 0, err
+	case ReplyPolicyFollowing:
+		var count int64
+		err = db.Get(&count, "SELECT COUNT(*) FROM Follow WHERE UserId = ? AND Handle = ? AND Host = ?",
+			author.UserId, viewer.Address.Handle, viewer.Address.Host)
+		return count > 0, err
+	}
+	return false, nil
+}
+
+// check the reply_to and reply_to_host form values and fill in the note's reply fields
+// returns an HTTP status and message if the author may not reply
+// first call r.ParseForm()
+func setReplyTo(db *sqlx.DB, r *http.Request, note *Note, author *User, principal *Principal) (int, string) {
+	replyTo := validIntFormValue(r, "reply_to", 0)
+	if replyTo <= 0 {
+		return 0, ""
+	}
+	replyToHost := r.FormValue("reply_to_host")
+
+	if len(replyToHost) == 0 || strings.EqualFold(replyToHost, cfg.Api.Host) {
+		parent := new(Note)
+		err := db.Get(parent, "SELECT * FROM Note WHERE NoteId = ?", replyTo)
+		if err == sql.ErrNoRows {
+			return http.StatusBadRequest, "There is no note with that ID."
+		} else if err != nil {
+			fmt.Println(err)
+			return http.StatusInternalServerError, err.Error()
+		}
+
+		allowed, err := CanReply(db, parent, principal)
+		if err != nil {
+			fmt.Println(err)
+			return http.StatusInternalServerError, err.Error()
+		}
+		if !allowed {
+			visible, _ := CanSeeNote(db, parent, principal)
+			if !visible {
+				// don't reveal that the note exists
+				return http.StatusBadRequest, "There is no note with that ID."
+			}
+			return http.StatusForbidden, "You are not allowed to reply to that note."
+		}
+
+		note.ReplyToId = parent.NoteId
+		note.ThreadId = parent.ThreadId
+		if note.ThreadId == 0 {
+			note.ThreadId = parent.NoteId
+		}
+		// a note in a group gets replies in the same group
+		note.GroupId = parent.GroupId
+		return 0, ""
+	}
+
+	// ask the parent's host whether we may reply
+	var parent map[string]interface{}
+	err := FederationGet(db, author, replyToHost, "/note/" + strconv.Itoa(replyTo), nil, &parent)
+	if err != nil {
+		fmt.Println(err)
+		return http.StatusBadRequest, "Could not retrieve that note from its host."
+	}
+	if canReply, _ := parent["CanReply"].(bool); !canReply {
+		return http.StatusForbidden, "You are not allowed to reply to that note."
+	}
+	note.ReplyToId = int64(replyTo)
+	note.ReplyToHost = replyToHost
+	return 0, ""
+}
+
+// the note and every local note in its conversation that the viewer can see, oldest first
+func GetThreadHandler(rw http.ResponseWriter, r *http.Request) {
+	viewer, err := FetchPrincipal(db, r)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if viewer == nil {
+		sendError(rw, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	noteId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		sendError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	note := new(Note)
+	err = db.Get(note, "SELECT * FROM Note WHERE NoteId = ?", noteId)
+	if err == sql.ErrNoRows {
+		sendError(rw, http.StatusNotFound, "There is no note with that ID.")
+		return
+	} else if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	visible, err := CanSeeNote(db, note, viewer)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !visible {
+		sendError(rw, http.StatusNotFound, "There is no note with that ID.")
+		return
+	}
+
+	threadId := note.ThreadId
+	if threadId == 0 {
+		threadId = note.NoteId
+	}
+	thread := []Note{}
+	err = db.Select(&thread, "SELECT * FROM Note WHERE NoteId = ? OR ThreadId = ? ORDER BY Date, NoteId", threadId, threadId)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	visibleNotes := []Note{}
+	for _, n := range thread {
+		visible, err := CanSeeNote(db, &n, viewer)
+		if err != nil {
+			fmt.Println(err)
+			sendError(rw, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if visible {
+			visibleNotes = append(visibleNotes, n)
+		}
+	}
+	err = PrepareNotes(db, visibleNotes, viewer)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	notes := []interface{}{}
+	for _, n := range visibleNotes {
+		notes = append(notes, n.AsMap())
+	}
+	sendData(rw, http.StatusOK, notes)
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// A repost is a note that refers to an original note, and its text is the reposter's commentary.
+// Reposts of local notes are links, so the original's edits, deletion and visibility rules always apply.
+// Reposts of notes on other hosts carry a copy of the original as it was when reposted,
+// because the reposter's readers may not have guest tokens for the original's host.
+
+func PostRepostHandler(rw http.ResponseWriter, r *http.Request) {
+	token, err := FetchToken(db, r)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if token == nil {
+		sendError(rw, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	author, err := FetchUser(db, token.UserId)
+	if err != nil || author == nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	if !CanPost(author) {
+		sendError(rw, http.StatusForbidden, "Verify your email address before posting.")
+		return
+	}
+	principal := &Principal{Token: token, Address: LocalAddress(author.Handle)}
+
+	originalId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		sendError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	r.ParseForm()
+
+	// the commentary is optional, the whole 140 characters are available for it
+	note := new(Note)
+	noteText := r.PostFormValue("note")
+	if len(noteText) > 0 {
+		note = parseNote(noteText)
+		if note == nil {
+			sendError(rw, http.StatusBadRequest, "Bad Request")
+			return
+		}
+	}
+	ok, err := ResolveLocalMentions(db, note, principal.Address)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !ok {
+		sendError(rw, http.StatusBadRequest, "Notes must be no longer than 140 characters, counting mentions that can't be shortened.")
+		return
+	}
+	note.UserId = author.UserId
+	note.RepostOfId = int64(originalId)
+
+	hostname := r.PostFormValue("host")
+	if len(hostname) == 0 || strings.EqualFold(hostname, cfg.Api.Host) {
+		original := new(Note)
+		err = db.Get(original, "SELECT * FROM Note WHERE NoteId = ?", originalId)
+		if err != nil && err != sql.ErrNoRows {
+			fmt.Println(err)
+			sendError(rw, http.StatusInternalServerError, err.Error())
+			return
+		}
+		visible := false
+		if err == nil {
+			visible, err = CanSeeNote(db, original, principal)
+			if err != nil {
+				fmt.Println(err)
+				sendError(rw, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+		if !visible {
+			sendError(rw, http.StatusNotFound, "There is no note with that ID.")
+			return
+		}
+		// reposting would leak private notes out of their group
+		if original.GroupId != 0 {
+			sendError(rw, http.StatusForbidden, "Notes in a group can't be reposted.")
+			return
+		}
+	} else {
+		var original map[string]interface{}
+		err = FederationGet(db, author, hostname, "/note/" + strconv.Itoa(originalId), nil, &original)
+		if err != nil {
+			fmt.Println(err)
+			sendError(rw, http.StatusBadRequest, "Could not retrieve that note from its host.")
+			return
+		}
+		if groupId, _ := original["GroupId"].(float64); groupId != 0 {
+			sendError(rw, http.StatusForbidden, "Notes in a group can't be reposted.")
+			return
+		}
+		note.RepostOfHost = hostname
+		note.RepostCopy, err = repostCopy(original)
+		if err != nil {
+			fmt.Println(err)
+			sendError(rw, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	var count int64
+	err = db.Get(&count, "SELECT COUNT(*) FROM Note WHERE UserId = ? AND RepostOfId = ? AND RepostOfHost = ?",
+		note.UserId, note.RepostOfId, note.RepostOfHost)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if count > 0 {
+		sendError(rw, http.StatusConflict, "You have already reposted that note.")
+		return
+	}
+
+	result, err := db.NamedExec("INSERT INTO `Note` (`UserId`, `Text`, `Link`, `LinkType`, `GroupId`, `Pending`, " +
+			"`RepostOfId`, `RepostOfHost`, `RepostCopy`) " +
+			"VALUES (:UserId, :Text, :Link, :LinkType, :GroupId, :Pending, :RepostOfId, :RepostOfHost, :RepostCopy)", note)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	note.NoteId, err = result.LastInsertId()
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	notes := []Note{*note}
+	err = AttachReposts(db, notes, principal)
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	err = InsertMentions(db, note)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !note.Pending {
+		sendData(rw, http.StatusCreated, notes[0].AsMap())
+		return
+	}
+	sendData(rw, http.StatusAccepted, notes[0].AsMap())
+
+	go ProcessMentions(db, note, principal.Address)
+}
+
+// the copy of a remote note to keep with a repost, without what only applies to the reposter
+func repostCopy(original map[string]interface{}) (sql.NullString, error) {
+	delete(original, "CanReply")
+	cached, err := json.Marshal(original)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(cached), Valid: true}, nil
+}
+
+// fill in the copy of the remote note that the user's imported repost refers to
+// a note in a group can't be reposted, so then the repost goes instead
+func SaveRepostCopy(db *sqlx.DB, userId int64, hostname string, noteId int64, original map[string]interface{}) error {
+	ids := []int64{}
+	err := db.Select(&ids, "SELECT NoteId FROM Note WHERE UserId = ? AND RepostOfId = ? AND RepostOfHost = ? AND RepostCopy IS NULL",
+		userId, noteId, hostname)
+	if err != nil {
+		return err
+	}
+	if groupId, _ := original["GroupId"].(float64); groupId != 0 {
+		return DeleteNotes(db, ids)
+	}
+	cached, err := repostCopy(original)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		_, err = db.Exec("UPDATE Note SET RepostCopy = ? WHERE NoteId = ?", cached, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fill in the RepostCount of each note, and the Original of each repost as far as the viewer may see it
+func AttachReposts(db *sqlx.DB, notes []Note, viewer *Principal) error {
+	if len(notes) == 0 {
+		return nil
+	}
+
+	ids := []int64{}
+	byId := map[int64]*Note{}
+	for i := range notes {
+		ids = append(ids, notes[i].NoteId)
+		byId[notes[i].NoteId] = &notes[i]
+	}
+
+	query, args, err := sqlx.In("SELECT RepostOfId, COUNT(*) AS RepostCount FROM Note " +
+		"WHERE RepostOfHost = '' AND RepostOfId IN (?) GROUP BY RepostOfId", ids)
+	if err != nil {
+		return err
+	}
+	counts := []struct {
+		RepostOfId int64
+		RepostCount int64
+	}{}
+	err = db.Select(&counts, query, args...)
+	if err != nil {
+		return err
+	}
+	for _, c := range counts {
+		byId[c.RepostOfId].RepostCount = c.RepostCount
+	}
+
+	for i := range notes {
+		n := &notes[i]
+		// an imported repost of a remote note has no copy until it has been fetched, see JobRepostCopy
+		if n.RepostOfId == 0 || (len(n.RepostOfHost) > 0 && !n.RepostCopy.Valid) {
+			continue
+		}
+		if n.RepostCopy.Valid {
+			var original map[string]interface{}
+			err = json.Unmarshal([]byte(n.RepostCopy.String), &original)
+			if err != nil {
+				return err
+			}
+			n.Original = original
+			continue
+		}
+
+		original := new(Note)
+		err = db.Get(original, "SELECT * FROM Note WHERE NoteId = ?", n.RepostOfId)
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return err
+		}
+		visible, err := CanSeeNote(db, original, viewer)
+		if err != nil {
+			return err
+		}
+		if visible {
+			originals := []Note{*original}
+			err = AttachMentions(db, originals)
+			if err != nil {
+				return err
+			}
+			n.Original = *originals[0].AsMap()
+		}
+	}
+	return nil
+}
+
+// remove the reposts of the author's notes made by the reposter, who has just been blocked
+func DeleteRepostsOf(db *sqlx.DB, authorId int64, reposter *Address) error {
+	if !reposter.IsLocal() {
+		// the reposts live on the reposter's host, and without a copy they'll find the original unavailable
+		return nil
+	}
+	ids := []int64{}
+	err := db.Select(&ids, "SELECT Repost.NoteId FROM Note AS Repost " +
+		"JOIN Note AS Original ON Repost.RepostOfId = Original.NoteId " +
+		"JOIN User ON Repost.UserId = User.UserId " +
+		"WHERE Repost.RepostOfHost = '' AND Original.UserId = ? AND User.Handle = ?", authorId, reposter.Handle)
+	if err != nil {
+		return err
+	}
+	return DeleteNotes(db, ids)
+}
+
+// remove the local reposts of a note that has just been deleted
+func DeleteRepostsOfNote(db *sqlx.DB, noteId int64) error {
+	ids := []int64{}
+	err := db.Select(&ids, "SELECT NoteId FROM Note WHERE RepostOfHost = '' AND RepostOfId = ?", noteId)
+	if err != nil {
+		return err
+	}
+	return DeleteNotes(db, ids)
+}
+
+// delete the notes along with their mentions, favorites and bookmarks
+func DeleteNotes(db *sqlx.DB, ids []int64) error {
+	for _, id := range ids {
+		err := DeleteMentions(db, id)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec("DELETE FROM `Favorite` WHERE NoteId = ? AND NoteHost = ''", id)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec("DELETE FROM `Bookmark` WHERE NoteId = ? AND NoteHost = ''", id)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec("DELETE FROM `Note` WHERE NoteId = ?", id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fill in everything about the notes that isn't stored in the Note table
+func PrepareNotes(db *sqlx.DB, notes []Note, viewer *Principal) error {
+	err := AttachMentions(db, notes)
+	if err != nil {
+		return err
+	}
+	err = AttachFavorites(db, notes)
+	if err != nil {
+		return err
+	}
+	return AttachReposts(db, notes, viewer)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"github.com/jmoiron/sqlx"
+	"io"
+	"log"
+)
+
+// Tokens that this host hands out, to its users and to guests, are stored as keyed hashes,
+// with a short prefix in the clear to find them by. Guest tokens that other hosts hand our users
+// have to be sent back to those hosts, so they are encrypted instead.
+// Both use the tokenkey from the [server] config section, which is kept out of the database.
+
+const (
+	TokenPrefixLength = 8
+	MinimumTokenKeyLength = 32
+	// longest guest token we'll accept from another host
+	MaximumForeignTokenLength = 255
+)
+
+// derive a separate key for each use of the token key
+func tokenSubkey(purpose string) []byte {
+	mac := hmac.New(sha256.New, []byte(cfg.Server.TokenKey))
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+func TokenPrefix(token string) string {
+	if len(token) < TokenPrefixLength {
+		return token
+	}
+	return token[:TokenPrefixLength]
+}
+
+func TokenHash(token string) string {
+	mac := hmac.New(sha256.New, tokenSubkey("hash"))
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TokenMatches(token string, hash string) bool {
+	return subtle.ConstantTimeCompare([]byte(TokenHash(token)), []byte(hash)) == 1
+}
+
+// encrypt a token from another host for storage, "" stays "" so it can still mean there is no token
+func SealToken(token string) (string, error) {
+	if len(token) == 0 {
+		return "", nil
+	}
+	gcm, err := tokenCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(token), nil)), nil
+}
+
+func OpenToken(sealed string) (string, error) {
+	if len(sealed) == 0 {
+		return "", nil
+	}
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := tokenCipher()
+	if err != nil {
+		return "", err
+	}
+	if len(data) < gcm.NonceSize() {
+		return "", errors.New("The sealed token is too short.")
+	}
+	token, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(token), nil
+}
+
+func tokenCipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(tokenSubkey("seal"))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// one-time migration from plaintext tokens, see migrate_hashed_tokens.sql
+// expects the old Token columns of UserToken and Guest to still be there alongside the new ones
+// safe to run more than once
+func RehashTokens(db *sqlx.DB) error {
+	userTokens := []struct {
+		TokenId int64
+		Token string
+	}{}
+	err := db.Select(&userTokens, "SELECT TokenId, Token FROM `UserToken` WHERE TokenHash = ''")
+	if err != nil {
+		return err
+	}
+	for _, t := range userTokens {
+		_, err = db.Exec("UPDATE `UserToken` SET TokenPrefix = ?, TokenHash = ? WHERE TokenId = ?",
+			TokenPrefix(t.Token), TokenHash(t.Token), t.TokenId)
+		if err != nil {
+			return err
+		}
+	}
+	log.Println("Hashed", len(userTokens), "user tokens.")
+
+	guests := []struct {
+		GuestId int64
+		Token string
+	}{}
+	err = db.Select(&guests, "SELECT GuestId, Token FROM `Guest` WHERE TokenHash = ''")
+	if err != nil {
+		return err
+	}
+	for _, g := range guests {
+		_, err = db.Exec("UPDATE `Guest` SET TokenPrefix = ?, TokenHash = ? WHERE GuestId = ?",
+			TokenPrefix(g.Token), TokenHash(g.Token), g.GuestId)
+		if err != nil {
+			return err
+		}
+	}
+	log.Println("Hashed", len(guests), "guest tokens.")
+
+	userHosts := []UserHost{}
+	err = db.Select(&userHosts, "SELECT * FROM `UserHost` WHERE Token != ''")
+	if err != nil {
+		return err
+	}
+	sealed := 0
+	for _, userHost := range userHosts {
+		// already sealed by an earlier run
+		if _, err := OpenToken(userHost.Token); err == nil {
+			continue
+		}
+		userHost.Token, err = SealToken(userHost.Token)
+		if err != nil {
+			return err
+		}
+		_, err = db.NamedExec("UPDATE `UserHost` SET Token = :Token WHERE UserId = :UserId AND HostId = :HostId", &userHost)
+		if err != nil {
+			return err
+		}
+		sealed++
+	}
+	log.Println("Encrypted", sealed, "tokens from other hosts.")
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func useTokenKey(t *testing.T, key string) {
+	saved := cfg.Server.TokenKey
+	cfg.Server.TokenKey = key
+	t.Cleanup(func() { cfg.Server.TokenKey = saved })
+}
+
+func TestTokenHash(t *testing.T) {
+	useTokenKey(t, testTokenKey)
+	token := RandomString(50)
+	hash := TokenHash(token)
+	if !TokenMatches(token, hash) {
+		t.Errorf("the token doesn't match its own hash")
+	}
+	if TokenMatches(token[:49] + "!", hash) || TokenMatches(strings.ToUpper(token), hash) || TokenMatches("", hash) {
+		t.Errorf("another token matches the hash")
+	}
+	if TokenHash(token) != hash {
+		t.Errorf("the hash isn't the same every time")
+	}
+
+	// a new key logs everyone out
+	useTokenKey(t, strings.Repeat("k", MinimumTokenKeyLength))
+	if TokenMatches(token, hash) {
+		t.Errorf("the token matches a hash made with another key")
+	}
+
+	if TokenPrefix(token) != token[:TokenPrefixLength] || TokenPrefix("abc") != "abc" {
+		t.Errorf("TokenPrefix = %q", TokenPrefix(token))
+	}
+}
+
+func TestSealToken(t *testing.T) {
+	useTokenKey(t, testTokenKey)
+	token := "a guest token from another host"
+	sealed, err := SealToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(sealed, token) {
+		t.Errorf("the sealed token is in the clear")
+	}
+	opened, err := OpenToken(sealed)
+	if err != nil || opened != token {
+		t.Errorf("OpenToken = %q, %v, want %q", opened, err, token)
+	}
+	again, _ := SealToken(token)
+	if again == sealed {
+		t.Errorf("sealing the token twice gave the same result, so the nonce isn't random")
+	}
+
+	// no token stays no token
+	if sealed, err := SealToken(""); sealed != "" || err != nil {
+		t.Errorf("SealToken(\"\") = %q, %v", sealed, err)
+	}
+	if opened, err := OpenToken(""); opened != "" || err != nil {
+		t.Errorf("OpenToken(\"\") = %q, %v", opened, err)
+	}
+
+	data, _ := base64.StdEncoding.DecodeString(sealed)
+	data[len(data) - 1] ^= 1
+	if opened, err := OpenToken(base64.StdEncoding.EncodeToString(data)); err == nil {
+		t.Errorf("a tampered token opened as %q", opened)
+	}
+	if opened, err := OpenToken(base64.StdEncoding.EncodeToString(data[:4])); err == nil {
+		t.Errorf("a truncated token opened as %q", opened)
+	}
+	if opened, err := OpenToken(token); err == nil {
+		t.Errorf("a token that was never sealed opened as %q", opened)
+	}
+
+	useTokenKey(t, strings.Repeat("k", MinimumTokenKeyLength))
+	if opened, err := OpenToken(sealed); err == nil {
+		t.Errorf("a token sealed with another key opened as %q", opened)
+	}
+}
+
+func TestFindTokenByPrefix(t *testing.T) {
+	tdb := openTestDB(t)
+	alice := insertTestUser(t, tdb, "alice")
+	bob := insertTestUser(t, tdb, "bob")
+	r := httptest.NewRequest("POST", "/token", nil)
+	token, err := MakeToken(tdb, &User{UserId: alice}, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := MakeToken(tdb, &User{UserId: bob}, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// bob's token shares alice's prefix, so looking it up has to check the hashes
+	tdb.MustExec("UPDATE UserToken SET TokenPrefix = ? WHERE TokenId = ?", token.TokenPrefix, other.TokenId)
+
+	for _, tt := range []*UserToken{token, other} {
+		found, err := findToken(tdb, tt.Token)
+		if err != nil || found == nil || found.TokenId != tt.TokenId {
+			t.Errorf("findToken = %+v, %v, want token %d", found, err, tt.TokenId)
+		}
+	}
+
+	swapped := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		} else if r >= 'A' && r <= 'Z' {
+			return r - 'A' + 'a'
+		}
+		return r
+	}, token.Token)
+	if swapped == token.Token {
+		t.Skip("the token has no letters")
+	}
+	var count int
+	tdb.Get(&count, "SELECT COUNT(*) FROM UserToken WHERE TokenPrefix = ?", TokenPrefix(swapped))
+	if count != 0 {
+		t.Errorf("the prefix %q matched %d tokens, want the lookup to be case-sensitive", TokenPrefix(swapped), count)
+	}
+	if found, _ := findToken(tdb, swapped); found != nil {
+		t.Errorf("a token differing in case was accepted")
+	}
+
+	// the same goes for the nonces of guest token requests
+	tdb.MustExec("INSERT INTO UserHost (`UserId`, `HostId`, `Nonce`, `Token`, `CreatedDate`) VALUES (?, 1, 'NoNcE', '', ?)", alice, time.Now())
+	tdb.Get(&count, "SELECT COUNT(*) FROM UserHost WHERE Nonce = 'nonce'")
+	if count != 0 {
+		t.Errorf("the nonce lookup isn't case-sensitive")
+	}
+}
+
+func TestRehashTokens(t *testing.T) {
+	tdb := openTestDB(t)
+	// the plaintext columns as migrate_hashed_tokens.sql leaves them after step 1
+	tdb.MustExec("ALTER TABLE `UserToken` ADD `Token` varchar(50) NOT NULL DEFAULT ''")
+	tdb.MustExec("ALTER TABLE `Guest` ADD `Token` varchar(50) NOT NULL DEFAULT ''")
+	alice := insertTestUser(t, tdb, "alice")
+	tdb.MustExec("INSERT INTO UserToken (`Token`, `TokenPrefix`, `TokenHash`, `UserId`, `LoginTime`, `LastSeenTime`) " +
+		"VALUES ('user-token-in-the-clear', '', '', ?, ?, ?)", alice, time.Now(), time.Now())
+	tdb.MustExec("INSERT INTO Guest (`Token`, `TokenPrefix`, `TokenHash`, `Handle`, `HostId`, `CreatedDate`) " +
+		"VALUES ('guest-token-in-the-clear', '', '', 'bob', 1, ?)", time.Now())
+	tdb.MustExec("INSERT INTO UserHost (`UserId`, `HostId`, `Nonce`, `Token`, `CreatedDate`) " +
+		"VALUES (?, 1, '', 'foreign-token-in-the-clear', ?)", alice, time.Now())
+
+	// running it again, say after it was interrupted, changes nothing
+	var sealed string
+	for run := 0; run < 2; run++ {
+		err := RehashTokens(tdb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := findToken(tdb, "user-token-in-the-clear")
+		if err != nil || token == nil || token.UserId != alice {
+			t.Errorf("run %d: findToken = %+v, %v", run, token, err)
+		}
+		var hash string
+		tdb.Get(&hash, "SELECT TokenHash FROM Guest WHERE Handle = 'bob'")
+		if !TokenMatches("guest-token-in-the-clear", hash) {
+			t.Errorf("run %d: the guest token wasn't hashed", run)
+		}
+		var stored string
+		tdb.Get(&stored, "SELECT Token FROM UserHost WHERE UserId = ?", alice)
+		if opened, err := OpenToken(stored); err != nil || opened != "foreign-token-in-the-clear" {
+			t.Errorf("run %d: the foreign token opens as %q, %v", run, opened, err)
+		}
+		if run == 1 && stored != sealed {
+			t.Errorf("the foreign token was sealed again")
+		}
+		sealed = stored
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// A token is a session: it expires if it goes unused for too long, and after a fixed lifetime
+// no matter how much it is used. Users can see where they are logged in and log sessions out.
+
+// used when the [policy] config section doesn't say otherwise
+const (
+	DefaultTokenIdleDays = 14
+	DefaultTokenLifetimeDays = 90
+	// last seen time and address are saved at most this often, so every request isn't a write
+	SecondsBetweenTokenTouches = 60
+	SecondsBetweenTokenSweeps = 3600
+	MaximumUserAgentLength = 255
+)
+
+func tokenIdleDuration() time.Duration {
+	days := cfg.Policy.TokenIdleDays
+	if days <= 0 {
+		days = DefaultTokenIdleDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+func tokenLifetime() time.Duration {
+	days := cfg.Policy.TokenLifetimeDays
+	if days <= 0 {
+		days = DefaultTokenLifetimeDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+func (t *UserToken) IsExpired() bool {
+	now := time.Now()
+	return !t.LoginTime.Valid || !t.LastSeenTime.Valid ||
+		now.After(t.LastSeenTime.Time.Add(tokenIdleDuration())) ||
+		now.After(t.LoginTime.Time.Add(tokenLifetime()))
+}
+
+// note that the token has been used by the request's client
+func (t *UserToken) Touch(db *sqlx.DB, r *http.Request) error {
+	ip := getIP(r)
+	userAgent := truncate(r.UserAgent(), MaximumUserAgentLength)
+	if ip == t.IP && userAgent == t.UserAgent &&
+		time.Now().Before(t.LastSeenTime.Time.Add(SecondsBetweenTokenTouches * time.Second)) {
+		return nil
+	}
+
+	t.LastSeenTime.Time = time.Now()
+	t.LastSeenTime.Valid = true
+	t.IP = ip
+	t.UserAgent = userAgent
+	_, err := db.NamedExec("UPDATE `UserToken` SET LastSeenTime = :LastSeenTime, IP = :IP, UserAgent = :UserAgent " +
+		"WHERE TokenId = :TokenId", t)
+	return err
+}
+
+// shorten s to at most max bytes without splitting a character
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return s[:max]
+}
+
+// delete expired tokens, so sessions that are never used again don't pile up
+func DeleteExpiredTokens(db *sqlx.DB) (int64, error) {
+	now := time.Now()
+	result, err := db.Exec("DELETE FROM `UserToken` WHERE LastSeenTime < ? OR LoginTime < ?",
+		now.Add(-tokenIdleDuration()), now.Add(-tokenLifetime()))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// run forever in the background
+func SweepTokens(db *sqlx.DB) {
+	ticker := time.NewTicker(SecondsBetweenTokenSweeps * time.Second)
+	defer ticker.Stop()
+	for {
+		n, err := DeleteExpiredTokens(db)
+		if err != nil {
+			log.Println(err)
+		} else if n > 0 {
+			log.Println("Deleted", n, "expired tokens.")
+		}
+		<-ticker.C
+	}
+}
+
+// the token itself is never shown, sessions are identified by TokenId
+func (t *UserToken) AsSessionMap(current *UserToken) map[string]interface{} {
+	return map[string]interface{}{
+		"TokenId": t.TokenId,
+		"LoginTime": t.LoginTime.Time.Unix(),
+		"LastSeenTime": t.LastSeenTime.Time.Unix(),
+		"IP": t.IP,
+		"UserAgent": t.UserAgent,
+		"Current": t.TokenId == current.TokenId,
+	}
+}
+
+// the authenticated user's unexpired sessions, most recently used first
+func ListSessionsHandler(rw http.ResponseWriter, r *http.Request) {
+	user, token, ok := sessionOwnerFromRequest(rw, r)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	tokens := []UserToken{}
+	err := db.Select(&tokens, "SELECT * FROM `UserToken` WHERE UserId = ? AND LastSeenTime >= ? AND LoginTime >= ? " +
+		"ORDER BY LastSeenTime DESC", user.UserId, now.Add(-tokenIdleDuration()), now.Add(-tokenLifetime()))
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	sessions := make([]map[string]interface{}, len(tokens))
+	for i := range tokens {
+		sessions[i] = tokens[i].AsSessionMap(token)
+	}
+	sendData(rw, http.StatusOK, sessions)
+}
+
+// log out one of the authenticated user's sessions, which may be the current one
+func DeleteSessionHandler(rw http.ResponseWriter, r *http.Request) {
+	user, _, ok := sessionOwnerFromRequest(rw, r)
+	if !ok {
+		return
+	}
+
+	tokenId, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		sendError(rw, http.StatusBadRequest, "Invalid session id.")
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM `UserToken` WHERE TokenId = ? AND UserId = ?", tokenId, user.UserId)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		sendError(rw, http.StatusNotFound, "There is no such session.")
+		return
+	}
+	sendData(rw, http.StatusNoContent, "")
+}
+
+// log out all of the authenticated user's sessions, including the current one
+func DeleteSessionsHandler(rw http.ResponseWriter, r *http.Request) {
+	user, _, ok := sessionOwnerFromRequest(rw, r)
+	if !ok {
+		return
+	}
+
+	err := DeleteUserTokens(db, user.UserId)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sendData(rw, http.StatusNoContent, "")
+}
+
+// like listOwnerFromRequest, but also gives the token the request was made with
+func sessionOwnerFromRequest(rw http.ResponseWriter, r *http.Request) (*User, *UserToken, bool) {
+	user, ok := listOwnerFromRequest(rw, r)
+	if !ok {
+		return nil, nil, false
+	}
+	token, err := FetchToken(db, r)
+	if err != nil || token == nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusUnauthorized, "Unauthorized")
+		return nil, nil, false
+	}
+	return user, token, true
+}
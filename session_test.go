@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAsSessionMap(t *testing.T) {
+	login := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	token := &UserToken{TokenId: 7, IP: "192.0.2.1", UserAgent: "test"}
+	token.LoginTime.Time, token.LoginTime.Valid = login, true
+	token.LastSeenTime.Time, token.LastSeenTime.Valid = login.Add(time.Hour), true
+
+	// dates are Unix seconds, like everywhere else in the API
+	m := token.AsSessionMap(&UserToken{TokenId: 7})
+	if m["LoginTime"] != login.Unix() || m["LastSeenTime"] != login.Add(time.Hour).Unix() {
+		t.Errorf("the session's times are %v and %v", m["LoginTime"], m["LastSeenTime"])
+	}
+	if m["Current"] != true {
+		t.Errorf("the current session isn't marked current")
+	}
+	if m = token.AsSessionMap(&UserToken{TokenId: 8}); m["Current"] != false {
+		t.Errorf("another session is marked current")
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"github.com/jmoiron/sqlx"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Hosts sign their requests to each other, so that no one can pretend to be a host
+// to inject guest tokens or make this host call back to somewhere it shouldn't.
+// Signatures follow the HTTP message signatures draft, and cover the method and path,
+// the name of the receiving host, the Date header and a digest of the body. A host's public key is served at HostKeyPath
+// on its discovered API location, so the key is only as trustworthy as the host's HTTPS certificate.
+// The API location may have a path, like imp.example.com/api, which a proxy usually strips before the request
+// reaches the server, and may change the Host header too. So the path that is signed is relative to the location,
+// and (imp-host) is the receiver's IMP host name, not the Host header.
+
+const (
+	HostKeyPath = "/host/key"
+	SignatureAlgorithm = "ed25519"
+	DefaultSigningKeyFile = "signing.key"
+	// reject signed requests whose Date is further than this from our clock
+	MaximumClockSkewSeconds = 300
+	// a host's public key is fetched again at most this often, in case it has changed
+	SecondsBetweenHostKeyFetches = 300
+	MaximumSignedBodyLength = 1 << 20
+	// looking for the key of a host we don't know yet means requests to wherever the signer says,
+	// so only this many of those are made a minute, across all hosts
+	UnknownHostKeyFetchesPerMinute = 10
+	signedHeaders = "(request-target) (imp-host) date digest"
+)
+
+var signingKey ed25519.PrivateKey
+
+var unknownHostKeyFetches = struct {
+	sync.Mutex
+	count int
+	resetDate time.Time
+}{}
+
+// read this host's signing key, making one the first time the server runs
+func LoadSigningKey(file string) error {
+	if len(file) == 0 {
+		file = DefaultSigningKeyFile
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+		if err != nil {
+			return err
+		}
+		signingKey = key
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return errors.New("The signing key file " + file + " is not PEM encoded.")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return errors.New("The signing key in " + file + " is not an ed25519 key.")
+	}
+	signingKey = edKey
+	return nil
+}
+
+// public, so other hosts can check our signatures
+func GetHostKeyHandler(rw http.ResponseWriter, r *http.Request) {
+	sendData(rw, http.StatusOK, map[string]interface{}{
+			"Host": cfg.Api.Host,
+			"Algorithm": SignatureAlgorithm,
+			"PublicKey": base64.StdEncoding.EncodeToString(signingKey.Public().(ed25519.PublicKey)),
+		})
+}
+
+func bodyDigest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func signingString(method string, requestURI string, hostname string, date string, digest string) string {
+	return "(request-target): " + strings.ToLower(method) + " " + requestURI + "\n" +
+		"(imp-host): " + strings.ToLower(hostname) + "\n" +
+		"date: " + date + "\n" +
+		"digest: " + digest
+}
+
+// make a request to another host, signed by this one
+// the path, with any query, is relative to the host's API location, which must already be located
+// a non-empty body is sent as a form
+func NewSignedRequest(method string, host *Host, path string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequest(method, "https://" + host.Location + path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > 0 {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	date := time.Now().UTC().Format(http.TimeFormat)
+	digest := bodyDigest(body)
+	signature := ed25519.Sign(signingKey, []byte(signingString(method, path, host.Name, date, digest)))
+	req.Header.Set("Date", date)
+	req.Header.Set("Digest", digest)
+	req.Header.Set("Signature", `keyId="` + cfg.Api.Host + `",algorithm="` + SignatureAlgorithm +
+		`",headers="` + signedHeaders + `",signature="` + base64.StdEncoding.EncodeToString(signature) + `"`)
+	return req, nil
+}
+
+// like http.PostForm, but signed
+func PostSignedForm(host *Host, path string, form url.Values) (*http.Response, error) {
+	req, err := NewSignedRequest("POST", host, path, []byte(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	return federationClient.Do(req)
+}
+
+// like http.Get, but signed
+func GetSigned(host *Host, path string) (*http.Response, error) {
+	req, err := NewSignedRequest("GET", host, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return federationClient.Do(req)
+}
+
+// the host that signed the request, or an error if it isn't properly signed
+// the body is read to check its digest, and replaced so the handler can still parse it
+// everything that can be checked without the signer's key is checked before looking for it
+func VerifyHostRequest(db *sqlx.DB, r *http.Request) (*Host, error) {
+	params, err := parseSignature(r.Header.Get("Signature"))
+	if err != nil {
+		return nil, err
+	}
+	if params["algorithm"] != SignatureAlgorithm || params["headers"] != signedHeaders {
+		return nil, errors.New("Unsupported signature.")
+	}
+	signature, err := base64.StdEncoding.DecodeString(params["signature"])
+	if err != nil {
+		return nil, errors.New("Malformed signature.")
+	}
+
+	date := r.Header.Get("Date")
+	sent, err := http.ParseTime(date)
+	if err != nil {
+		return nil, errors.New("Missing or malformed Date header.")
+	}
+	skew := time.Since(sent)
+	if skew > MaximumClockSkewSeconds * time.Second || skew < -MaximumClockSkewSeconds * time.Second {
+		return nil, errors.New("The Date header is too far from the current time.")
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, MaximumSignedBodyLength + 1))
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > MaximumSignedBodyLength {
+		return nil, errors.New("The request body is too long.")
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	digest := r.Header.Get("Digest")
+	if digest != bodyDigest(body) {
+		return nil, errors.New("The Digest header does not match the body.")
+	}
+
+	hostname := params["keyId"]
+	if !hostrx.MatchString(hostname) {
+		return nil, errors.New("Malformed Signature header.")
+	}
+	// nothing is saved about the signer until its signature checks out
+	host, err := FindHost(db, hostname)
+	if err != nil {
+		return nil, err
+	}
+	if host == nil {
+		if !allowUnknownHostKeyFetch() {
+			return nil, errors.New("Too many requests from unknown hosts, try again later.")
+		}
+		host = &Host{Name: hostname}
+	}
+
+	message := []byte(signingString(r.Method, r.URL.RequestURI(), cfg.Api.Host, date, digest))
+	key, err := FetchHostKey(db, host, false)
+	if err != nil || !ed25519.Verify(key, message, signature) {
+		// the host may have a new key
+		key, err = FetchHostKey(db, host, true)
+		if err != nil {
+			return nil, err
+		}
+		if !ed25519.Verify(key, message, signature) {
+			return nil, errors.New("The signature is not valid for " + host.Name + ".")
+		}
+	}
+	if host.HostId == 0 {
+		err = saveNewHost(db, host)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return host, nil
+}
+
+// count a key lookup for a host we don't know, and return false if there have been too many lately
+func allowUnknownHostKeyFetch() bool {
+	unknownHostKeyFetches.Lock()
+	defer unknownHostKeyFetches.Unlock()
+	if time.Now().After(unknownHostKeyFetches.resetDate) {
+		unknownHostKeyFetches.count = 0
+		unknownHostKeyFetches.resetDate = time.Now().Add(time.Minute)
+	}
+	if unknownHostKeyFetches.count >= UnknownHostKeyFetchesPerMinute {
+		return false
+	}
+	unknownHostKeyFetches.count++
+	return true
+}
+
+// add a host that has just proven who it is, keeping what was learned about it while checking
+func saveNewHost(db *sqlx.DB, host *Host) error {
+	saved, err := FetchHost(db, host.Name)
+	if err != nil {
+		return err
+	}
+	host.HostId = saved.HostId
+	_, err = db.NamedExec("UPDATE Host SET Location = :Location, Version = :Version, LocationDate = :LocationDate, " +
+		"PublicKey = :PublicKey, PublicKeyDate = :PublicKeyDate WHERE HostId = :HostId", host)
+	return err
+}
+
+// the parameters of a Signature header, like keyId="example.com",algorithm="ed25519"
+func parseSignature(header string) (map[string]string, error) {
+	if len(header) == 0 {
+		return nil, errors.New("The request is not signed.")
+	}
+	params := map[string]string{}
+	for _, param := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(kv) != 2 || len(kv[1]) < 2 || !strings.HasPrefix(kv[1], `"`) || !strings.HasSuffix(kv[1], `"`) {
+			return nil, errors.New("Malformed Signature header.")
+		}
+		params[kv[0]] = kv[1][1:len(kv[1]) - 1]
+	}
+	if len(params["keyId"]) == 0 || len(params["signature"]) == 0 {
+		return nil, errors.New("Malformed Signature header.")
+	}
+	return params, nil
+}
+
+// the host's public key, from the Host table unless refresh is set and it hasn't been fetched lately
+func FetchHostKey(db *sqlx.DB, host *Host, refresh bool) (ed25519.PublicKey, error) {
+	recent := host.PublicKeyDate.Valid &&
+		time.Now().Before(host.PublicKeyDate.Time.Add(SecondsBetweenHostKeyFetches * time.Second))
+	if len(host.PublicKey) > 0 && (!refresh || recent) {
+		return decodeHostKey(host.PublicKey)
+	}
+	if len(host.PublicKey) == 0 && recent {
+		return nil, errors.New("Could not get the public key of " + host.Name + ".")
+	}
+
+	// remember the attempt even if it fails, so a spoofed host can't make us fetch over and over
+	// a host without an id isn't in the table yet, see VerifyHostRequest
+	host.PublicKeyDate.Time = time.Now()
+	host.PublicKeyDate.Valid = true
+	if host.HostId > 0 {
+		_, err := db.Exec("UPDATE Host SET PublicKeyDate = ? WHERE HostId = ?", host.PublicKeyDate.Time, host.HostId)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := LocateHost(db, host)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := federationClient.Get("https://" + host.Location + HostKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Could not get the public key of " + host.Name + ": " + resp.Status)
+	}
+
+	envelope := struct {
+		Data struct {
+			Host string
+			Algorithm string
+			PublicKey string
+		} `json:"data"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&envelope)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(envelope.Data.Host, host.Name) || envelope.Data.Algorithm != SignatureAlgorithm {
+		return nil, errors.New("The public key served for " + host.Name + " is not for that host.")
+	}
+	key, err := decodeHostKey(envelope.Data.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	host.PublicKey = envelope.Data.PublicKey
+	if host.HostId > 0 {
+		_, err = db.Exec("UPDATE Host SET PublicKey = ? WHERE HostId = ?", host.PublicKey, host.HostId)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+func decodeHostKey(encoded string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("The public key is the wrong size.")
+	}
+	return ed25519.PublicKey(key), nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sign as a.example, with a new key, and return its public half
+func useSigningKey(t *testing.T) ed25519.PublicKey {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedKey, savedHost := signingKey, cfg.Api.Host
+	signingKey, cfg.Api.Host = private, "a.example"
+	t.Cleanup(func() { signingKey, cfg.Api.Host = savedKey, savedHost })
+	return public
+}
+
+// send nothing, but count the attempts
+func useOfflineFederation(t *testing.T) *offlineTransport {
+	offline := &offlineTransport{}
+	useDiscoveryClient(t, &http.Client{Transport: offline})
+	saved := federationClient
+	federationClient = &http.Client{Transport: offline}
+	t.Cleanup(func() { federationClient = saved })
+	return offline
+}
+
+// a request signed by a.example for b.example, whose API is behind a proxy at imp.b.example/api,
+// as b.example receives it once the proxy has stripped the /api
+// change can tamper with the request after it's signed
+func receivedSignedRequest(t *testing.T, change func(req *http.Request)) *http.Request {
+	cfg.Api.Host = "a.example"
+	b := &Host{Name: "b.example", Location: "imp.b.example/api"}
+	req, err := NewSignedRequest("POST", b, "/guest?x=1", []byte("handle=bob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.URL.String() != "https://imp.b.example/api/guest?x=1" {
+		t.Fatalf("request URL = %s", req.URL)
+	}
+	if change != nil {
+		change(req)
+	}
+
+	body, _ := ioutil.ReadAll(req.Body)
+	received := httptest.NewRequest(req.Method, strings.TrimPrefix(req.URL.RequestURI(), "/api"), strings.NewReader(string(body)))
+	received.Header = req.Header
+	received.Host = "localhost:5039"
+	cfg.Api.Host = "b.example"
+	return received
+}
+
+func TestVerifyHostRequestChecksBeforeLookingForTheKey(t *testing.T) {
+	useSigningKey(t)
+	offline := useOfflineFederation(t)
+
+	tests := map[string]func(req *http.Request){
+		"tampered digest": func(req *http.Request) {
+			req.Header.Set("Digest", bodyDigest([]byte("handle=mallory")))
+		},
+		"tampered body": func(req *http.Request) {
+			req.Body = ioutil.NopCloser(strings.NewReader("handle=mallory"))
+		},
+		"stale date": func(req *http.Request) {
+			req.Header.Set("Date", time.Now().Add(-(MaximumClockSkewSeconds + 60) * time.Second).UTC().Format(http.TimeFormat))
+		},
+		"future date": func(req *http.Request) {
+			req.Header.Set("Date", time.Now().Add((MaximumClockSkewSeconds + 60) * time.Second).UTC().Format(http.TimeFormat))
+		},
+		"missing signature": func(req *http.Request) {
+			req.Header.Del("Signature")
+		},
+		"other headers": func(req *http.Request) {
+			req.Header.Set("Signature", strings.Replace(req.Header.Get("Signature"), signedHeaders, "date", 1))
+		},
+	}
+	for name, change := range tests {
+		// there's no database, so getting as far as looking up the signer would panic
+		host, err := VerifyHostRequest(nil, receivedSignedRequest(t, change))
+		if err == nil || host != nil {
+			t.Errorf("%s: VerifyHostRequest = %v, %v, want an error", name, host, err)
+		}
+	}
+	if offline.requests > 0 {
+		t.Errorf("%d requests were made, want none", offline.requests)
+	}
+}
+
+func TestVerifyHostRequest(t *testing.T) {
+	tdb := openTestDB(t)
+	public := useSigningKey(t)
+	offline := useOfflineFederation(t)
+
+	// a.example's key is known
+	tdb.MustExec("INSERT INTO `Host` (`Name`, `Location`, `LocationDate`, `PublicKey`, `PublicKeyDate`) VALUES (?, ?, ?, ?, ?)",
+		"a.example", "imp.a.example", time.Now(), base64.StdEncoding.EncodeToString(public), time.Now())
+
+	r := receivedSignedRequest(t, nil)
+	host, err := VerifyHostRequest(tdb, r)
+	if err != nil || host == nil || host.Name != "a.example" {
+		t.Fatalf("VerifyHostRequest = %v, %v, want a.example", host, err)
+	}
+	r.ParseForm()
+	if r.PostFormValue("handle") != "bob" {
+		t.Errorf("the handler can't read the body")
+	}
+
+	// signed for another host
+	r = receivedSignedRequest(t, nil)
+	cfg.Api.Host = "c.example"
+	if _, err := VerifyHostRequest(tdb, r); err == nil {
+		t.Errorf("a request signed for b.example was accepted by c.example")
+	}
+
+	// signed for another path
+	r = receivedSignedRequest(t, func(req *http.Request) {
+		req.URL.Path = "/api/moved"
+	})
+	if _, err := VerifyHostRequest(tdb, r); err == nil {
+		t.Errorf("a request signed for /guest was accepted for /moved")
+	}
+
+	// signed by someone else's key, in a.example's name
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	signingKey = other
+	r = receivedSignedRequest(t, nil)
+	if _, err := VerifyHostRequest(tdb, r); err == nil {
+		t.Errorf("a request signed with another key was accepted")
+	}
+
+	if offline.requests > 1 {
+		t.Errorf("%d requests were made, want at most one key refresh", offline.requests)
+	}
+}
+
+func TestVerifyHostRequestFromAnUnknownHost(t *testing.T) {
+	tdb := openTestDB(t)
+	useSigningKey(t)
+	useOfflineFederation(t)
+
+	// nobody knows a.example, and its key can't be found
+	_, err := VerifyHostRequest(tdb, receivedSignedRequest(t, nil))
+	if err == nil {
+		t.Errorf("a request from an unknown host was accepted")
+	}
+	var count int
+	tdb.Get(&count, "SELECT COUNT(*) FROM `Host`")
+	if count != 0 {
+		t.Errorf("%d hosts were saved, want none", count)
+	}
+}
@@ -15,10 +15,18 @@ import (
 )
 
 type UserToken struct {
-	Token string
+	// identifies the session without revealing the token
+	TokenId int64
+	// only known when the token is made or presented, never stored
+	Token string `db:"-"`
+	TokenPrefix string
+	TokenHash string
 	UserId int64
 	LoginTime mysql.NullTime
 	LastSeenTime mysql.NullTime
+	// where the token was last used from
+	IP string
+	UserAgent string
 }
 
 func PostTokenHandler(rw http.ResponseWriter, r *http.Request) {
@@ -69,7 +77,7 @@ func PostTokenHandler(rw http.ResponseWriter, r *http.Request) {
 
     var u User
     err = db.Get(&u, "SELECT `UserId`, `Handle`, `Status`, `Biography`, `PasswordHash`, `JoinedDate` FROM `User` " +
-		"WHERE Handle LIKE ? OR Email LIKE ? LIMIT 1", handleOrEmail, handleOrEmail)
+		"WHERE Handle = ? OR Email = ? LIMIT 1", handleOrEmail, handleOrEmail)
     if err == sql.ErrNoRows {
     	// in order to prevent not found user failing more quickly than bad password
     	// proceed with checking password against dummy hash
@@ -102,7 +110,7 @@ func PostTokenHandler(rw http.ResponseWriter, r *http.Request) {
 	}
 	limit.Clear(db)
 
-	t, err := MakeToken(db, &u)
+	t, err := MakeToken(db, &u, r)
 	if err != nil {
 		sendError(rw, http.StatusInternalServerError, err.Error())
 		return
@@ -116,8 +124,31 @@ func PostTokenHandler(rw http.ResponseWriter, r *http.Request) {
 	sendData(rw, http.StatusCreated, resp)
 }
 
+// log out, only with the token's own user's token
 func DeleteTokenHandler(rw http.ResponseWriter, r *http.Request) {
-	err := DeleteToken(db, mux.Vars(r)["token"])
+	token, err := FetchToken(db, r)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if token == nil {
+		sendError(rw, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	t, err := findToken(db, mux.Vars(r)["token"])
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if t == nil || t.UserId != token.UserId {
+		sendError(rw, http.StatusNotFound, "There is no such token.")
+		return
+	}
+
+	err = DeleteToken(db, t.TokenId)
 	if err != nil {
 		fmt.Println(err)
 		sendError(rw, http.StatusInternalServerError, err.Error())
@@ -127,62 +158,170 @@ func DeleteTokenHandler(rw http.ResponseWriter, r *http.Request) {
 	sendData(rw, http.StatusNoContent, "")
 }
 
+const (
+	UserAuthPrefix = "IMP user="
+	GuestAuthPrefix = "IMP guest="
+)
+
+// whoever is making a request: either a user of this host or a guest from another host
+type Principal struct {
+	// nil for guests
+	Token *UserToken
+	// nil for local users
+	Guest *Guest
+	Address *Address
+}
+
+func (p *Principal) IsGuest() bool {
+	return p.Guest != nil
+}
+
+// local user id, or 0 for a guest
+func (p *Principal) UserId() int64 {
+	if p.Token == nil {
+		return 0
+	}
+	return p.Token.UserId
+}
+
+// for acting on behalf of a user who has already been authenticated
+func UserPrincipal(user *User) *Principal {
+	return &Principal{Token: &UserToken{UserId: user.UserId}, Address: LocalAddress(user.Handle)}
+}
+
+// only finds tokens of local users, guests are treated as unauthenticated
 func FetchToken(db *sqlx.DB, r *http.Request)  (*UserToken, error) {
 	auth := r.Header.Get("Authorization")
-	userPrefix := "IMP user="
-	guestPrefix := "IMP guest="
 
-	if strings.HasPrefix(auth, userPrefix) {
-		token := auth[len(userPrefix):]
+	if strings.HasPrefix(auth, UserAuthPrefix) {
+		token := auth[len(UserAuthPrefix):]
 
-		t := new(UserToken)
-		err := db.Get(t, "SELECT `Token`, `UserId`, `LoginTime`, `LastSeenTime` FROM `UserToken` WHERE Token LIKE ? LIMIT 1", token)
-		if err == sql.ErrNoRows {
-			return nil, nil
-		} else if err != nil {
+		t, err := findToken(db, token)
+		if err != nil {
 		    log.Println(err)
 		    return nil, err
 		}
+		if t == nil {
+			return nil, nil
+		}
+
+		if t.IsExpired() {
+			err = DeleteToken(db, t.TokenId)
+			if err != nil {
+			    log.Println(err)
+			}
+			return nil, nil
+		}
+		err = t.Touch(db, r)
+		if err != nil {
+		    log.Println(err)
+		}
 		return t, nil
 	}
 
-	if strings.HasPrefix(auth, guestPrefix) {
-		// token := auth[len(guestPrefix):]
+	return nil, nil
+}
+
+// finds either a local user or a guest
+func FetchPrincipal(db *sqlx.DB, r *http.Request) (*Principal, error) {
+	auth := r.Header.Get("Authorization")
+
+	if strings.HasPrefix(auth, UserAuthPrefix) {
+		t, err := FetchToken(db, r)
+		if err != nil || t == nil {
+			return nil, err
+		}
+		user, err := FetchUser(db, t.UserId)
+		if err != nil || user == nil {
+			return nil, err
+		}
+		return &Principal{Token: t, Address: LocalAddress(user.Handle)}, nil
+	}
+
+	if strings.HasPrefix(auth, GuestAuthPrefix) {
+		token := auth[len(GuestAuthPrefix):]
 
-		// TODO: guest auth
-		// t := new(UserToken)
-		// err := db.Get(t, "SELECT `Token`, `UserId`, `LoginTime`, `LastSeenTime` FROM `UserToken` WHERE Token LIKE ? LIMIT 1", token)
-		// if err == sql.ErrNoRows {
-		// 	return nil, nil
-		// } else if err != nil {
-		//     log.Println(err)
-		//     return nil, err
-		// }
-		// return t, nil
+		guests := []Guest{}
+		err := db.Select(&guests, "SELECT * FROM `Guest` WHERE TokenPrefix = ?", TokenPrefix(token))
+		if err != nil {
+		    log.Println(err)
+		    return nil, err
+		}
+		var guest *Guest
+		for i := range guests {
+			if TokenMatches(token, guests[i].TokenHash) {
+				guest = &guests[i]
+			}
+		}
+		if guest == nil {
+			return nil, nil
+		}
+
+		var hostname string
+		err = db.Get(&hostname, "SELECT Name FROM `Host` WHERE HostId = ?", guest.HostId)
+		if err == sql.ErrNoRows {
+			return nil, nil
+		} else if err != nil {
+		    log.Println(err)
+		    return nil, err
+		}
+		return &Principal{Guest: guest, Address: &Address{Handle: guest.Handle, Host: hostname}}, nil
 	}
 
 	return nil, nil
 }
 
-func MakeToken(db *sqlx.DB, user *User) (*UserToken, error) {
+// log the user in from the request's client
+func MakeToken(db *sqlx.DB, user *User, r *http.Request) (*UserToken, error) {
 	t := new(UserToken)
 	t.Token = RandomString(50)
+	t.TokenPrefix = TokenPrefix(t.Token)
+	t.TokenHash = TokenHash(t.Token)
 	t.UserId = user.UserId
 	t.LoginTime.Time = time.Now()
 	t.LoginTime.Valid = true
 	t.LastSeenTime.Time = time.Now()
 	t.LastSeenTime.Valid = true
+	t.IP = getIP(r)
+	t.UserAgent = truncate(r.UserAgent(), MaximumUserAgentLength)
 
-	_, err := db.NamedExec("INSERT INTO `UserToken` (`Token`, `UserId`, `LoginTime`, `LastSeenTime`) " +
-			"VALUES (:Token, :UserId, :LoginTime, :LastSeenTime)", t)
+	result, err := db.NamedExec("INSERT INTO `UserToken` (`TokenPrefix`, `TokenHash`, `UserId`, `LoginTime`, `LastSeenTime`, `IP`, `UserAgent`) " +
+			"VALUES (:TokenPrefix, :TokenHash, :UserId, :LoginTime, :LastSeenTime, :IP, :UserAgent)", t)
+	if err != nil {
+		return nil, err
+	}
+	t.TokenId, err = result.LastInsertId()
 	if err != nil {
 		return nil, err
 	}
 	return t, nil
 }
 
-func DeleteToken(db *sqlx.DB, token string) (err error) {
-	_, err = db.Exec("DELETE FROM `UserToken` WHERE Token LIKE ?", token)
+// the user token with this value, or nil
+// tokens are found by their prefix, and the hash compared in constant time
+func findToken(db *sqlx.DB, token string) (*UserToken, error) {
+	tokens := []UserToken{}
+	err := db.Select(&tokens, "SELECT * FROM `UserToken` WHERE TokenPrefix = ?", TokenPrefix(token))
+	if err != nil {
+		return nil, err
+	}
+	for i := range tokens {
+		if TokenMatches(token, tokens[i].TokenHash) {
+			tokens[i].Token = token
+			return &tokens[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func DeleteToken(db *sqlx.DB, tokenId int64) (err error) {
+	_, err = db.Exec("DELETE FROM `UserToken` WHERE TokenId = ?", tokenId)
+	return
+}
+
+// log the user out everywhere
+func DeleteUserTokens(db *sqlx.DB, userId int64) (err error) {
+	_, err = db.Exec("DELETE FROM `UserToken` WHERE UserId = ?", userId)
 	return
 }
 
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"database/sql"
 	"fmt"
 	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
 	"golang.org/x/crypto/bcrypt"
 	"net/mail"
 	"net/http"
@@ -12,15 +14,29 @@ import (
 type User struct {
 	UserId int64
 	Handle string
+	// the status and essence, stored the way parseNote stores a note
 	Status string
+	StatusLink sql.NullString
+	StatusDate mysql.NullTime
+	StatusPending bool
 	Biography string
+	BiographyLink sql.NullString
+	BiographyPending bool
 	Email string
 	IsValidEmail bool
-	EmailValidationToken string
+	// never sent to the user, only emailed to them
+	EmailValidationToken sql.NullString `json:"-"`
 	EmailValidationDate mysql.NullTime
 	PasswordHash string
+	// hash of the emailed password reset token
+	PasswordResetHash sql.NullString `json:"-"`
+	PasswordResetDate mysql.NullTime
 	JoinedDate mysql.NullTime
 	IsDisabled bool
+	// one of the ReplyPolicy constants
+	ReplyPolicy string
+	// the user's address on another host, if they've moved there
+	MovedTo string
 }
 
 func PostUserHandler(rw http.ResponseWriter, r *http.Request) {
@@ -48,6 +64,16 @@ func PostUserHandler(rw http.ResponseWriter, r *http.Request) {
     	sendError(rw, http.StatusBadRequest, "Missing handle.")
 		return
 	}
+	if !IsValidHandle(handle) {
+		fmt.Println("Invalid handle.")
+		sendError(rw, http.StatusBadRequest, "Handles must be 1 to 16 characters of underscores, digits and the letters A to Z.")
+		return
+	}
+	if IsReservedHandle(handle) {
+		fmt.Println("Reserved handle.")
+		sendError(rw, http.StatusBadRequest, "That handle is reserved.")
+		return
+	}
 
 	email, err := mail.ParseAddress(r.PostFormValue("email"))
 	if err != nil {
@@ -56,17 +82,17 @@ func PostUserHandler(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-    // TODO: check password strength
 	password := r.PostFormValue("password")
-	if len(password) == 0 {
-		fmt.Println("Missing password.")
-    	sendError(rw, http.StatusBadRequest, "Missing password.")
+	failed := CheckPassword(password, handle, email.Address)
+	if len(failed) > 0 {
+		fmt.Println("Weak password.")
+		sendErrors(rw, http.StatusBadRequest, failed)
 		return
 	}
 
 	// look up handle to see if this user already exists
     var count int64
-    err = db.Get(&count, "SELECT COUNT(*) FROM User WHERE Handle LIKE ?", handle)
+    err = db.Get(&count, "SELECT COUNT(*) FROM User WHERE Handle = ?", handle)
 	if err != nil {
 		fmt.Println(err)
 		sendError(rw, http.StatusInternalServerError, err.Error())
@@ -78,7 +104,7 @@ func PostUserHandler(rw http.ResponseWriter, r *http.Request) {
 		return
     }
 
-    err = db.Get(&count, "SELECT COUNT(*) FROM User WHERE Email LIKE ?", email.Address)
+    err = db.Get(&count, "SELECT COUNT(*) FROM User WHERE Email = ?", email.Address)
 	if err != nil {
 		fmt.Println(err)
 		sendError(rw, http.StatusInternalServerError, err.Error())
@@ -102,6 +128,7 @@ func PostUserHandler(rw http.ResponseWriter, r *http.Request) {
     u.Email = email.Address
     u.Status = ""
     u.Biography = ""
+    u.ReplyPolicy = ReplyPolicyEveryone
     u.PasswordHash = string(hash)
 	fmt.Println(u)
 
@@ -117,8 +144,14 @@ func PostUserHandler(rw http.ResponseWriter, r *http.Request) {
 		fmt.Println(err)
 	}
 
+	err = StartEmailVerification(db, &u)
+	if err != nil {
+		fmt.Println(err)
+		// the user can ask for another verification email later
+	}
+
 	// go ahead and log user in
-	t, err := MakeToken(db, &u)
+	t, err := MakeToken(db, &u, r)
 	if err != nil {
 		fmt.Println(err)
 		// something went wrong, but at least we created the user, so don't die here
@@ -132,3 +165,57 @@ func PostUserHandler(rw http.ResponseWriter, r *http.Request) {
 
 	sendData(rw, http.StatusCreated, resp)
 }
+
+// edit the authenticated user's settings
+func PutUserHandler(rw http.ResponseWriter, r *http.Request) {
+	user, ok := listOwnerFromRequest(rw, r)
+	if !ok {
+		return
+	}
+
+	r.ParseForm()
+	replyPolicy := r.PostFormValue("reply_policy")
+	if len(replyPolicy) > 0 {
+		if !IsValidReplyPolicy(replyPolicy) {
+			sendError(rw, http.StatusBadRequest, "Reply policy must be everyone, followers, following or nobody.")
+			return
+		}
+		user.ReplyPolicy = replyPolicy
+	}
+
+	_, err := db.NamedExec("UPDATE User SET ReplyPolicy = :ReplyPolicy WHERE UserId = :UserId", user)
+	if err != nil {
+		fmt.Println(err)
+		sendError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sendData(rw, http.StatusOK, map[string]interface{}{
+			"ReplyPolicy": user.ReplyPolicy,
+		})
+}
+
+func FetchUser(db *sqlx.DB, userId int64) (*User, error) {
+	user := new(User)
+	err := db.Get(user, "SELECT * FROM User WHERE UserId = ?", userId)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// handles are matched case-insensitively by the column's collation
+func FetchUserByHandle(db *sqlx.DB, handle string) (*User, error) {
+	if !IsValidHandle(handle) {
+		return nil, nil
+	}
+	user := new(User)
+	err := db.Get(user, "SELECT * FROM User WHERE Handle = ?", handle)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return user, nil
+}